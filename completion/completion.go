@@ -0,0 +1,253 @@
+package completion
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/NBISweden/sda-cli/helpers"
+	"gopkg.in/ini.v1"
+)
+
+// Help text and command line flags.
+
+// Usage text that will be displayed as command line help text when using the
+// `help completion` command
+var Usage = `
+USAGE: %s completion [bash | zsh | fish]
+
+completion:
+    Prints a shell completion script for bash, zsh or fish, which
+    completes the commands, their flags, and the names of the profiles
+    in ~/.sda-cli/config.  Load it in the shell, e.g. with
+    "sda-cli completion bash > ~/.bash_completion.d/sda-cli".
+`
+
+// ArgHelp is the suffix text that will be displayed after the argument list in
+// the module help
+var ArgHelp = `
+    [shell]
+        The shell to print the completion script for, bash, zsh or fish.`
+
+// Args is a flagset that needs to be exported so that it can be written to the
+// main program help
+var Args = flag.NewFlagSet("completion", flag.ExitOnError)
+
+// Command is a subcommand of the tool, for which completions are generated
+type Command struct {
+	Name  string
+	Usage string
+	Args  *flag.FlagSet
+}
+
+// programName is the name that the completions are registered for
+const programName = "sda-cli"
+
+// Completion prints the completion script for the shell given as argument.
+// The hidden argument `profiles` lists the profile names, which the scripts
+// use to complete the `-profile` flag.
+func Completion(args []string, commands []Command) error {
+	err := Args.Parse(args[1:])
+	if err != nil {
+		return fmt.Errorf("could not parse arguments: %s", err)
+	}
+	if len(Args.Args()) != 1 {
+		return errors.New("a single shell must be given, bash, zsh or fish")
+	}
+
+	sort.Slice(commands, func(i, j int) bool {
+		return commands[i].Name < commands[j].Name
+	})
+
+	switch shell := Args.Args()[0]; shell {
+	case "bash":
+		writeBash(os.Stdout, commands)
+	case "zsh":
+		writeZsh(os.Stdout, commands)
+	case "fish":
+		writeFish(os.Stdout, commands)
+	case "profiles":
+		return printProfiles(os.Stdout)
+	default:
+		return fmt.Errorf("unsupported shell: %s", shell)
+	}
+
+	return nil
+}
+
+// printProfiles writes the names of the profiles in ~/.sda-cli/config to w,
+// one per line. A missing file has no profiles.
+func printProfiles(w io.Writer) error {
+	profilesPath, err := helpers.ProfilesPath()
+	if err != nil {
+		return err
+	}
+	if !helpers.FileExists(profilesPath) {
+		return nil
+	}
+	cfg, err := ini.Load(profilesPath)
+	if err != nil {
+		return fmt.Errorf("failed to read profiles, reason: %w", err)
+	}
+	for _, name := range cfg.SectionStrings() {
+		if name != ini.DefaultSection {
+			fmt.Fprintln(w, name)
+		}
+	}
+
+	return nil
+}
+
+// flagInfo is a flag of a command
+type flagInfo struct {
+	name        string
+	description string
+	isBool      bool
+}
+
+// commandFlags returns the flags of a command, sorted by name
+func commandFlags(command Command) []flagInfo {
+	var flags []flagInfo
+	if command.Args == nil {
+		return flags
+	}
+	command.Args.VisitAll(func(f *flag.Flag) {
+		boolFlag, ok := f.Value.(interface{ IsBoolFlag() bool })
+		flags = append(flags, flagInfo{
+			name:        f.Name,
+			description: strings.Split(f.Usage, "\n")[0],
+			isBool:      ok && boolFlag.IsBoolFlag(),
+		})
+	})
+
+	return flags
+}
+
+// description returns the first sentence of the description in the usage text
+// of a command
+func description(command Command) string {
+	lines := strings.Split(command.Usage, "\n")
+	for i, line := range lines {
+		if strings.TrimSpace(line) != command.Name+":" {
+			continue
+		}
+		var text []string
+		for _, line := range lines[i+1:] {
+			if strings.TrimSpace(line) == "" {
+				break
+			}
+			text = append(text, strings.TrimSpace(line))
+		}
+		sentence, _, _ := strings.Cut(strings.Join(text, " "), ". ")
+
+		return strings.TrimSuffix(sentence, ".")
+	}
+
+	return ""
+}
+
+// quote returns s in single quotes for the shell
+func quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// writeBash writes the completion script for bash to w
+func writeBash(w io.Writer, commands []Command) {
+	names := []string{"help"}
+	for _, command := range commands {
+		names = append(names, command.Name)
+	}
+
+	fmt.Fprintf(w, "# bash completion for %s\n", programName)
+	fmt.Fprintln(w, "_sda_cli() {")
+	fmt.Fprintln(w, `    local cur="${COMP_WORDS[COMP_CWORD]}" prev="${COMP_WORDS[COMP_CWORD-1]}" flags=""`)
+	fmt.Fprintln(w, `    if [ "$COMP_CWORD" -eq 1 ]; then`)
+	fmt.Fprintf(w, "        COMPREPLY=($(compgen -W %s -- \"$cur\"))\n", quote(strings.Join(names, " ")))
+	fmt.Fprintln(w, "        return")
+	fmt.Fprintln(w, "    fi")
+	fmt.Fprintln(w, `    if [ "$prev" = "-profile" ] || [ "$prev" = "--profile" ]; then`)
+	fmt.Fprintln(w, `        COMPREPLY=($(compgen -W "$("${COMP_WORDS[0]}" completion profiles 2>/dev/null)" -- "$cur"))`)
+	fmt.Fprintln(w, "        return")
+	fmt.Fprintln(w, "    fi")
+	fmt.Fprintln(w, `    case "${COMP_WORDS[1]}" in`)
+	for _, command := range commands {
+		var flags []string
+		for _, f := range commandFlags(command) {
+			flags = append(flags, "-"+f.name)
+		}
+		fmt.Fprintf(w, "        %s) flags=%s ;;\n", command.Name, quote(strings.Join(flags, " ")))
+	}
+	fmt.Fprintln(w, "    esac")
+	fmt.Fprintln(w, `    if [[ "$cur" == -* ]]; then`)
+	fmt.Fprintln(w, `        COMPREPLY=($(compgen -W "$flags" -- "$cur"))`)
+	fmt.Fprintln(w, "    else")
+	fmt.Fprintln(w, `        COMPREPLY=($(compgen -f -- "$cur"))`)
+	fmt.Fprintln(w, "    fi")
+	fmt.Fprintln(w, "}")
+	fmt.Fprintf(w, "complete -o filenames -F _sda_cli %s\n", programName)
+}
+
+// writeZsh writes the completion script for zsh to w
+func writeZsh(w io.Writer, commands []Command) {
+	fmt.Fprintf(w, "#compdef %s\n\n", programName)
+	fmt.Fprintln(w, "_sda_cli() {")
+	fmt.Fprintln(w, "    local -a commands flags profiles")
+	fmt.Fprintln(w, "    commands=(")
+	fmt.Fprintln(w, "        'help:Show the help of a command'")
+	for _, command := range commands {
+		fmt.Fprintf(w, "        %s\n", quote(command.Name+":"+description(command)))
+	}
+	fmt.Fprintln(w, "    )")
+	fmt.Fprintln(w, "    if (( CURRENT == 2 )); then")
+	fmt.Fprintln(w, "        _describe 'command' commands")
+	fmt.Fprintln(w, "        return")
+	fmt.Fprintln(w, "    fi")
+	fmt.Fprintln(w, "    if [[ ${words[CURRENT-1]} == -profile || ${words[CURRENT-1]} == --profile ]]; then")
+	fmt.Fprintln(w, `        profiles=(${(f)"$(${words[1]} completion profiles 2>/dev/null)"})`)
+	fmt.Fprintln(w, "        compadd -a profiles")
+	fmt.Fprintln(w, "        return")
+	fmt.Fprintln(w, "    fi")
+	fmt.Fprintln(w, "    case ${words[2]} in")
+	for _, command := range commands {
+		var flags []string
+		for _, f := range commandFlags(command) {
+			flags = append(flags, quote("-"+f.name+":"+f.description))
+		}
+		fmt.Fprintf(w, "        %s) flags=(%s) ;;\n", command.Name, strings.Join(flags, " "))
+	}
+	fmt.Fprintln(w, "    esac")
+	fmt.Fprintln(w, "    if [[ $PREFIX == -* ]]; then")
+	fmt.Fprintln(w, "        _describe 'flag' flags")
+	fmt.Fprintln(w, "    else")
+	fmt.Fprintln(w, "        _files")
+	fmt.Fprintln(w, "    fi")
+	fmt.Fprintln(w, "}")
+	fmt.Fprintf(w, "\ncompdef _sda_cli %s\n", programName)
+}
+
+// writeFish writes the completion script for fish to w
+func writeFish(w io.Writer, commands []Command) {
+	fmt.Fprintf(w, "# fish completion for %s\n", programName)
+	fmt.Fprintf(w, "complete -c %s -n __fish_use_subcommand -f -a help -d %s\n", programName, quote("Show the help of a command"))
+	for _, command := range commands {
+		fmt.Fprintf(w, "complete -c %s -n __fish_use_subcommand -f -a %s -d %s\n", programName, command.Name, quote(description(command)))
+	}
+	for _, command := range commands {
+		condition := quote("__fish_seen_subcommand_from " + command.Name)
+		for _, f := range commandFlags(command) {
+			switch {
+			case f.name == "profile":
+				fmt.Fprintf(w, "complete -c %s -n %s -o %s -x -a %s -d %s\n", programName, condition, f.name,
+					quote("("+programName+" completion profiles 2>/dev/null)"), quote(f.description))
+			case f.isBool:
+				fmt.Fprintf(w, "complete -c %s -n %s -o %s -d %s\n", programName, condition, f.name, quote(f.description))
+			default:
+				fmt.Fprintf(w, "complete -c %s -n %s -o %s -r -d %s\n", programName, condition, f.name, quote(f.description))
+			}
+		}
+	}
+}
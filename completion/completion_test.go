@@ -0,0 +1,90 @@
+package completion
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type CompletionTests struct {
+	suite.Suite
+	commands []Command
+}
+
+func TestCompletionTestSuite(t *testing.T) {
+	suite.Run(t, new(CompletionTests))
+}
+
+func (suite *CompletionTests) SetupTest() {
+	args := flag.NewFlagSet("list", flag.ContinueOnError)
+	args.String("profile", "", "Named profile to use.")
+	args.Bool("r", false, "List recursively.\nSecond line.")
+	suite.commands = []Command{{
+		Name:  "list",
+		Usage: "\nUSAGE: %s list [-r]\n\nlist:\n    Lists the user's files.  Use '-r' to list\n    recursively.\n",
+		Args:  args,
+	}}
+}
+
+func (suite *CompletionTests) TestDescription() {
+	assert.Equal(suite.T(), "Lists the user's files", description(suite.commands[0]))
+	assert.Equal(suite.T(), "", description(Command{Name: "other", Usage: "USAGE: %s other"}))
+}
+
+func (suite *CompletionTests) TestCommandFlags() {
+	assert.Equal(suite.T(), []flagInfo{
+		{name: "profile", description: "Named profile to use."},
+		{name: "r", description: "List recursively.", isBool: true},
+	}, commandFlags(suite.commands[0]))
+}
+
+func (suite *CompletionTests) TestWriteBash() {
+	var out bytes.Buffer
+	writeBash(&out, suite.commands)
+	assert.Contains(suite.T(), out.String(), "compgen -W 'help list' -- \"$cur\"")
+	assert.Contains(suite.T(), out.String(), "list) flags='-profile -r' ;;")
+	assert.Contains(suite.T(), out.String(), "complete -o filenames -F _sda_cli sda-cli\n")
+}
+
+func (suite *CompletionTests) TestWriteZsh() {
+	var out bytes.Buffer
+	writeZsh(&out, suite.commands)
+	assert.Contains(suite.T(), out.String(), `'list:Lists the user'\''s files'`)
+	assert.Contains(suite.T(), out.String(), "list) flags=('-profile:Named profile to use.' '-r:List recursively.') ;;")
+}
+
+func (suite *CompletionTests) TestWriteFish() {
+	var out bytes.Buffer
+	writeFish(&out, suite.commands)
+	assert.Contains(suite.T(), out.String(), "complete -c sda-cli -n '__fish_seen_subcommand_from list' -o profile -x -a '(sda-cli completion profiles 2>/dev/null)' -d 'Named profile to use.'\n")
+	assert.Contains(suite.T(), out.String(), "complete -c sda-cli -n '__fish_seen_subcommand_from list' -o r -d 'List recursively.'\n")
+}
+
+func (suite *CompletionTests) TestPrintProfiles() {
+	home := suite.T().TempDir()
+	suite.T().Setenv("HOME", home)
+
+	// No profiles file is not an error
+	var out bytes.Buffer
+	assert.NoError(suite.T(), printProfiles(&out))
+	assert.Empty(suite.T(), out.String())
+
+	assert.NoError(suite.T(), os.MkdirAll(filepath.Join(home, ".sda-cli"), 0700))
+	err := os.WriteFile(filepath.Join(home, ".sda-cli", "config"), []byte("[bp]\naccess_key = a\n\n[fega]\naccess_key = b\n"), 0600)
+	assert.NoError(suite.T(), err)
+	assert.NoError(suite.T(), printProfiles(&out))
+	assert.Equal(suite.T(), "bp\nfega\n", out.String())
+}
+
+func (suite *CompletionTests) TestUnsupportedShell() {
+	err := Completion([]string{"completion", "powershell"}, suite.commands)
+	assert.EqualError(suite.T(), err, "unsupported shell: powershell")
+
+	err = Completion([]string{"completion"}, suite.commands)
+	assert.EqualError(suite.T(), err, "a single shell must be given, bash, zsh or fish")
+}
@@ -0,0 +1,225 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/NBISweden/sda-cli/helpers"
+)
+
+// Help text and command line flags.
+
+// Usage text that will be displayed as command line help text when using the
+// `help config` command
+var Usage = `
+USAGE: %s config validate [-config <s3config-file>] [-profile <name>]
+
+config:
+    Checks the configuration file.  With 'validate', all fields of the
+    configuration are checked, and the fields that are missing or
+    malformed are reported: the access key, the access token, which
+    must be a JWT that has not expired, the host, which must be a valid
+    URL, and the public key, if given, which must decode to 32 bytes or
+    be a https URL, and the TLS client certificate and the CA
+    certificates, if given.  The exit code is 0 only if all checks pass.
+    If no config is specified, the tool will look for a previous
+    session, or the profile given with '-profile' in ~/.sda-cli/config.
+`
+
+// ArgHelp is the suffix text that will be displayed after the argument list in
+// the module help
+var ArgHelp = `
+    [validate]
+        Check the fields of the configuration.`
+
+// Args is a flagset that needs to be exported so that it can be written to the
+// main program help
+var Args = flag.NewFlagSet("config", flag.ExitOnError)
+
+var configPath = Args.String("config", "",
+	"S3 config file to check.")
+
+var profile = Args.String("profile", "",
+	"Named profile in ~/.sda-cli/config to check instead of the session file.")
+
+// fieldCheck is the result of the check of a field in the configuration. An
+// empty problem means that the field is valid.
+type fieldCheck struct {
+	field   string
+	problem string
+}
+
+// Config runs the mode of the config command given as argument.
+func Config(args []string) error {
+	err := helpers.ParseArgs(args, Args)
+	if err != nil {
+		return fmt.Errorf("could not parse arguments: %s", err)
+	}
+	if len(Args.Args()) != 1 {
+		return errors.New("a single mode must be given, validate")
+	}
+
+	switch mode := Args.Args()[0]; mode {
+	case "validate":
+		return validate(os.Stdout)
+	default:
+		return fmt.Errorf("unsupported mode: %s", mode)
+	}
+}
+
+// validate checks the fields of the configuration file and writes the result
+// of each check to w. It returns an error if any check failed.
+func validate(w io.Writer) error {
+	path, err := helpers.FindConfigFile(*configPath, *profile)
+	if err != nil {
+		return helpers.WithCategory(helpers.ErrConfig, fmt.Errorf("no configuration file found, reason: %w", err))
+	}
+	config, err := helpers.ReadConfigFile(path, *profile)
+	if err != nil {
+		return helpers.WithCategory(helpers.ErrConfig, fmt.Errorf("failed to read %s, reason: %w", path, err))
+	}
+
+	fmt.Fprintf(w, "Checking %s\n", path)
+	failed := 0
+	for _, check := range checkConfig(config) {
+		if check.problem == "" {
+			fmt.Fprintf(w, "  %s: ok\n", check.field)
+
+			continue
+		}
+		fmt.Fprintf(w, "  %s: %s\n", check.field, check.problem)
+		failed++
+	}
+
+	if failed > 0 {
+		return helpers.WithCategory(helpers.ErrConfig, fmt.Errorf("%d of the fields in %s are missing or malformed", failed, path))
+	}
+	fmt.Fprintln(w, "The configuration is valid")
+
+	return nil
+}
+
+// checkConfig checks the fields of the configuration, in the order of the
+// configuration file written by login
+func checkConfig(config *helpers.Config) []fieldCheck {
+	checks := []fieldCheck{
+		{field: "access_key", problem: checkAccessKey(config.AccessKey)},
+		{field: "access_token", problem: checkAccessToken(config.AccessToken)},
+		{field: "host_base", problem: checkHostBase(config.HostBase, config.UseHTTPS)},
+	}
+	// The public key is only needed to encrypt without a key file
+	if config.PublicKey != "" {
+		checks = append(checks, fieldCheck{field: "public_key", problem: checkPublicKey(config.PublicKey)})
+	}
+	if config.TLSCert != "" || config.TLSKey != "" {
+		checks = append(checks, fieldCheck{field: "tls_cert", problem: checkTLSCert(config.TLSCert, config.TLSKey)})
+	}
+	if config.CACert != "" {
+		checks = append(checks, fieldCheck{field: "ca_cert", problem: checkCACert(config.CACert)})
+	}
+
+	return checks
+}
+
+func checkAccessKey(accessKey string) string {
+	if accessKey == "" {
+		return "missing"
+	}
+
+	return ""
+}
+
+// checkAccessToken checks that the token is a JWT with an expiration time
+// that has not passed
+func checkAccessToken(accessToken string) string {
+	if accessToken == "" {
+		return "missing"
+	}
+	expiration, err := helpers.TokenExpiration(accessToken)
+	if err != nil {
+		return fmt.Sprintf("malformed, %v", err)
+	}
+	if time.Now().After(expiration) {
+		return fmt.Sprintf("expired at %v, log in again", expiration.Local().Format(time.RFC1123))
+	}
+
+	return ""
+}
+
+// checkHostBase checks that the host, which may be given without a scheme as
+// in s3cmd configuration files, is a valid http(s) URL
+func checkHostBase(hostBase string, useHTTPS bool) string {
+	if hostBase == "" {
+		return "missing"
+	}
+	if err := helpers.ValidateHostBase(hostBase, useHTTPS); err != nil {
+		return fmt.Sprintf("malformed, %v", err)
+	}
+
+	return ""
+}
+
+// checkTLSCert checks that the TLS client certificate and its key can be
+// loaded
+func checkTLSCert(certFile, keyFile string) string {
+	if certFile == "" || keyFile == "" {
+		return "tls_cert and tls_key must be given together"
+	}
+	if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		return fmt.Sprintf("malformed, %v", err)
+	}
+
+	return ""
+}
+
+// checkCACert checks that the file has at least one PEM encoded certificate
+func checkCACert(path string) string {
+	pemData, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return fmt.Sprintf("malformed, %v", err)
+	}
+	if !x509.NewCertPool().AppendCertsFromPEM(pemData) {
+		return fmt.Sprintf("malformed, no certificates found in %s", path)
+	}
+
+	return ""
+}
+
+// checkPublicKey checks that the public key is a hex or base64 encoded key of
+// 32 bytes, or the https URL of a key file
+func checkPublicKey(publicKey string) string {
+	if strings.HasPrefix(publicKey, "https://") {
+		if u, err := url.Parse(publicKey); err != nil || u.Host == "" {
+			return fmt.Sprintf("malformed, %s is not a valid URL", publicKey)
+		}
+
+		return ""
+	}
+	if key, err := hex.DecodeString(publicKey); err == nil {
+		if len(key) != 32 {
+			return fmt.Sprintf("malformed, decodes to %d bytes instead of 32", len(key))
+		}
+
+		return ""
+	}
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil {
+		return "malformed, not a hex or base64 encoded key"
+	}
+	if len(key) != 32 {
+		return fmt.Sprintf("malformed, decodes to %d bytes instead of 32", len(key))
+	}
+
+	return ""
+}
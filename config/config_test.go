@@ -0,0 +1,103 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/NBISweden/sda-cli/helpers"
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type ConfigTests struct {
+	suite.Suite
+}
+
+func TestConfigTestSuite(t *testing.T) {
+	suite.Run(t, new(ConfigTests))
+}
+
+func newToken(expiration time.Time) (string, error) {
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"exp": expiration.Unix()}).SignedString([]byte("secret"))
+}
+
+func (suite *ConfigTests) TestCheckAccessToken() {
+	assert.Equal(suite.T(), "missing", checkAccessToken(""))
+	assert.Contains(suite.T(), checkAccessToken("not-a-jwt"), "malformed, could not parse token")
+
+	accessToken, err := newToken(time.Now().Add(-time.Hour))
+	assert.NoError(suite.T(), err)
+	assert.Contains(suite.T(), checkAccessToken(accessToken), "expired at")
+
+	accessToken, err = newToken(time.Now().Add(time.Hour))
+	assert.NoError(suite.T(), err)
+	assert.Empty(suite.T(), checkAccessToken(accessToken))
+}
+
+func (suite *ConfigTests) TestCheckHostBase() {
+	assert.Equal(suite.T(), "missing", checkHostBase("", true))
+	assert.Empty(suite.T(), checkHostBase("inbox.example.org", true))
+	assert.Empty(suite.T(), checkHostBase("inbox.example.org", false))
+	assert.Empty(suite.T(), checkHostBase("http://localhost:8000", false))
+	assert.Equal(suite.T(), "malformed, ftp://inbox.example.org is not a valid URL", checkHostBase("ftp://inbox.example.org", false))
+	assert.Contains(suite.T(), checkHostBase("inbox example org", true), "malformed")
+}
+
+func (suite *ConfigTests) TestCheckPublicKey() {
+	assert.Empty(suite.T(), checkPublicKey("27be42445fd9e39c9be39e6b36a55e61e3801fc845f63781a813d3fe9977e17a"))
+	assert.Empty(suite.T(), checkPublicKey("J75CRF/Z45yb455rNqVeYeOAH8hF9jeBqBPT/pl34Xo="))
+	assert.Equal(suite.T(), "malformed, decodes to 2 bytes instead of 32", checkPublicKey("abcd"))
+	assert.Equal(suite.T(), "malformed, not a hex or base64 encoded key", checkPublicKey("not a key"))
+	assert.Empty(suite.T(), checkPublicKey("https://example.org/key.pub"))
+	assert.Equal(suite.T(), "malformed, https:// is not a valid URL", checkPublicKey("https://"))
+}
+
+func (suite *ConfigTests) TestCheckTLSCert() {
+	assert.Equal(suite.T(), "tls_cert and tls_key must be given together", checkTLSCert("client.pem", ""))
+	assert.Contains(suite.T(), checkTLSCert(filepath.Join(suite.T().TempDir(), "client.pem"), "client.key"), "malformed, open")
+}
+
+func (suite *ConfigTests) TestCheckCACert() {
+	caFile := filepath.Join(suite.T().TempDir(), "ca.pem")
+	assert.Contains(suite.T(), checkCACert(caFile), "malformed, open")
+	assert.NoError(suite.T(), os.WriteFile(caFile, []byte("no certificates"), 0600))
+	assert.Equal(suite.T(), "malformed, no certificates found in "+caFile, checkCACert(caFile))
+}
+
+func (suite *ConfigTests) TestValidate() {
+	accessToken, err := newToken(time.Now().Add(time.Hour))
+	assert.NoError(suite.T(), err)
+
+	configFile := filepath.Join(suite.T().TempDir(), "s3cmd.conf")
+	err = os.WriteFile(configFile, []byte("access_key = someUser\naccess_token = "+accessToken+"\nhost_base = inbox.example.org\nuse_https = True\n"), 0600)
+	assert.NoError(suite.T(), err)
+	*configPath = configFile
+	defer func() { *configPath = "" }()
+
+	var out bytes.Buffer
+	assert.NoError(suite.T(), validate(&out))
+	assert.Equal(suite.T(), "Checking "+configFile+"\n  access_key: ok\n  access_token: ok\n  host_base: ok\nThe configuration is valid\n", out.String())
+
+	err = os.WriteFile(configFile, []byte("access_token = broken\nhost_base = inbox.example.org\npublic_key = abcd\n"), 0600)
+	assert.NoError(suite.T(), err)
+	out.Reset()
+	err = validate(&out)
+	assert.EqualError(suite.T(), err, "3 of the fields in "+configFile+" are missing or malformed")
+	assert.Equal(suite.T(), helpers.ExitConfigError, helpers.ExitCode(err))
+	assert.Contains(suite.T(), out.String(), "  access_key: missing\n")
+	assert.Contains(suite.T(), out.String(), "  access_token: malformed, could not parse token")
+	assert.Contains(suite.T(), out.String(), "  host_base: ok\n")
+	assert.Contains(suite.T(), out.String(), "  public_key: malformed, decodes to 2 bytes instead of 32\n")
+}
+
+func (suite *ConfigTests) TestConfig() {
+	err := Config([]string{"config", "check"})
+	assert.EqualError(suite.T(), err, "unsupported mode: check")
+
+	err = Config([]string{"config"})
+	assert.EqualError(suite.T(), err, "a single mode must be given, validate")
+}
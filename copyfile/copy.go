@@ -0,0 +1,278 @@
+package copyfile
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/NBISweden/sda-cli/helpers"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	log "github.com/sirupsen/logrus"
+)
+
+// Help text and command line flags.
+
+// Usage text that will be displayed as command line help text when using the
+// `help copy` command
+var Usage = `
+USAGE: %s copy [-config <s3config-file>] [-profile-src <name>] [-profile-dst <name>] (-force-overwrite) [src-key] [dst-key]
+
+copy:
+    Copies a file in the Sensitive Data Archive (SDA) to another key,
+    on the server, without downloading and uploading it again.  The
+    file is copied within the user's folder, or from the folder of the
+    profile given with '-profile-src' to the folder of the profile given
+    with '-profile-dst' in ~/.sda-cli/config.  Both profiles must use
+    the same host, and the account of the destination profile must be
+    allowed to read the source file.  If no config is specified, the
+    tool will look for a previous session.
+`
+
+// ArgHelp is the suffix text that will be displayed after the argument list in
+// the module help
+var ArgHelp = `
+    [src-key]
+        The key of the file to copy.
+    [dst-key]
+        The key to copy the file to.`
+
+// Args is a flagset that needs to be exported so that it can be written to the
+// main program help
+var Args = flag.NewFlagSet("copy", flag.ExitOnError)
+
+var configPath = Args.String("config", "",
+	"S3 config file to use for copying.")
+
+var profileSrc = Args.String("profile-src", "",
+	"Named profile in ~/.sda-cli/config, or in the config file, to copy\n"+
+		"the file from.")
+
+var profileDst = Args.String("profile-dst", "",
+	"Named profile in ~/.sda-cli/config, or in the config file, to copy\n"+
+		"the file to.")
+
+var forceOverwrite = Args.Bool("force-overwrite", false,
+	"Overwrite the destination file if it exists.")
+
+// maxCopySize is the largest object that can be copied with a single
+// CopyObject request. Larger objects are copied in parts. maxParts and
+// minPartSize are the limits of the parts of a multipart upload.
+const (
+	maxCopySize = 5 * 1024 * 1024 * 1024
+	maxParts    = 10000
+	minPartSize = 5 * 1024 * 1024
+)
+
+// Copy copies a file from the source key to the destination key on the
+// server.
+func Copy(args []string) error {
+	// Call ParseArgs to take care of all the flag parsing
+	err := helpers.ParseArgs(args, Args)
+	if err != nil {
+		return fmt.Errorf("failed parsing arguments, reason: %w", err)
+	}
+
+	if len(Args.Args()) != 2 {
+		return errors.New("a source and a destination key are required")
+	}
+	srcKey, dstKey := strings.TrimPrefix(Args.Args()[0], "/"), strings.TrimPrefix(Args.Args()[1], "/")
+	if srcKey == "" || dstKey == "" {
+		return errors.New("the source and the destination keys can not be empty")
+	}
+
+	srcConfig, err := helpers.GetAuth(*configPath, *profileSrc)
+	if err != nil {
+		return fmt.Errorf("failed to load config file, reason: %w", err)
+	}
+	dstConfig, err := helpers.GetAuth(*configPath, *profileDst)
+	if err != nil {
+		return fmt.Errorf("failed to load config file, reason: %w", err)
+	}
+	if srcConfig.HostBase != dstConfig.HostBase {
+		return helpers.WithCategory(helpers.ErrConfig,
+			fmt.Errorf("the files can only be copied between profiles on the same host, found %s and %s", srcConfig.HostBase, dstConfig.HostBase))
+	}
+	if srcConfig.AccessKey == dstConfig.AccessKey && srcKey == dstKey {
+		return errors.New("the source and the destination are the same file")
+	}
+
+	err = helpers.WarnTokenExpiration(dstConfig)
+	if err != nil {
+		return err
+	}
+
+	// The copy is made by the destination account, which reads the source
+	sess, err := helpers.NewS3Session(dstConfig)
+	if err != nil {
+		return err
+	}
+	svc := s3.New(sess)
+
+	_, err = CopyFile(svc, srcConfig.AccessKey, srcKey, dstConfig.AccessKey, dstKey, dstConfig.MultipartChunkSizeMb*1024*1024, *forceOverwrite)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("copied %s/%s to %s/%s\n", srcConfig.AccessKey, srcKey, dstConfig.AccessKey, dstKey)
+
+	return nil
+}
+
+// CopyFile copies the object at srcBucket/srcKey to dstBucket/dstKey on the
+// server, and returns the ETag of the copy. Objects larger than maxCopySize
+// are copied in parts of at least partSize. An existing object at the
+// destination is only overwritten if overwrite is set.
+func CopyFile(svc *s3.S3, srcBucket, srcKey, dstBucket, dstKey string, partSize int64, overwrite bool) (string, error) {
+	head, err := svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(srcBucket),
+		Key:    aws.String(srcKey),
+	})
+	if err != nil {
+		var reqErr awserr.RequestFailure
+		if errors.As(err, &reqErr) && reqErr.StatusCode() == 404 {
+			return "", fmt.Errorf("file %s does not exist", srcKey)
+		}
+
+		return "", fmt.Errorf("failed to get information about %s, reason: %w", srcKey, err)
+	}
+
+	if !overwrite {
+		_, err := svc.HeadObject(&s3.HeadObjectInput{
+			Bucket: aws.String(dstBucket),
+			Key:    aws.String(dstKey),
+		})
+		if err == nil {
+			return "", fmt.Errorf("file %s already exists, use -force-overwrite to overwrite it", dstKey)
+		}
+		var reqErr awserr.RequestFailure
+		if !errors.As(err, &reqErr) || reqErr.StatusCode() != 404 {
+			return "", fmt.Errorf("failed to get information about %s, reason: %w", dstKey, err)
+		}
+	}
+
+	copySource := (&url.URL{Path: srcBucket + "/" + srcKey}).EscapedPath()
+	size := aws.Int64Value(head.ContentLength)
+	if size <= maxCopySize {
+		result, err := svc.CopyObject(&s3.CopyObjectInput{
+			Bucket:     aws.String(dstBucket),
+			Key:        aws.String(dstKey),
+			CopySource: aws.String(copySource),
+		})
+		if err == nil && result.CopyObjectResult == nil {
+			err = errors.New("no result from the server")
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to copy %s, reason: %w", srcKey, err)
+		}
+
+		return aws.StringValue(result.CopyObjectResult.ETag), nil
+	}
+
+	return copyParts(svc, copySource, size, dstBucket, dstKey, partSize)
+}
+
+// copyParts copies an object of the given size in parts with a multipart
+// upload, which is aborted if a part fails, and returns the ETag of the copy.
+// The ETag is checked against the checksums of the copied parts, so that the
+// copy is known to consist of the parts that were copied.
+func copyParts(svc *s3.S3, copySource string, size int64, dstBucket, dstKey string, partSize int64) (string, error) {
+	upload, err := svc.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket: aws.String(dstBucket),
+		Key:    aws.String(dstKey),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to copy %s, reason: %w", copySource, err)
+	}
+
+	var parts []*s3.CompletedPart
+	for i, r := range partRanges(size, partSize) {
+		result, err := svc.UploadPartCopy(&s3.UploadPartCopyInput{
+			Bucket:          aws.String(dstBucket),
+			Key:             aws.String(dstKey),
+			UploadId:        upload.UploadId,
+			PartNumber:      aws.Int64(int64(i + 1)),
+			CopySource:      aws.String(copySource),
+			CopySourceRange: aws.String(r),
+		})
+		if err == nil && result.CopyPartResult == nil {
+			err = errors.New("no result from the server")
+		}
+		if err != nil {
+			_, abortErr := svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(dstBucket),
+				Key:      aws.String(dstKey),
+				UploadId: upload.UploadId,
+			})
+			if abortErr != nil {
+				log.Errorf("failed to abort the copy of %s, reason: %v", copySource, abortErr)
+			}
+
+			return "", fmt.Errorf("failed to copy part %d of %s, reason: %w", i+1, copySource, err)
+		}
+		parts = append(parts, &s3.CompletedPart{ETag: result.CopyPartResult.ETag, PartNumber: aws.Int64(int64(i + 1))})
+	}
+
+	result, err := svc.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(dstBucket),
+		Key:             aws.String(dstKey),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to copy %s, reason: %w", copySource, err)
+	}
+
+	expected, err := multipartETag(parts)
+	if err != nil {
+		return "", fmt.Errorf("failed to verify the copy of %s, reason: %w", copySource, err)
+	}
+	etag := strings.Trim(aws.StringValue(result.ETag), `"`)
+	if !strings.EqualFold(etag, expected) {
+		return "", fmt.Errorf("the checksum of the copy of %s is %s, but the copied parts give %s", copySource, etag, expected)
+	}
+
+	return aws.StringValue(result.ETag), nil
+}
+
+// multipartETag returns the ETag of an object uploaded in the given parts,
+// which is the md5 checksum of the md5 checksums of the parts, followed by
+// the number of parts
+func multipartETag(parts []*s3.CompletedPart) (string, error) {
+	hash := md5.New()
+	for _, part := range parts {
+		sum, err := hex.DecodeString(strings.Trim(aws.StringValue(part.ETag), `"`))
+		if err != nil {
+			return "", fmt.Errorf("invalid checksum of part %d: %s", aws.Int64Value(part.PartNumber), aws.StringValue(part.ETag))
+		}
+		hash.Write(sum)
+	}
+
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(hash.Sum(nil)), len(parts)), nil
+}
+
+// partRanges returns the byte ranges of the parts to copy an object of the
+// given size in, using parts of at least partSize and at most maxParts parts
+func partRanges(size, partSize int64) []string {
+	if partSize < minPartSize {
+		partSize = minPartSize
+	}
+	if minSize := (size + maxParts - 1) / maxParts; partSize < minSize {
+		partSize = minSize
+	}
+
+	var ranges []string
+	for start := int64(0); start < size; start += partSize {
+		end := start + partSize - 1
+		if end >= size {
+			end = size - 1
+		}
+		ranges = append(ranges, fmt.Sprintf("bytes=%d-%d", start, end))
+	}
+
+	return ranges
+}
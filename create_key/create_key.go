@@ -1,9 +1,13 @@
 package createkey
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/csv"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -18,11 +22,23 @@ import (
 // Usage text that will be displayed as command line help text when using the
 // `help encrypt` command
 var Usage = `
-USAGE: %s createKey (-outdir <dirname>) <name>
+USAGE: %s createKey (-outdir <dirname>) (-use-keyring) (-repassphrase) (-fingerprint) (-batch <csv-file>) <name>
 
 createKey:
     Creates a crypt4gh encryption key pair, and saves it to
-    <name>.pub.pem, and <name>.sec.pem.
+    <name>.pub.pem, and <name>.sec.pem.  With '-use-keyring', the
+    password of the private key is stored in the system keyring, so
+    that it does not have to be typed when decrypting.  With
+    '-repassphrase', <name> is an existing private key file, whose
+    password is changed instead, leaving the public key unchanged.
+    The fingerprint of the public key is printed after the keys are
+    created.  With '-fingerprint', <name> is an existing public key
+    file, and only its fingerprint is printed.  With '-batch', key
+    pairs are created for all the users in a csv file with the columns
+    username,passphrase, where an empty passphrase is asked for.  The
+    keys of each user are named <username>.pub.pem and
+    <username>.sec.pem, like the keys of a single key pair, and the
+    passwords are stored in the keyring with '-use-keyring'.
 
     NOTE:
         Keys created using this function should not be used when
@@ -43,6 +59,24 @@ var Args = flag.NewFlagSet("createKey", flag.ExitOnError)
 var outDir = Args.String("outdir", "",
 	"Output directory for the key files.")
 
+var repassphrase = Args.Bool("repassphrase", false,
+	"Change the password of an existing private key file.")
+
+var fingerprint = Args.Bool("fingerprint", false,
+	"Print the fingerprint of an existing public key file.")
+
+var batchFile = Args.String("batch", "",
+	"CSV file with the columns username,passphrase to create a key pair\n"+
+		"for every user.")
+
+var useKeyring = Args.Bool("use-keyring", false,
+	"Store the private key password in the system keyring.")
+
+// Long names of the short flags
+func init() {
+	helpers.AliasFlag(Args, "outdir", "output-dir")
+}
+
 // CreateKey takes two arguments, a base filename, and optionally an output
 // directory specified with `-outdir`.
 func CreateKey(args []string) error {
@@ -54,6 +88,14 @@ func CreateKey(args []string) error {
 		return fmt.Errorf("could not parse arguments: %s", err)
 	}
 
+	if *batchFile != "" {
+		if len(Args.Args()) > 0 {
+			return fmt.Errorf("unknown arguments: %v, no filename is expected with -batch", strings.Join(Args.Args(), ", "))
+		}
+
+		return createBatch(*batchFile, *outDir)
+	}
+
 	// Args() returns the non-flag arguments, which we assume is the key
 	// filename. If more than one name is given, an error is returned.
 	if len(Args.Args()) > 1 {
@@ -64,19 +106,245 @@ func CreateKey(args []string) error {
 	}
 	basename := Args.Args()[0]
 
+	if *repassphrase {
+		return changePassphrase(basename)
+	}
+	if *fingerprint {
+		return printFingerprint(basename)
+	}
+
 	// Add the output directory to the file path (does nothing if outDir is "")
 	basename = filepath.Join(*outDir, basename)
 
 	// Read password from user, to avoid having it in plaintext as an argument
 	password, err := helpers.PromptPassword("Enter private key password")
 	if err != nil {
-		return fmt.Errorf("failed to read password from user: %v", err)
+		return fmt.Errorf("failed to read password from user: %w", err)
 	}
 
 	// Write the key files
 	err = GenerateKeyPair(basename, password)
+	if err != nil {
+		return err
+	}
+	if err := printFingerprint(fmt.Sprintf("%s.pub.pem", basename)); err != nil {
+		return err
+	}
 
-	return err
+	if *useKeyring {
+		storeKeyringPassphrase(fmt.Sprintf("%s.sec.pem", basename), password)
+	}
+
+	return nil
+}
+
+// batchUser is a row in the csv file for batch creation of key pairs
+type batchUser struct {
+	username   string
+	passphrase string
+}
+
+// readBatchFile reads the users from a csv file with the columns
+// username,passphrase. A header row with these names is skipped.
+func readBatchFile(filename string) ([]batchUser, error) {
+	f, err := os.Open(filepath.Clean(filename))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read batch file, reason: %w", err)
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = 2
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse batch file %s, reason: %v", filename, err)
+	}
+	if len(records) > 0 && records[0][0] == "username" && records[0][1] == "passphrase" {
+		records = records[1:]
+	}
+
+	users := make([]batchUser, 0, len(records))
+	for i, record := range records {
+		username := strings.TrimSpace(record[0])
+		if username == "" || strings.ContainsAny(username, `/\`) || username == "." || username == ".." {
+			return nil, fmt.Errorf("invalid username %q on line %d of %s", record[0], i+1, filename)
+		}
+		users = append(users, batchUser{username: username, passphrase: record[1]})
+	}
+
+	return users, nil
+}
+
+// createBatch creates a key pair for every user in the batch file, in the
+// given output directory. The keys are named <username>.pub.pem and
+// <username>.sec.pem, the same as the keys created for a single name, so
+// that they can be used in the same way. Users without a passphrase in the
+// file are prompted for one, and the passphrases are stored in the keyring
+// with -use-keyring. Failed users are reported without stopping the others.
+func createBatch(filename, dir string) error {
+	users, err := readBatchFile(filename)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, user := range users {
+		password := user.passphrase
+		if password == "" {
+			password, err = helpers.PromptPassword(fmt.Sprintf("Enter private key password for %s", user.username))
+			if err != nil {
+				return fmt.Errorf("failed to read password from user: %w", err)
+			}
+		}
+
+		basename := filepath.Join(dir, user.username)
+		if err := GenerateKeyPair(basename, password); err != nil {
+			log.Errorf("Failed to create keys for %s, reason: %v", user.username, err)
+			failed++
+
+			continue
+		}
+		if err := printFingerprint(fmt.Sprintf("%s.pub.pem", basename)); err != nil {
+			return err
+		}
+		if *useKeyring {
+			storeKeyringPassphrase(fmt.Sprintf("%s.sec.pem", basename), password)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("failed to create keys for %d of %d users", failed, len(users))
+	}
+
+	return nil
+}
+
+// printFingerprint prints the fingerprint of the public key in
+// `publicKeyName` to stdout.
+func printFingerprint(publicKeyName string) error {
+	keyFile, err := os.Open(filepath.Clean(publicKeyName))
+	if err != nil {
+		return err
+	}
+	defer keyFile.Close()
+
+	publicKey, err := readPublicKey(keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to read public key %s, reason: %v", publicKeyName, err)
+	}
+	fmt.Printf("%s %s\n", Fingerprint(publicKey), publicKeyName)
+
+	return nil
+}
+
+// Fingerprint returns the fingerprint of a crypt4gh X25519 public key, which
+// is the base64 encoded sha256 hash of the raw key, prefixed with "SHA256:",
+// like the fingerprints shown by ssh-keygen.
+func Fingerprint(publicKey [32]byte) string {
+	hash := sha256.Sum256(publicKey[:])
+
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(hash[:])
+}
+
+// readPublicKey wraps keys.ReadPublicKey, which panics if the key is
+// malformed, so that the panic is returned as an error.
+func readPublicKey(reader io.Reader) (key [32]byte, err error) {
+	defer func() {
+		if recover() != nil {
+			err = errors.New("malformed key file")
+		}
+	}()
+
+	return keys.ReadPublicKey(reader)
+}
+
+// changePassphrase prompts for the current and the new password of a private
+// key file, and rewrites the key encrypted with the new password.
+func changePassphrase(privateKeyName string) error {
+	oldPassword, err := helpers.PromptPassword("Enter current private key password")
+	if err != nil {
+		return fmt.Errorf("failed to read password from user: %w", err)
+	}
+	newPassword, err := helpers.PromptPassword("Enter new private key password")
+	if err != nil {
+		return fmt.Errorf("failed to read password from user: %w", err)
+	}
+	repeated, err := helpers.PromptPassword("Repeat new private key password")
+	if err != nil {
+		return fmt.Errorf("failed to read password from user: %w", err)
+	}
+	if newPassword != repeated {
+		return errors.New("the new passwords do not match")
+	}
+
+	if err := ChangePassphrase(privateKeyName, oldPassword, newPassword); err != nil {
+		return err
+	}
+
+	if *useKeyring {
+		storeKeyringPassphrase(privateKeyName, newPassword)
+	}
+
+	return nil
+}
+
+// storeKeyringPassphrase stores the password of the private key file in the
+// system keyring. The key is already written when this is called, so a
+// keyring that cannot be used is only reported as a warning, and the password
+// has to be entered when the key is used instead.
+func storeKeyringPassphrase(privateKeyName, password string) bool {
+	if err := helpers.SetKeyringPassphrase(privateKeyName, password); err != nil {
+		log.Warnf("The password of %s was not stored in the keyring: %v", privateKeyName, err)
+
+		return false
+	}
+
+	return true
+}
+
+// ChangePassphrase decrypts the crypt4gh private key in `privateKeyName` with
+// `oldPassword`, and writes it back encrypted with `newPassword`. The key is
+// first written to a temporary file, which then replaces the original file,
+// so that the key is not lost if writing fails.
+func ChangePassphrase(privateKeyName, oldPassword, newPassword string) error {
+	keyFile, err := os.Open(filepath.Clean(privateKeyName))
+	if err != nil {
+		return err
+	}
+	privateKeyData, err := readPrivateKey(keyFile, oldPassword)
+	keyFile.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read private key %s, reason: %v", privateKeyName, err)
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(privateKeyName), filepath.Base(privateKeyName)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	err = keys.WriteCrypt4GHX25519PrivateKey(tmpFile, privateKeyData, []byte(newPassword))
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write private key, reason: %w", err)
+	}
+
+	return os.Rename(tmpFile.Name(), privateKeyName)
+}
+
+// readPrivateKey wraps keys.ReadPrivateKey, which panics if the key is
+// malformed, so that the panic is returned as an error.
+func readPrivateKey(reader io.Reader, password string) (key [32]byte, err error) {
+	defer func() {
+		if recover() != nil {
+			err = errors.New("malformed key file")
+		}
+	}()
+
+	return keys.ReadPrivateKey(reader, []byte(password))
 }
 
 // GenerateKeyPair generates a crypt4gh key pair and saves it to the
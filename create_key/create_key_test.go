@@ -1,14 +1,17 @@
 package createkey
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"testing"
 
+	"github.com/NBISweden/sda-cli/helpers"
 	"github.com/neicnordic/crypt4gh/keys"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
+	"github.com/zalando/go-keyring"
 )
 
 type CreateKeyTests struct {
@@ -66,3 +69,127 @@ func (suite *CreateKeyTests) TestgenerateKeyPair() {
 	_, err = keys.ReadPrivateKey(keyFile, []byte(password))
 	assert.NoError(suite.T(), err)
 }
+
+func (suite *CreateKeyTests) TestChangePassphrase() {
+	testFileName := filepath.Join(suite.tempDir, "rotated")
+	err := GenerateKeyPair(testFileName, "old")
+	assert.NoError(suite.T(), err)
+	defer os.Remove(testFileName + ".pub.pem")
+	defer os.Remove(testFileName + ".sec.pem")
+
+	publicKey, err := os.ReadFile(testFileName + ".pub.pem")
+	assert.NoError(suite.T(), err)
+	readKey := func(password string) ([32]byte, error) {
+		f, err := os.Open(testFileName + ".sec.pem")
+		assert.NoError(suite.T(), err)
+		defer f.Close()
+
+		return readPrivateKey(f, password)
+	}
+	privateKey, err := readKey("old")
+	assert.NoError(suite.T(), err)
+
+	// The wrong current password is rejected
+	err = ChangePassphrase(testFileName+".sec.pem", "wrong", "new")
+	assert.ErrorContains(suite.T(), err, "failed to read private key")
+
+	err = ChangePassphrase(testFileName+".sec.pem", "old", "new")
+	assert.NoError(suite.T(), err)
+
+	// The same key is now unlocked with the new password only
+	_, err = readKey("old")
+	assert.Error(suite.T(), err)
+	rotatedKey, err := readKey("new")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), privateKey, rotatedKey)
+
+	// The public key is left unchanged, and no temporary files are left
+	unchanged, err := os.ReadFile(testFileName + ".pub.pem")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), publicKey, unchanged)
+	entries, err := os.ReadDir(suite.tempDir)
+	assert.NoError(suite.T(), err)
+	assert.Len(suite.T(), entries, 2)
+}
+
+func (suite *CreateKeyTests) TestFingerprint() {
+	var publicKey [32]byte
+	assert.Equal(suite.T(), "SHA256:Zmh6rfhivXdsj8GLjp+OIAiXFIVu4jOzkCpZHQ1fKSU", Fingerprint(publicKey))
+
+	testFileName := filepath.Join(suite.tempDir, "fingerprint")
+	err := GenerateKeyPair(testFileName, "")
+	assert.NoError(suite.T(), err)
+	defer os.Remove(testFileName + ".pub.pem")
+	defer os.Remove(testFileName + ".sec.pem")
+
+	assert.NoError(suite.T(), printFingerprint(testFileName+".pub.pem"))
+	notAKey := filepath.Join(suite.tempDir, "not-a-key")
+	assert.NoError(suite.T(), os.WriteFile(notAKey, []byte("not a key"), 0600))
+	defer os.Remove(notAKey)
+	err = printFingerprint(notAKey)
+	assert.ErrorContains(suite.T(), err, "failed to read public key")
+}
+
+func (suite *CreateKeyTests) TestCreateBatch() {
+	batch := filepath.Join(suite.tempDir, "users.csv")
+	err := os.WriteFile(batch, []byte("username,passphrase\nalice,secret1\nbob,secret2\n"), 0600)
+	assert.NoError(suite.T(), err)
+	defer os.Remove(batch)
+
+	users, err := readBatchFile(batch)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), []batchUser{{"alice", "secret1"}, {"bob", "secret2"}}, users)
+
+	keyDir := filepath.Join(suite.tempDir, "keys")
+	assert.NoError(suite.T(), os.Mkdir(keyDir, 0700))
+	defer os.RemoveAll(keyDir)
+
+	assert.NoError(suite.T(), createBatch(batch, keyDir))
+	for _, user := range users {
+		f, err := os.Open(filepath.Join(keyDir, user.username+".sec.pem"))
+		assert.NoError(suite.T(), err)
+		_, err = readPrivateKey(f, user.passphrase)
+		assert.NoError(suite.T(), err)
+		f.Close()
+		assert.FileExists(suite.T(), filepath.Join(keyDir, user.username+".pub.pem"))
+	}
+
+	// The passphrases are stored in the keyring with -use-keyring
+	keyring.MockInit()
+	*useKeyring = true
+	defer func() { *useKeyring = false }()
+	err = os.WriteFile(batch, []byte("dave,secret4\n"), 0600)
+	assert.NoError(suite.T(), err)
+	assert.NoError(suite.T(), createBatch(batch, keyDir))
+	passphrase, found, err := helpers.GetKeyringPassphrase(filepath.Join(keyDir, "dave.sec.pem"))
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), found)
+	assert.Equal(suite.T(), "secret4", passphrase)
+	*useKeyring = false
+
+	// Existing keys are not overwritten, but the other users are created
+	err = os.WriteFile(batch, []byte("alice,secret1\ncarol,secret3\n"), 0600)
+	assert.NoError(suite.T(), err)
+	err = createBatch(batch, keyDir)
+	assert.EqualError(suite.T(), err, "failed to create keys for 1 of 2 users")
+	assert.FileExists(suite.T(), filepath.Join(keyDir, "carol.pub.pem"))
+
+	// Usernames can not be paths
+	err = os.WriteFile(batch, []byte("../mallory,secret\n"), 0600)
+	assert.NoError(suite.T(), err)
+	_, err = readBatchFile(batch)
+	assert.ErrorContains(suite.T(), err, "invalid username")
+}
+
+func (suite *CreateKeyTests) TestStoreKeyringPassphrase() {
+	keyring.MockInit()
+	assert.True(suite.T(), storeKeyringPassphrase(filepath.Join(suite.tempDir, "key.sec.pem"), "secret"))
+	passphrase, found, err := helpers.GetKeyringPassphrase("key.sec.pem")
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), found)
+	assert.Equal(suite.T(), "secret", passphrase)
+
+	// A keyring that cannot be used is not an error
+	keyring.MockInitWithError(errors.New("no keyring available"))
+	assert.False(suite.T(), storeKeyringPassphrase("key.sec.pem", "secret"))
+}
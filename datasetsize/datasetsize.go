@@ -1,15 +1,21 @@
 package datasetsize
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"text/tabwriter"
 
 	"github.com/NBISweden/sda-cli/download"
-	"github.com/inhies/go-bytesize"
+	"github.com/NBISweden/sda-cli/helpers"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -18,14 +24,20 @@ import (
 // Usage text that will be displayed as command line help text when using the
 // `help list` command
 var Usage = `
-USAGE: %s datasetsize [url(s) | file]
+USAGE: %s datasetsize (-format <text|json>) (-verbose) (-no-files) (-by-ext) (-compare <url | file>) [url(s) | file]
 
 datasetsize:
     List files that can be downloaded from the Sensitive Data
     Archive (SDA).  If a URL is provided (ending with "/" or the
     urls_list.txt file), then the tool will attempt to first download
-    the urls_list.txt file, and then return a list of the files with
-    their respective sizes.
+    the urls_list.txt file, and then list the files with their
+    respective sizes before the total size of the files.  Only the
+    total is shown with '-no-files'.  With '-by-ext', the files are
+    also grouped by extension, showing the number and total size of the
+    files with each extension.  With '-compare', the size of a second
+    dataset is also computed, and the difference between the two
+    datasets is shown, e.g. to verify that a re-upload has the same size
+    as the original.  The output can be printed as json with '-format'.
 `
 
 // ArgHelp is the suffix text that will be displayed after the argument list in
@@ -38,11 +50,59 @@ var ArgHelp = `
 // main program help
 var Args = flag.NewFlagSet("datasetsize", flag.ExitOnError)
 
+var outputFormat = Args.String("format", "text",
+	"Output format, text or json.")
+
+var verbose = Args.Bool("verbose", false,
+	"Add the key and size of every file to the json output.")
+
+var noFiles = Args.Bool("no-files", false,
+	"Show only the total size, without the list of files.")
+
+var byExtension = Args.Bool("by-ext", false,
+	"Group the files by extension, with the number and total size of\n"+
+		"the files for every extension.")
+
+var compareWith = Args.String("compare", "",
+	"Location of a second dataset to compare the size of the dataset with.")
+
+// fileSize is the key and size of a file in the dataset
+type fileSize struct {
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+}
+
+// extensionSize is the number and total size of the files with an extension
+type extensionSize struct {
+	Extension  string `json:"extension"`
+	FileCount  int    `json:"file_count"`
+	TotalBytes int64  `json:"total_bytes"`
+}
+
+// sizeReport is the document printed in json format
+type sizeReport struct {
+	Dataset    string          `json:"dataset"`
+	TotalBytes int64           `json:"total_bytes"`
+	FileCount  int             `json:"file_count"`
+	HumanSize  string          `json:"human_size"`
+	Extensions []extensionSize `json:"extensions,omitempty"`
+	Files      []fileSize      `json:"files,omitempty"`
+}
+
+// sizeComparison is the document printed in json format when comparing two
+// datasets. The difference is the size of the first dataset minus the size of
+// the second one.
+type sizeComparison struct {
+	Datasets        []sizeReport `json:"datasets"`
+	DifferenceBytes int64        `json:"difference_bytes"`
+	Larger          string       `json:"larger,omitempty"`
+}
+
 // Function to return the size of a file
 func getFileSize(file string) (downloadSize int64, err error) {
 	resp, err := http.Head(file)
 	if err != nil {
-		return 0, fmt.Errorf("failed to head file, reason: %v", err)
+		return 0, fmt.Errorf("failed to head file, reason: %w", err)
 	}
 	defer resp.Body.Close()
 
@@ -59,11 +119,16 @@ func getFileSize(file string) (downloadSize int64, err error) {
 // DatasetSize function returns the list of the files available for downloading and their
 // respective size. The argument can be a local file or a url to an S3 folder
 func DatasetSize(args []string) error {
-	// Parse flags. There are no flags at the moment, but in case some are added
-	// we check for them.
-	err := Args.Parse(args[1:])
+	// Call ParseArgs to take care of all the flag parsing
+	err := helpers.ParseArgs(args, Args)
 	if err != nil {
-		return fmt.Errorf("failed parsing arguments, reason: %v", err)
+		return fmt.Errorf("failed parsing arguments, reason: %w", err)
+	}
+
+	switch *outputFormat {
+	case "text", "json":
+	default:
+		return fmt.Errorf("invalid output format: %s", *outputFormat)
 	}
 
 	// Args() returns the non-flag arguments, which we assume are filenames.
@@ -72,37 +137,251 @@ func DatasetSize(args []string) error {
 		return fmt.Errorf("failed to find location of files, no argument passed")
 	}
 
-	var currentPath, urlsFilePath string
-	currentPath, err = os.Getwd()
+	currentPath, err := os.Getwd()
 	if err != nil {
-		return fmt.Errorf("failed to get current path, reason: %v", err)
+		return fmt.Errorf("failed to get current path, reason: %w", err)
 	}
 
-	urlsFilePath, err = download.GetURLsListFile(currentPath, urls[0])
+	report, files, err := datasetSize(currentPath, urls[0])
 	if err != nil {
-		return fmt.Errorf("failed to get urls list file, reason: %v", err)
+		return err
+	}
+
+	if *compareWith != "" {
+		other, _, err := datasetSize(currentPath, *compareWith)
+		if err != nil {
+			return err
+		}
+
+		return printComparison(os.Stdout, compareReports(report, other, urls[0], *compareWith))
+	}
+
+	if *outputFormat == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+
+		return encoder.Encode(report)
+	}
+
+	if !*noFiles {
+		printFiles(os.Stdout, files)
+	}
+	fmt.Printf("Total dataset size: %s\n", helpers.FormatBytes(report.TotalBytes))
+	if *byExtension {
+		printExtensions(os.Stdout, report.Extensions)
+	}
+
+	log.Info("finished listing available files")
+
+	return nil
+}
+
+// datasetSize gets the urls_list.txt file of the dataset at location, and
+// returns the size report and the sizes of the files in the dataset.
+func datasetSize(currentPath, location string) (sizeReport, []fileSize, error) {
+	urlsFilePath, err := download.GetURLsListFile(currentPath, location)
+	if err != nil {
+		return sizeReport{}, nil, fmt.Errorf("failed to get urls list file, reason: %w", err)
 	}
 
 	// Open urls_list.txt file and loop through file urls
 	urlsList, err := download.GetURLsFile(urlsFilePath)
 	if err != nil {
-		return err
+		return sizeReport{}, nil, err
 	}
 
-	var datasetSize float64
 	// Get the size for each of the files in the list
+	files := make([]fileSize, 0, len(urlsList))
+	report := sizeReport{Dataset: datasetID(urlsList)}
+	dir := datasetDir(urlsList)
 	for _, file := range urlsList {
 
 		downloadSize, err := getFileSize(file)
 		if err != nil {
-			return err
+			return sizeReport{}, nil, err
 		}
-		datasetSize += float64(downloadSize)
-		fmt.Printf("%s \t %s \n", bytesize.New(float64(downloadSize)), file[strings.LastIndex(file, "/")+1:])
+		// Files are named by their path in the dataset folder
+		files = append(files, fileSize{Key: strings.TrimPrefix(strings.TrimPrefix(urlPath(file), "/"), strings.TrimPrefix(dir, "/")), Size: downloadSize})
+		report.TotalBytes += downloadSize
+		report.FileCount++
+	}
+	report.HumanSize = helpers.FormatBytes(report.TotalBytes)
+	if *byExtension {
+		report.Extensions = groupByExtension(files)
+	}
+	if *verbose {
+		report.Files = files
 	}
-	fmt.Printf("Total dataset size: %s \n", bytesize.New(datasetSize))
 
-	log.Info("finished listing available files")
+	return report, files, nil
+}
 
-	return nil
+// compareReports returns the comparison of two dataset size reports. The
+// datasets are named by their ids, or by their locations if the ids can not
+// tell them apart.
+func compareReports(first, second sizeReport, firstLocation, secondLocation string) sizeComparison {
+	if first.Dataset == "" || second.Dataset == "" || first.Dataset == second.Dataset {
+		first.Dataset = firstLocation
+		second.Dataset = secondLocation
+	}
+
+	comparison := sizeComparison{
+		Datasets:        []sizeReport{first, second},
+		DifferenceBytes: first.TotalBytes - second.TotalBytes,
+	}
+	switch {
+	case comparison.DifferenceBytes > 0:
+		comparison.Larger = first.Dataset
+	case comparison.DifferenceBytes < 0:
+		comparison.Larger = second.Dataset
+	}
+
+	return comparison
+}
+
+// printComparison writes the comparison of two datasets to w, in the output
+// format given with -format
+func printComparison(w io.Writer, comparison sizeComparison) error {
+	if *outputFormat == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+
+		return encoder.Encode(comparison)
+	}
+
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "DATASET\tFILES\tSIZE")
+	for _, report := range comparison.Datasets {
+		fmt.Fprintf(table, "%s\t%d\t%s\n", report.Dataset, report.FileCount, helpers.FormatBytes(report.TotalBytes))
+	}
+	if err := table.Flush(); err != nil {
+		return err
+	}
+
+	difference := comparison.DifferenceBytes
+	if difference < 0 {
+		difference = -difference
+	}
+	if comparison.Larger == "" {
+		_, err := fmt.Fprintln(w, "The datasets have the same size")
+
+		return err
+	}
+	smaller := comparison.Datasets[1].Dataset
+	if comparison.Larger == smaller {
+		smaller = comparison.Datasets[0].Dataset
+	}
+	_, err := fmt.Fprintf(w, "%s is larger than %s by %s (%d bytes)\n", comparison.Larger, smaller, helpers.FormatBytes(difference), difference)
+
+	return err
+}
+
+// urlPath returns the path of a file url, or the location itself if it is
+// not a url with a host
+func urlPath(location string) string {
+	if u, err := url.Parse(location); err == nil && u.Host != "" {
+		return u.Path
+	}
+
+	return location
+}
+
+// datasetDir returns the path of the deepest folder that contains all the
+// files, with a trailing "/"
+func datasetDir(urls []string) string {
+	var common []string
+	for i, fileURL := range urls {
+		filePath := urlPath(fileURL)
+		parts := strings.Split(strings.Trim(filePath[:strings.LastIndex(filePath, "/")+1], "/"), "/")
+		if i == 0 {
+			common = parts
+
+			continue
+		}
+		n := 0
+		for n < len(common) && n < len(parts) && common[n] == parts[n] {
+			n++
+		}
+		common = common[:n]
+	}
+	dir := strings.Join(common, "/")
+	if dir == "" {
+		return "/"
+	}
+
+	return "/" + dir + "/"
+}
+
+// datasetID returns the id of the dataset that the files belong to, which is
+// the name of the deepest folder that contains all the files. For files
+// stored as <host>/<bucket>/<dataset>/<file> this is <dataset>.
+func datasetID(urls []string) string {
+	dir := strings.TrimSuffix(datasetDir(urls), "/")
+
+	return dir[strings.LastIndex(dir, "/")+1:]
+}
+
+// fileExtension returns the extension of a file name. For encrypted files,
+// the extension of the unencrypted file is included, e.g. ".bam.c4gh". Files
+// without an extension get "(none)".
+func fileExtension(name string) string {
+	ext := filepath.Ext(name)
+	if ext == ".c4gh" {
+		ext = filepath.Ext(strings.TrimSuffix(name, ext)) + ext
+	}
+	if ext == "" || ext == name {
+		return "(none)"
+	}
+
+	return ext
+}
+
+// groupByExtension returns the number and total size of the files for every
+// extension, sorted by extension
+func groupByExtension(files []fileSize) []extensionSize {
+	groups := map[string]*extensionSize{}
+	for _, file := range files {
+		ext := fileExtension(file.Key)
+		if groups[ext] == nil {
+			groups[ext] = &extensionSize{Extension: ext}
+		}
+		groups[ext].FileCount++
+		groups[ext].TotalBytes += file.Size
+	}
+
+	extensions := make([]extensionSize, 0, len(groups))
+	for _, group := range groups {
+		extensions = append(extensions, *group)
+	}
+	sort.Slice(extensions, func(i, j int) bool {
+		return extensions[i].Extension < extensions[j].Extension
+	})
+
+	return extensions
+}
+
+// printFiles writes the size and key of every file to w, with the sizes
+// right-aligned in a column of equal width
+func printFiles(w io.Writer, files []fileSize) {
+	sizes := make([]string, len(files))
+	width := 0
+	for i, file := range files {
+		sizes[i] = helpers.FormatBytes(file.Size)
+		if len(sizes[i]) > width {
+			width = len(sizes[i])
+		}
+	}
+	for i, file := range files {
+		fmt.Fprintf(w, "%*s  %s\n", width, sizes[i], file.Key)
+	}
+}
+
+// printExtensions writes the extension groups to w as a table
+func printExtensions(w io.Writer, extensions []extensionSize) {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "EXTENSION\tFILES\tSIZE")
+	for _, ext := range extensions {
+		fmt.Fprintf(table, "%s\t%d\t%s\n", ext.Extension, ext.FileCount, helpers.FormatBytes(ext.TotalBytes))
+	}
+	table.Flush()
 }
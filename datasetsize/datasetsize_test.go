@@ -1,9 +1,13 @@
 package datasetsize
 
 import (
+	"bytes"
+	"encoding/json"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"testing"
@@ -69,3 +73,201 @@ func (suite *TestSuite) TestGetFileSizeFail() {
 	assert.True(suite.T(), strings.HasPrefix(err.Error(), "failed to head file, reason:"))
 	assert.Equal(suite.T(), int64(0), size)
 }
+
+func (suite *TestSuite) TestInvalidFormat() {
+	os.Args = []string{"datasetsize", "-format", "xml", "somefile"}
+	defer func() { *outputFormat = "text" }()
+
+	err := DatasetSize(os.Args)
+	assert.EqualError(suite.T(), err, "invalid output format: xml")
+}
+
+func (suite *TestSuite) TestFileExtension() {
+	assert.Equal(suite.T(), ".bam.c4gh", fileExtension("file.bam.c4gh"))
+	assert.Equal(suite.T(), ".c4gh", fileExtension("file.c4gh"))
+	assert.Equal(suite.T(), ".txt", fileExtension("file.txt"))
+	assert.Equal(suite.T(), "(none)", fileExtension("README"))
+	assert.Equal(suite.T(), "(none)", fileExtension(".c4gh"))
+}
+
+func (suite *TestSuite) TestGroupByExtension() {
+	files := []fileSize{
+		{Key: "a.bam.c4gh", Size: 10},
+		{Key: "b.vcf.c4gh", Size: 5},
+		{Key: "sub/c.bam.c4gh", Size: 20},
+	}
+	assert.Equal(suite.T(), []extensionSize{
+		{Extension: ".bam.c4gh", FileCount: 2, TotalBytes: 30},
+		{Extension: ".vcf.c4gh", FileCount: 1, TotalBytes: 5},
+	}, groupByExtension(files))
+
+	var out bytes.Buffer
+	printExtensions(&out, groupByExtension(files))
+	assert.Equal(suite.T(), `EXTENSION  FILES  SIZE
+.bam.c4gh  2      30 B
+.vcf.c4gh  1      5 B
+`, out.String())
+}
+
+func (suite *TestSuite) TestDatasetSizeJSON() {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := w.Write([]byte(r.URL.Path))
+		assert.NoError(suite.T(), err)
+	}))
+	defer ts.Close()
+
+	urlsFile := filepath.Join(suite.T().TempDir(), "urls_list.txt")
+	err := os.WriteFile(urlsFile, []byte(ts.URL+"/dataset/a.bam.c4gh\n"+ts.URL+"/dataset/b.bam.c4gh\n"+ts.URL+"/dataset/c.vcf.c4gh\n"), 0600)
+	assert.NoError(suite.T(), err)
+
+	rescueStdout := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+
+	os.Args = []string{"datasetsize", "-format", "json", "-by-ext", "-verbose", urlsFile}
+	err = DatasetSize(os.Args)
+	*outputFormat = "text"
+	*byExtension = false
+	*verbose = false
+
+	w.Close()
+	os.Stdout = rescueStdout
+	assert.NoError(suite.T(), err)
+	output, _ := io.ReadAll(r)
+
+	var report map[string]interface{}
+	assert.NoError(suite.T(), json.Unmarshal(output, &report))
+	assert.Equal(suite.T(), map[string]interface{}{
+		"dataset":     "dataset",
+		"total_bytes": float64(57),
+		"file_count":  float64(3),
+		"human_size":  "57 B",
+		"extensions": []interface{}{
+			map[string]interface{}{"extension": ".bam.c4gh", "file_count": float64(2), "total_bytes": float64(38)},
+			map[string]interface{}{"extension": ".vcf.c4gh", "file_count": float64(1), "total_bytes": float64(19)},
+		},
+		"files": []interface{}{
+			map[string]interface{}{"key": "a.bam.c4gh", "size": float64(19)},
+			map[string]interface{}{"key": "b.bam.c4gh", "size": float64(19)},
+			map[string]interface{}{"key": "c.vcf.c4gh", "size": float64(19)},
+		},
+	}, report)
+}
+
+func (suite *TestSuite) TestDatasetID() {
+	assert.Equal(suite.T(), "EGAD001", datasetID([]string{
+		"http://localhost:9000/download/EGAD001/a.c4gh",
+		"http://localhost:9000/download/EGAD001/sub/b.c4gh",
+	}))
+	assert.Equal(suite.T(), "sub", datasetID([]string{"http://localhost:9000/download/EGAD001/sub/b.c4gh"}))
+	assert.Equal(suite.T(), "", datasetID([]string{"http://host/a/x.c4gh", "http://host/b/y.c4gh"}))
+	assert.Equal(suite.T(), "", datasetID(nil))
+}
+
+func (suite *TestSuite) TestPrintFiles() {
+	var out bytes.Buffer
+	printFiles(&out, []fileSize{{Key: "a.c4gh", Size: 5}, {Key: "sub/b.c4gh", Size: 2 * 1024 * 1024}})
+	assert.Equal(suite.T(), `   5 B  a.c4gh
+2.0 MB  sub/b.c4gh
+`, out.String())
+}
+
+func (suite *TestSuite) TestCompareReports() {
+	first := sizeReport{Dataset: "EGAD001", TotalBytes: 2048, FileCount: 2}
+	second := sizeReport{Dataset: "EGAD002", TotalBytes: 1024, FileCount: 1}
+
+	comparison := compareReports(first, second, "a.txt", "b.txt")
+	assert.Equal(suite.T(), int64(1024), comparison.DifferenceBytes)
+	assert.Equal(suite.T(), "EGAD001", comparison.Larger)
+
+	var out bytes.Buffer
+	assert.NoError(suite.T(), printComparison(&out, comparison))
+	assert.Equal(suite.T(), `DATASET  FILES  SIZE
+EGAD001  2      2.0 KB
+EGAD002  1      1.0 KB
+EGAD001 is larger than EGAD002 by 1.0 KB (1024 bytes)
+`, out.String())
+
+	// Datasets with the same id are named by their locations
+	second.Dataset = "EGAD001"
+	second.TotalBytes = 4096
+	comparison = compareReports(first, second, "a.txt", "b.txt")
+	assert.Equal(suite.T(), int64(-2048), comparison.DifferenceBytes)
+	assert.Equal(suite.T(), "b.txt", comparison.Larger)
+
+	second.TotalBytes = 2048
+	comparison = compareReports(first, second, "a.txt", "b.txt")
+	assert.Equal(suite.T(), "", comparison.Larger)
+	out.Reset()
+	assert.NoError(suite.T(), printComparison(&out, comparison))
+	assert.True(suite.T(), strings.HasSuffix(out.String(), "The datasets have the same size\n"))
+}
+
+func (suite *TestSuite) TestDatasetSizeCompare() {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := w.Write([]byte(r.URL.Path))
+		assert.NoError(suite.T(), err)
+	}))
+	defer ts.Close()
+
+	dir := suite.T().TempDir()
+	originalFile := filepath.Join(dir, "original.txt")
+	err := os.WriteFile(originalFile, []byte(ts.URL+"/original/a.c4gh\n"+ts.URL+"/original/b.c4gh\n"), 0600)
+	assert.NoError(suite.T(), err)
+	reuploadFile := filepath.Join(dir, "reupload.txt")
+	err = os.WriteFile(reuploadFile, []byte(ts.URL+"/reupload/a.c4gh\n"), 0600)
+	assert.NoError(suite.T(), err)
+
+	rescueStdout := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+
+	os.Args = []string{"datasetsize", "-format", "json", "-compare", reuploadFile, originalFile}
+	err = DatasetSize(os.Args)
+	*outputFormat = "text"
+	*compareWith = ""
+
+	w.Close()
+	os.Stdout = rescueStdout
+	assert.NoError(suite.T(), err)
+	output, _ := io.ReadAll(r)
+
+	var comparison sizeComparison
+	assert.NoError(suite.T(), json.Unmarshal(output, &comparison))
+	assert.Equal(suite.T(), int64(16), comparison.DifferenceBytes)
+	assert.Equal(suite.T(), "original", comparison.Larger)
+	assert.Equal(suite.T(), "reupload", comparison.Datasets[1].Dataset)
+}
+
+func (suite *TestSuite) TestDatasetSizeText() {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := w.Write([]byte(r.URL.Path))
+		assert.NoError(suite.T(), err)
+	}))
+	defer ts.Close()
+
+	urlsFile := filepath.Join(suite.T().TempDir(), "urls_list.txt")
+	err := os.WriteFile(urlsFile, []byte(ts.URL+"/dataset/a.c4gh\n"+ts.URL+"/dataset/b.c4gh\n"), 0600)
+	assert.NoError(suite.T(), err)
+
+	run := func(args ...string) string {
+		rescueStdout := os.Stdout
+		r, w, _ := os.Pipe()
+		os.Stdout = w
+
+		os.Args = append(append([]string{"datasetsize"}, args...), urlsFile)
+		err := DatasetSize(os.Args)
+		*noFiles = false
+
+		w.Close()
+		os.Stdout = rescueStdout
+		assert.NoError(suite.T(), err)
+		output, _ := io.ReadAll(r)
+
+		return string(output)
+	}
+
+	// The files are listed before the total by default
+	assert.Equal(suite.T(), "15 B  a.c4gh\n15 B  b.c4gh\nTotal dataset size: 30 B\n", run())
+	assert.Equal(suite.T(), "Total dataset size: 30 B\n", run("-no-files"))
+}
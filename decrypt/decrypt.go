@@ -13,6 +13,8 @@ import (
 	"github.com/neicnordic/crypt4gh/keys"
 	"github.com/neicnordic/crypt4gh/streaming"
 	log "github.com/sirupsen/logrus"
+	"github.com/vbauerster/mpb/v8"
+	"github.com/vbauerster/mpb/v8/decor"
 )
 
 // Help text and command line flags.
@@ -20,13 +22,21 @@ import (
 // Usage text that will be displayed as command line help text when using the
 // `help decrypt` command
 var Usage = `
-USAGE: %s decrypt -key <private-key-file> [file(s)]
+USAGE: %s decrypt -key <private-key-file> (-stdout) (-outfile <file>) (-filelist <file>) (-use-keyring) [file(s)]
 
 decrypt:
     Decrypts files from the Sensitive Data Archive (SDA) with the
     provided private key.  If the private key is encrypted, the password
-    can be supplied in the C4GH_PASSWORD environment variable, or at the
-    interactive password prompt.
+    can be supplied in the SDA_CLI_PASSPHRASE or C4GH_PASSWORD
+    environment variables, or at the interactive password prompt.  With
+    '-use-keyring', the password is stored in the system keyring the
+    first time it is entered, and read from there later on.  With
+    '-stdout', a single file is decrypted to stdout instead, e.g. for
+    piping it to another tool.  The decrypted files are named as the
+    input files without the .c4gh suffix, unless another name is given
+    with '-outfile'.  Many files can be given in a file list with
+    '-filelist', one file per line.  Failed files in the list are
+    reported without stopping the others.
 `
 
 // ArgHelp is the suffix text that will be displayed after the argument list in
@@ -42,6 +52,26 @@ var Args = flag.NewFlagSet("decrypt", flag.ExitOnError)
 var privateKeyFile = Args.String("key", "",
 	"Private key to use for decrypting files.")
 
+var outFileName = Args.String("outfile", "",
+	"Output file for the decrypted data, when decrypting a single file.")
+
+var fileList = Args.String("filelist", "",
+	"File with the files to decrypt, one per line. Empty lines and lines\n"+
+		"starting with # are ignored.")
+
+var useKeyring = Args.Bool("use-keyring", false,
+	"Read the private key password from the system keyring, and store it\n"+
+		"there when it is entered.")
+
+var toStdout = Args.Bool("stdout", false,
+	"Write the decrypted data of a single file to stdout.")
+
+// Long names of the short flags
+func init() {
+	helpers.AliasFlag(Args, "key", "private-key")
+	helpers.AliasFlag(Args, "outfile", "output-file")
+}
+
 // Decrypt takes a set of arguments, parses them, and attempts to decrypt the
 // given data files with the given private key file..
 func Decrypt(args []string) error {
@@ -49,17 +79,34 @@ func Decrypt(args []string) error {
 	// Call ParseArgs to take care of all the flag parsing
 	err := helpers.ParseArgs(args, Args)
 	if err != nil {
-		return fmt.Errorf("failed parsing arguments, reason: %v", err)
+		return fmt.Errorf("failed parsing arguments, reason: %w", err)
+	}
+
+	// The files to decrypt are the non-flag arguments, followed by the
+	// files in the file list
+	inputs := Args.Args()
+	if *fileList != "" {
+		listed, err := helpers.ReadFileList(*fileList)
+		if err != nil {
+			return err
+		}
+		inputs = append(inputs, listed...)
+	}
+
+	if *outFileName != "" && len(inputs) != 1 {
+		return fmt.Errorf("-outfile can only be used when decrypting a single file, found %d files", len(inputs))
 	}
 
 	// format input and output files
-	// Args() returns the non-flag arguments, which we assume are filenames.
 	// All filenames are read into a struct together with their output filenames
 	files := []helpers.EncryptionFileSet{}
-	for _, filename := range Args.Args() {
+	for _, filename := range inputs {
 
 		// Set directory for the output file
 		unencryptedFilename := strings.TrimSuffix(filename, ".c4gh")
+		if *outFileName != "" {
+			unencryptedFilename = *outFileName
+		}
 
 		files = append(files, helpers.EncryptionFileSet{Encrypted: filename, Unencrypted: unencryptedFilename})
 	}
@@ -69,23 +116,32 @@ func Decrypt(args []string) error {
 		return errors.New("a private key is required to decrypt data")
 	}
 
-	var privateKey *[32]byte
-
-	// try reading private key without password
-	privateKey, err = readPrivateKey(*privateKeyFile, "")
+	privateKey, err := ReadPrivateKeyFile(*privateKeyFile)
 	if err != nil {
+		return helpers.WithCategory(helpers.ErrCrypto, err)
+	}
 
-		// if there was an error, try again with the password
-		password, err := getPassword("C4GH_PASSWORD")
-		if err != nil {
-			return err
+	// Decrypt a single file to stdout. Log messages go to stderr, so they
+	// do not mix with the data.
+	if *toStdout {
+		if len(files) != 1 {
+			return fmt.Errorf("only a single file can be decrypted to stdout, found %d files", len(files))
 		}
-
-		// Loading private key file
-		privateKey, err = readPrivateKey(*privateKeyFile, password)
-		if err != nil {
-			return err
+		if !helpers.FileIsReadable(files[0].Encrypted) {
+			return helpers.WithCategory(helpers.ErrIO, fmt.Errorf("cannot read input file %s", files[0].Encrypted))
 		}
+
+		return decryptStream(files[0].Encrypted, os.Stdout, *privateKey, nil)
+	}
+
+	// create progress bar instance, shared by all files
+	p := helpers.NewProgress()
+	defer p.Shutdown()
+
+	// Files from a file list are decrypted as a batch, where a failed file
+	// does not stop the others
+	if *fileList != "" {
+		return decryptBatch(files, *privateKey, p)
 	}
 
 	// Check that all the encrypted files exist, and all the unencrypted don't
@@ -99,7 +155,7 @@ func Decrypt(args []string) error {
 	for i, file := range files {
 		log.Infof("Decrypting file %v/%v: %s", i+1, numFiles, file.Encrypted)
 
-		err = decrypt(file.Encrypted, file.Unencrypted, *privateKey)
+		err = decrypt(file.Encrypted, file.Unencrypted, *privateKey, p)
 		if err != nil {
 			return err
 		}
@@ -108,14 +164,87 @@ func Decrypt(args []string) error {
 	return nil
 }
 
-// getPassword will check if the `envVar` environment variable is set, and
-// return its value if present. Otherwise, the password will be read from a user
-// prompt.
-func getPassword(envVar string) (string, error) {
-	// check if there is a password available in the `envVar` env variable
-	password, available := os.LookupEnv(envVar)
-	if available {
-		return password, nil
+// decryptBatch decrypts all the files, reporting the files that fail without
+// stopping. A summary of the batch is printed at the end, and an error is
+// returned if any file failed.
+func decryptBatch(files []helpers.EncryptionFileSet, privateKey [32]byte, p *mpb.Progress) error {
+	failed := 0
+	for i, file := range files {
+		log.Infof("Decrypting file %v/%v: %s", i+1, len(files), file.Encrypted)
+
+		err := checkFiles([]helpers.EncryptionFileSet{file})
+		if err == nil {
+			err = decrypt(file.Encrypted, file.Unencrypted, privateKey, p)
+		}
+		if err != nil {
+			log.Errorf("Failed to decrypt %s, reason: %v", file.Encrypted, err)
+			failed++
+		}
+	}
+
+	fmt.Printf("Decrypted %d of %d files, %d failed\n", len(files)-failed, len(files), failed)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed to decrypt", failed, len(files))
+	}
+
+	return nil
+}
+
+// ReadPrivateKeyFile reads a crypt4gh private key from a file. If the key can
+// not be read without a password, the password is taken from the system
+// keyring if -use-keyring is set, the SDA_CLI_PASSPHRASE or C4GH_PASSWORD
+// environment variables, or from a user prompt.
+func ReadPrivateKeyFile(filename string) (*[32]byte, error) {
+	// try reading private key without password
+	privateKey, err := readPrivateKey(filename, "")
+	if err == nil {
+		return privateKey, nil
+	}
+
+	// try the password stored in the keyring
+	if *useKeyring {
+		password, found, err := helpers.GetKeyringPassphrase(filename)
+		switch {
+		case err != nil:
+			log.Warning(err)
+		case found:
+			if privateKey, err := readPrivateKey(filename, password); err == nil {
+				return privateKey, nil
+			}
+			log.Warningf("the password in the keyring does not unlock %s", filename)
+		}
+	}
+
+	// if there was an error, try again with the password
+	password, err := getPassword("SDA_CLI_PASSPHRASE", "C4GH_PASSWORD")
+	if err != nil {
+		return nil, err
+	}
+
+	privateKey, err = readPrivateKey(filename, password)
+	if err != nil {
+		return nil, err
+	}
+
+	// remember the working password for the next time
+	if *useKeyring {
+		if err := helpers.SetKeyringPassphrase(filename, password); err != nil {
+			log.Warning(err)
+		}
+	}
+
+	return privateKey, nil
+}
+
+// getPassword will check if any of the `envVars` environment variables is
+// set, in the given order, and return the first value present. Otherwise, the
+// password will be read from a user prompt.
+func getPassword(envVars ...string) (string, error) {
+	// check if there is a password available in the `envVars` env variables
+	for _, envVar := range envVars {
+		if password, available := os.LookupEnv(envVar); available {
+			return password, nil
+		}
 	}
 
 	// otherwise, read the password from a user prompt
@@ -158,31 +287,50 @@ func checkFiles(files []helpers.EncryptionFileSet) error {
 	for _, file := range files {
 		// check that the input file exists and is readable
 		if !helpers.FileIsReadable(file.Encrypted) {
-			return fmt.Errorf("cannot read input file %s", file.Encrypted)
+			return helpers.WithCategory(helpers.ErrIO, fmt.Errorf("cannot read input file %s", file.Encrypted))
 		}
 
 		// check that the output file doesn't exist
 		if helpers.FileExists(file.Unencrypted) {
-			return fmt.Errorf("outfile %s already exists", file.Unencrypted)
+			return helpers.WithCategory(helpers.ErrIO, fmt.Errorf("outfile %s already exists", file.Unencrypted))
 		}
 	}
 
 	return nil
 }
 
+// DecryptFile decrypts the file `filename` with `privateKey` to `outfileName`,
+// which must not exist. The progress is shown in a bar added to `p`, unless
+// `p` is nil.
+func DecryptFile(filename, outfileName string, privateKey [32]byte, p *mpb.Progress) error {
+	return decrypt(filename, outfileName, privateKey, p)
+}
+
 // decrypts the data in `filename` with the given `privateKey`, writing the
-// resulting data to `outfile`.
-func decrypt(filename, outfileName string, privateKey [32]byte) error {
+// resulting data to `outfile`. The progress is shown in a bar added to `p`,
+// unless `p` is nil.
+func decrypt(filename, outfileName string, privateKey [32]byte, p *mpb.Progress) error {
 
 	// check that the infile exists, and the the outfile doesn't exist
 	if !helpers.FileIsReadable(filename) {
-		return fmt.Errorf("infile %s does not exist or could not be read", filename)
+		return helpers.WithCategory(helpers.ErrIO, fmt.Errorf("infile %s does not exist or could not be read", filename))
 	}
 
 	if helpers.FileExists(outfileName) {
-		return fmt.Errorf("outfile %s already exists", outfileName)
+		return helpers.WithCategory(helpers.ErrIO, fmt.Errorf("outfile %s already exists", outfileName))
 	}
 
+	// The output file is only created once the whole file is decrypted, so
+	// that no partially decrypted file is left behind
+	return helpers.AtomicWriter(outfileName, func(w io.Writer) error {
+		return decryptStream(filename, w, privateKey, p)
+	})
+}
+
+// decrypts the data in `filename` with the given `privateKey`, writing the
+// resulting data to `out`. The progress is shown in a bar added to `p`,
+// unless `p` is nil.
+func decryptStream(filename string, out io.Writer, privateKey [32]byte, p *mpb.Progress) error {
 	// open input file for reading
 	inFile, err := os.Open(filepath.Clean(filename))
 	if err != nil {
@@ -194,21 +342,39 @@ func decrypt(filename, outfileName string, privateKey [32]byte) error {
 		}
 	}()
 
-	// Create crypt4gh reader
-	crypt4GHReader, err := streaming.NewCrypt4GHReader(inFile, privateKey, nil)
-	if err != nil {
-		return fmt.Errorf("could not create cryp4gh reader: %s", err)
+	var in io.Reader = inFile
+	if p != nil {
+		fileInfo, err := inFile.Stat()
+		if err != nil {
+			return err
+		}
+		file := fmt.Sprintf("File %s:", filepath.Base(filename))
+		// The progress bar starts with the file name, followed by the
+		// decrypting status, the processed bytes and the estimated time
+		// remaining. It is marked as done when the decryption is complete
+		bar := p.AddBar(fileInfo.Size(),
+			mpb.PrependDecorators(
+				decor.Name(file, decor.WC{W: len(file) + 1, C: decor.DidentRight}),
+				decor.Name("decrypting", decor.WCSyncSpaceR),
+				decor.Counters(decor.SizeB1024(0), "% .1f / % .1f"),
+			),
+			mpb.AppendDecorators(
+				decor.OnComplete(decor.Percentage(decor.WC{W: 5}), "done"),
+				decor.OnComplete(decor.EwmaETA(decor.ET_STYLE_GO, 30, decor.WC{W: 4}), ""),
+			),
+		)
+		in = bar.ProxyReader(inFile)
 	}
 
-	// open output file for writing
-	outFile, err := os.Create(filepath.Clean(outfileName))
+	// Create crypt4gh reader
+	crypt4GHReader, err := streaming.NewCrypt4GHReader(in, privateKey, nil)
 	if err != nil {
-		return fmt.Errorf("could not create output file %s: %s", outfileName, err)
+		return helpers.WithCategory(helpers.ErrCrypto, fmt.Errorf("could not create cryp4gh reader: %w", err))
 	}
 
-	_, err = io.Copy(outFile, crypt4GHReader)
+	_, err = io.Copy(out, crypt4GHReader)
 	if err != nil {
-		return fmt.Errorf("could not decrypt file %s: %s", filename, err)
+		return helpers.WithCategory(helpers.ErrCrypto, fmt.Errorf("could not decrypt file %s: %w", filename, err))
 	}
 
 	return nil
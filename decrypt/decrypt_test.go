@@ -13,6 +13,8 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
+	"github.com/vbauerster/mpb/v8"
+	"github.com/zalando/go-keyring"
 )
 
 type DecryptTests struct {
@@ -80,6 +82,57 @@ func (suite *DecryptTests) TestreadPrivateKey() {
 	assert.NoError(suite.T(), err)
 }
 
+func (suite *DecryptTests) TestgetPassword() {
+	suite.T().Setenv("C4GH_PASSWORD", "c4gh")
+	password, err := getPassword("SDA_CLI_PASSPHRASE", "C4GH_PASSWORD")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "c4gh", password)
+
+	// SDA_CLI_PASSPHRASE takes precedence
+	suite.T().Setenv("SDA_CLI_PASSPHRASE", "sda-cli")
+	password, err = getPassword("SDA_CLI_PASSPHRASE", "C4GH_PASSWORD")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "sda-cli", password)
+}
+
+func (suite *DecryptTests) TestReadPrivateKeyFilePassphrase() {
+	testKeyFile := filepath.Join(suite.tempDir, "passkey")
+	err := createKey.GenerateKeyPair(testKeyFile, "secret")
+	assert.NoError(suite.T(), err)
+	defer os.Remove(testKeyFile + ".pub.pem")
+	defer os.Remove(testKeyFile + ".sec.pem")
+
+	suite.T().Setenv("SDA_CLI_PASSPHRASE", "secret")
+	_, err = ReadPrivateKeyFile(testKeyFile + ".sec.pem")
+	assert.NoError(suite.T(), err)
+}
+
+func (suite *DecryptTests) TestReadPrivateKeyFileKeyring() {
+	keyring.MockInit()
+	*useKeyring = true
+	defer func() { *useKeyring = false }()
+
+	testKeyFile := filepath.Join(suite.tempDir, "keyringkey")
+	err := createKey.GenerateKeyPair(testKeyFile, "secret")
+	assert.NoError(suite.T(), err)
+	defer os.Remove(testKeyFile + ".pub.pem")
+	defer os.Remove(testKeyFile + ".sec.pem")
+
+	// A password that unlocks the key is stored in the keyring
+	suite.T().Setenv("SDA_CLI_PASSPHRASE", "secret")
+	_, err = ReadPrivateKeyFile(testKeyFile + ".sec.pem")
+	assert.NoError(suite.T(), err)
+	passphrase, found, err := helpers.GetKeyringPassphrase(testKeyFile + ".sec.pem")
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), found)
+	assert.Equal(suite.T(), "secret", passphrase)
+
+	// The stored password is used before the environment
+	suite.T().Setenv("SDA_CLI_PASSPHRASE", "wrong")
+	_, err = ReadPrivateKeyFile(testKeyFile + ".sec.pem")
+	assert.NoError(suite.T(), err)
+}
+
 func (suite *DecryptTests) TestcheckFiles() {
 	// unencrypted is readable, and unencrypted isn't (this is fine!)
 	testOk := helpers.EncryptionFileSet{Encrypted: suite.testFile.Name(), Unencrypted: "does-not-exist"}
@@ -136,20 +189,20 @@ func (suite *DecryptTests) Testdecrypt() {
 	}
 
 	// Test decrypting a non-existent file
-	err = decrypt(filepath.Join(suite.tempDir, "non-existent"), "output_file", *privateKey)
+	err = decrypt(filepath.Join(suite.tempDir, "non-existent"), "output_file", *privateKey, nil)
 	assert.EqualError(suite.T(), err, fmt.Sprintf("infile %s does not exist or could not be read", filepath.Join(suite.tempDir, "non-existent")))
 
 	// Test decrypting where the output file exists
-	err = decrypt(encryptedFile, suite.testFile.Name(), *privateKey)
+	err = decrypt(encryptedFile, suite.testFile.Name(), *privateKey, nil)
 	assert.EqualError(suite.T(), err, fmt.Sprintf("outfile %s already exists", suite.testFile.Name()))
 
 	// Test decryption with malformed key
 	fakeKey := [32]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
-	err = decrypt(encryptedFile, decryptedFile, fakeKey)
+	err = decrypt(encryptedFile, decryptedFile, fakeKey, nil)
 	assert.EqualError(suite.T(), err, "could not create cryp4gh reader: could not find matching public key header, decryption failed")
 
 	// Test decrypting with the real key
-	err = decrypt(encryptedFile, decryptedFile, *privateKey)
+	err = decrypt(encryptedFile, decryptedFile, *privateKey, nil)
 	assert.NoError(suite.T(), err)
 
 	// Check content of the decrypted file
@@ -162,4 +215,67 @@ func (suite *DecryptTests) Testdecrypt() {
 		log.Error("Couldn't read decrypted filedata for content checking")
 	}
 	assert.Equal(suite.T(), fileData, suite.fileContent)
+
+	// Test decrypting with a progress bar
+	progressFile := filepath.Join(suite.tempDir, "progress_file")
+	defer os.Remove(progressFile)
+	p := mpb.New(mpb.WithOutput(io.Discard))
+	err = decrypt(encryptedFile, progressFile, *privateKey, p)
+	assert.NoError(suite.T(), err)
+	p.Wait()
+	fileData, err = os.ReadFile(progressFile)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), suite.fileContent, fileData)
+
+	// Test decrypting to a given output file, which requires a single file
+	defer func() { *outFileName = "" }()
+	outFile := filepath.Join(suite.tempDir, "named_output")
+	defer os.Remove(outFile)
+	os.Args = []string{"decrypt", "-key", fmt.Sprintf("%s.sec.pem", testKeyFile), "-outfile", outFile, encryptedFile, encryptedFile}
+	err = Decrypt(os.Args)
+	assert.EqualError(suite.T(), err, "-outfile can only be used when decrypting a single file, found 2 files")
+
+	os.Args = []string{"decrypt", "-key", fmt.Sprintf("%s.sec.pem", testKeyFile), "-outfile", outFile, encryptedFile}
+	err = Decrypt(os.Args)
+	assert.NoError(suite.T(), err)
+	fileData, err = os.ReadFile(outFile)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), suite.fileContent, fileData)
+	*outFileName = ""
+
+	// Test decrypting a file list, where a failed file does not stop the
+	// others
+	defer func() { *fileList = "" }()
+	list := filepath.Join(suite.tempDir, "files.txt")
+	defer os.Remove(list)
+	err = os.WriteFile(list, []byte("# files to decrypt\n"+filepath.Join(suite.tempDir, "missing.c4gh")+"\n"+encryptedFile+"\n"), 0600)
+	assert.NoError(suite.T(), err)
+	assert.NoError(suite.T(), os.Remove(suite.testFile.Name()))
+
+	os.Args = []string{"decrypt", "-key", fmt.Sprintf("%s.sec.pem", testKeyFile), "-filelist", list}
+	err = Decrypt(os.Args)
+	assert.EqualError(suite.T(), err, "1 of 2 files failed to decrypt")
+	fileData, err = os.ReadFile(suite.testFile.Name())
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), suite.fileContent, fileData)
+	*fileList = ""
+
+	// Test decrypting to stdout, which requires a single file
+	defer func() { *toStdout = false }()
+	os.Args = []string{"decrypt", "-key", fmt.Sprintf("%s.sec.pem", testKeyFile), "-stdout", encryptedFile, encryptedFile}
+	err = Decrypt(os.Args)
+	assert.EqualError(suite.T(), err, "only a single file can be decrypted to stdout, found 2 files")
+
+	rescueStdout := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+
+	os.Args = []string{"decrypt", "-key", fmt.Sprintf("%s.sec.pem", testKeyFile), "-stdout", encryptedFile}
+	err = Decrypt(os.Args)
+	assert.NoError(suite.T(), err)
+
+	w.Close()
+	os.Stdout = rescueStdout
+	stdoutData, _ := io.ReadAll(r)
+	assert.Equal(suite.T(), suite.fileContent, stdoutData)
 }
@@ -0,0 +1,162 @@
+package deletefile
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/NBISweden/sda-cli/helpers"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Help text and command line flags.
+
+// Usage text that will be displayed as command line help text when using the
+// `help delete` command
+var Usage = `
+USAGE: %s delete [-config <s3config-file>] [-profile <name>] (-filelist <file>) (-y) [key(s)]
+
+delete:
+    Deletes files from the user's folder in the Sensitive Data Archive
+    (SDA).  The keys of the files can be given as arguments, or in a
+    file list with '-filelist', one key per line.  The deletion has to
+    be confirmed, unless '-y' is given.  If no config is specified, the
+    tool will look for a previous session, or the profile given with
+    '-profile' in ~/.sda-cli/config.
+`
+
+// ArgHelp is the suffix text that will be displayed after the argument list in
+// the module help
+var ArgHelp = `
+    [key(s)]
+        The keys of the files to delete.`
+
+// Args is a flagset that needs to be exported so that it can be written to the
+// main program help
+var Args = flag.NewFlagSet("delete", flag.ExitOnError)
+
+var configPath = Args.String("config", "",
+	"S3 config file to use for deleting.")
+
+var profile = Args.String("profile", "",
+	"Named profile in ~/.sda-cli/config to use instead of the session file.")
+
+var fileList = Args.String("filelist", "",
+	"File with the keys of the files to delete, one per line. Empty lines\n"+
+		"and lines starting with # are ignored.")
+
+var assumeYes = Args.Bool("y", false,
+	"Delete the files without asking for confirmation.")
+
+// Long names of the short flags
+func init() {
+	helpers.AliasFlag(Args, "y", "yes")
+}
+
+// Delete deletes the files with the given keys from the user's folder.
+func Delete(args []string) error {
+	// Call ParseArgs to take care of all the flag parsing
+	err := helpers.ParseArgs(args, Args)
+	if err != nil {
+		return fmt.Errorf("failed parsing arguments, reason: %w", err)
+	}
+
+	// The keys are the non-flag arguments, followed by the keys in the
+	// file list
+	keys := Args.Args()
+	if *fileList != "" {
+		listed, err := helpers.ReadFileList(*fileList)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, listed...)
+	}
+	if len(keys) == 0 {
+		return errors.New("no files to delete, give the keys as arguments or with -filelist")
+	}
+
+	// Get the configuration file or the .sda-cli-session
+	config, err := helpers.GetAuth(*configPath, *profile)
+	if err != nil {
+		return fmt.Errorf("failed to load config file, reason: %w", err)
+	}
+
+	err = helpers.WarnTokenExpiration(config)
+	if err != nil {
+		return err
+	}
+
+	sess, err := helpers.NewS3Session(config)
+	if err != nil {
+		return err
+	}
+
+	return deleteFiles(s3.New(sess), config.AccessKey, keys, helpers.PromptConfirm, os.Stdout)
+}
+
+// deleteFiles deletes the files with the given keys from the bucket, after it
+// is confirmed with confirm, and writes a line with the result for each file to
+// out. It returns an error if any file could not be deleted.
+func deleteFiles(svc *s3.S3, bucket string, keys []string, confirm func(string) (bool, error), out io.Writer) error {
+	if !*assumeYes {
+		fmt.Fprintf(os.Stderr, "The following files will be deleted from the archive:\n  %s\n", strings.Join(keys, "\n  "))
+		confirmed, err := confirm(fmt.Sprintf("Delete %d file(s)?", len(keys)))
+		if err != nil {
+			return err
+		}
+		if !confirmed {
+			fmt.Fprintln(out, "Deletion cancelled")
+
+			return nil
+		}
+	}
+
+	failed := 0
+	for _, key := range keys {
+		if err := deleteFile(svc, bucket, strings.TrimPrefix(key, "/")); err != nil {
+			fmt.Fprintf(out, "FAILED  %s: %v\n", key, err)
+			failed++
+
+			continue
+		}
+		fmt.Fprintf(out, "DELETED %s\n", key)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files could not be deleted", failed, len(keys))
+	}
+
+	return nil
+}
+
+// deleteFile deletes the file with the given key. Deleting a missing object
+// succeeds in S3, so the file is first checked to exist.
+func deleteFile(svc *s3.S3, bucket, key string) error {
+	_, err := svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var reqErr awserr.RequestFailure
+		if errors.As(err, &reqErr) && reqErr.StatusCode() == 404 {
+			return errors.New("file does not exist")
+		}
+
+		return fmt.Errorf("failed to get information about file, reason: %w", err)
+	}
+
+	_, err = svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete file, reason: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,179 @@
+package diff
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/NBISweden/sda-cli/helpers"
+	"github.com/NBISweden/sda-cli/syncdir"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Help text and command line flags.
+
+// Usage text that will be displayed as command line help text when using the
+// `help diff` command
+var Usage = `
+USAGE: %s diff [-config <s3config-file>] [-profile <name>] [local-dir] [remote-prefix]
+
+diff:
+    Compares a local directory with a folder in the Sensitive Data
+    Archive (SDA), without changing anything.  The files that only
+    exist locally, the files that only exist in the archive, and the
+    files that exist in both but with different sizes are listed.  The
+    local files are compared with the keys they would be uploaded to by
+    'sync'.  If no config is specified, the tool will look for a
+    previous session, or the profile given with '-profile' in
+    ~/.sda-cli/config.
+`
+
+// ArgHelp is the suffix text that will be displayed after the argument list in
+// the module help
+var ArgHelp = `
+    [local-dir]
+        The directory to compare.
+    [remote-prefix]
+        The folder in the archive to compare the directory with.  The
+        user's base folder is used if omitted.`
+
+// Args is a flagset that needs to be exported so that it can be written to the
+// main program help
+var Args = flag.NewFlagSet("diff", flag.ExitOnError)
+
+var configPath = Args.String("config", "",
+	"S3 config file to use for listing the archive.")
+
+var profile = Args.String("profile", "",
+	"Named profile in ~/.sda-cli/config to use instead of the session file.")
+
+// ANSI colors of the sections
+const (
+	colorGreen  = "\033[32m"
+	colorRed    = "\033[31m"
+	colorYellow = "\033[33m"
+	colorReset  = "\033[0m"
+)
+
+// sizeDiff is a file that exists both locally and in the archive, with
+// different sizes
+type sizeDiff struct {
+	key        string
+	localSize  int64
+	remoteSize int64
+}
+
+// comparison holds the keys of the files that differ between the local
+// directory and the archive
+type comparison struct {
+	onlyLocal  []string
+	onlyRemote []string
+	different  []sizeDiff
+}
+
+// Diff lists the differences between a local directory and a folder in the
+// archive.
+func Diff(args []string) error {
+	// Call ParseArgs to take care of all the flag parsing
+	err := helpers.ParseArgs(args, Args)
+	if err != nil {
+		return fmt.Errorf("failed parsing arguments, reason: %w", err)
+	}
+
+	if len(Args.Args()) < 1 || len(Args.Args()) > 2 {
+		return errors.New("a local directory and optionally a remote prefix are required")
+	}
+	localDir := Args.Args()[0]
+	prefix := ""
+	if len(Args.Args()) == 2 {
+		prefix = strings.Trim(Args.Args()[1], "/")
+	}
+
+	local, err := syncdir.LocalFiles(localDir, prefix)
+	if err != nil {
+		return err
+	}
+
+	// Get the configuration file or the .sda-cli-session
+	config, err := helpers.GetAuth(*configPath, *profile)
+	if err != nil {
+		return fmt.Errorf("failed to load config file, reason: %w", err)
+	}
+
+	err = helpers.WarnTokenExpiration(config)
+	if err != nil {
+		return err
+	}
+
+	remote, err := syncdir.RemoteFiles(config, prefix)
+	if err != nil {
+		return err
+	}
+
+	printComparison(os.Stdout, compareFiles(local, remote), helpers.IsTerminal(os.Stdout))
+
+	return nil
+}
+
+// compareFiles compares the local files with the files in the archive, by
+// their keys
+func compareFiles(local []syncdir.LocalFile, remote map[string]*s3.Object) comparison {
+	var result comparison
+	localKeys := map[string]bool{}
+	for _, file := range local {
+		localKeys[file.Key] = true
+		object, found := remote[file.Key]
+		switch {
+		case !found:
+			result.onlyLocal = append(result.onlyLocal, file.Key)
+		case aws.Int64Value(object.Size) != file.Size:
+			result.different = append(result.different, sizeDiff{
+				key:        file.Key,
+				localSize:  file.Size,
+				remoteSize: aws.Int64Value(object.Size),
+			})
+		}
+	}
+	for key := range remote {
+		if !localKeys[key] {
+			result.onlyRemote = append(result.onlyRemote, key)
+		}
+	}
+
+	sort.Strings(result.onlyLocal)
+	sort.Strings(result.onlyRemote)
+	sort.Slice(result.different, func(i, j int) bool {
+		return result.different[i].key < result.different[j].key
+	})
+
+	return result
+}
+
+// printComparison writes the three sections of the comparison to w. The
+// sections are shown in color if colored is set.
+func printComparison(w io.Writer, result comparison, colored bool) {
+	var different []string
+	for _, file := range result.different {
+		different = append(different, fmt.Sprintf("%s (local %d bytes, remote %d bytes)", file.key, file.localSize, file.remoteSize))
+	}
+
+	printSection(w, "Only local", result.onlyLocal, colorGreen, colored)
+	printSection(w, "Only remote", result.onlyRemote, colorRed, colored)
+	printSection(w, "Different size", different, colorYellow, colored)
+}
+
+// printSection writes a section with a title and one line per entry to w
+func printSection(w io.Writer, title string, lines []string, color string, colored bool) {
+	fmt.Fprintf(w, "%s (%d):\n", title, len(lines))
+	for _, line := range lines {
+		if colored {
+			line = color + line + colorReset
+		}
+		fmt.Fprintf(w, "  %s\n", line)
+	}
+}
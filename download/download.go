@@ -2,17 +2,30 @@ package download
 
 import (
 	"bufio"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync/atomic"
+	"time"
 
+	"github.com/NBISweden/sda-cli/decrypt"
 	"github.com/NBISweden/sda-cli/helpers"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/neicnordic/crypt4gh/streaming"
 	log "github.com/sirupsen/logrus"
+	"github.com/vbauerster/mpb/v8"
+	"github.com/vbauerster/mpb/v8/decor"
 )
 
 // Help text and command line flags.
@@ -20,7 +33,7 @@ import (
 // Usage text that will be displayed as command line help text when using the
 // `help download` command
 var Usage = `
-USAGE: %s download (-outdir <dir>) [url | file]
+USAGE: %s download (-outdir <dir>) (-concurrency <n>) (-max-retries <n>) (-no-resume) (-stdout (-privkey <private-key-file>)) (-decrypt (-privkey <private-key-file>) (-rm-encrypted)) (-verify) (-presign (-presign-expires <duration>)) (-with-index) [url | file | -manifest <file>] (-)
 
 download:
     Downloads files from the Sensitive Data Archive (SDA).  A list with
@@ -29,7 +42,18 @@ download:
     (ending with "/"). Alternatively, the local path to such a file may
     be given, instead.  The files will be downloaded in the current
     directory, if outdir is not defined and their folder structure is
-    preserved.
+    preserved.  Interrupted downloads are continued from where they
+    stopped, unless '-no-resume' is given.  A list with a single file
+    may be written to stdout with '-stdout', or by giving '-' after the
+    list.  Files uploaded with the upload command can be downloaded
+    again by giving the manifest written by the upload with '-manifest'.
+    With '-decrypt', the files are decrypted after the download, with
+    the private key given with '-privkey' or in the configuration.
+    With '-presign', presigned URLs for the files are printed instead,
+    which can be used to download the files without sda-cli.  The URLs
+    contain the access token, so keep them private.
+    With '-with-index', the index files of BAM, VCF and FASTA files
+    are downloaded as well, without being listed.
 `
 
 // ArgHelp is the suffix text that will be displayed after the argument list in
@@ -43,6 +67,57 @@ var ArgHelp = `
 var Args = flag.NewFlagSet("download", flag.ExitOnError)
 var outDir = Args.String("outdir", "",
 	"Directory for downloaded files.")
+var noResume = Args.Bool("no-resume", false,
+	"Always download files from the beginning, instead of continuing\n"+
+		"partially downloaded files.")
+var concurrency = Args.Int("concurrency", 1, "Number of files to download in parallel.")
+var maxRetries = Args.Int("max-retries", 3,
+	"Number of times to retry failed downloads.")
+var toStdout = Args.Bool("stdout", false,
+	"Write the downloaded file to stdout instead of to a file.")
+var privateKeyFile = Args.String("privkey", "",
+	"Private key to decrypt the files with, when writing to stdout or\n"+
+		"with -decrypt.")
+var decryptFiles = Args.Bool("decrypt", false,
+	"Decrypt the files after download, with the private key given with\n"+
+		"-privkey or private_key in the configuration.")
+var rmEncrypted = Args.Bool("rm-encrypted", false,
+	"Remove the downloaded .c4gh files once they are decrypted.")
+var verifyDownload = Args.Bool("verify", false,
+	"Verify the checksum of each downloaded file against the archive,\n"+
+		"or against the manifest when used with -manifest.")
+var manifestFile = Args.String("manifest", "",
+	"Download the files listed in a manifest written by the upload command.")
+var presign = Args.Bool("presign", false,
+	"Print a presigned URL for each file instead of downloading it, using\n"+
+		"the credentials of the configuration.")
+var presignExpires = Args.Duration("presign-expires", 24*time.Hour,
+	"How long the presigned URLs are valid, at most 168h.")
+var withIndex = Args.Bool("with-index", false,
+	"Download the index files of BAM (.bai), VCF (.tbi) and FASTA (.fai)\n"+
+		"files together with the files.")
+
+// Long names of the short flags
+func init() {
+	helpers.AliasFlag(Args, "outdir", "output-dir")
+	helpers.AliasFlag(Args, "privkey", "private-key")
+}
+
+// maxPresignExpires is the longest validity of a presigned URL allowed by S3
+const maxPresignExpires = 7 * 24 * time.Hour
+
+// downloadTarget is a file to download. The fileName is derived from the url
+// if empty, and the key in the archive and the sha256 checksum are only known
+// for files from a manifest.
+type downloadTarget struct {
+	url      string
+	fileName string
+	key      string
+	sha256   string
+}
+
+// retryDelay is the delay before the first retry of a failed download
+var retryDelay = time.Second
 
 // Gets the file name for a URL, using regex
 func createFilePathFromURL(file string, baseDir string) (fileName string, err error) {
@@ -70,39 +145,504 @@ func createFilePathFromURL(file string, baseDir string) (fileName string, err er
 	return fileName, nil
 }
 
-// Downloads a file from the url to the filePath location
-func downloadFile(url string, filePath string) error {
+// partialSuffix is appended to the name of files while they are downloaded
+const partialSuffix = ".sda-download.partial"
+
+// etagSuffix is appended to the name of a partial file to get the file where
+// the ETag of the file that is downloaded is kept
+const etagSuffix = ".etag"
+
+// Downloads a file from the url to the filePath location. The data is first
+// written to a partial file, which is renamed to filePath once the download
+// is complete. If a partial file from an earlier download exists, only the
+// remaining data is requested, unless -no-resume is given. The ETag of the
+// file is saved next to the partial file, so that the download is only
+// resumed if the remote file has not changed. The progress of the download is
+// shown in a bar added to `p`, unless it is nil.
+func downloadFile(url string, filePath string, p *mpb.Progress) error {
+	partialPath := filePath + partialSuffix
+
+	var offset int64
+	var etag string
+	if *noResume {
+		if err := removePartial(partialPath); err != nil {
+			return err
+		}
+	} else if fileInfo, err := os.Stat(partialPath); err == nil {
+		offset = fileInfo.Size()
+		etag = readETag(partialPath)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to download file, reason: %w", err)
+	}
+	// The partial file can only be continued if it is known to be a part of
+	// the same file, otherwise the whole file is downloaded again
+	if offset > 0 && etag != "" {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", etag)
+	}
 
 	// Get the file from the provided url
-	resp, err := http.Get(url)
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("failed to download file, reason: %v", err)
+		return fmt.Errorf("failed to download file, reason: %w", err)
 	}
 	defer resp.Body.Close()
 
-	// Check reponse status and report S3 error response
-	if resp.StatusCode >= 400 {
-		errorDetails, err := helpers.ParseS3ErrorResponse(resp.Body)
-		if err != nil {
-			log.Error(err.Error())
+	// The partial file does not match the remote file, start over
+	if (resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0) ||
+		(resp.StatusCode == http.StatusPartialContent && resp.Header.Get("ETag") != etag) {
+		log.Infof("Partial file %s does not match %s, starting over", partialPath, url)
+		if err := removePartial(partialPath); err != nil {
+			return err
 		}
 
-		return fmt.Errorf("request failed with `%s`, details: %v", resp.Status, errorDetails)
+		return downloadFile(url, filePath, p)
 	}
 
-	// Create the file in the current location
-	out, err := os.Create(filePath)
+	if err := responseError(resp); err != nil {
+		return err
+	}
+
+	// Continue the partial file only if the server sent the requested
+	// range, otherwise the whole file is written from the beginning
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if resp.StatusCode == http.StatusPartialContent {
+		log.Infof("Resuming download of %s from byte %d", filePath, offset)
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	} else {
+		offset = 0
+		if err := writeETag(partialPath, resp.Header.Get("ETag")); err != nil {
+			return err
+		}
+	}
+	out, err := os.OpenFile(filepath.Clean(partialPath), flags, 0600)
 	if err != nil {
 		return err
 	}
-	defer out.Close()
+
+	var dst io.Writer = out
+	var bar *mpb.Bar
+	if p != nil {
+		// The size is unknown if the server does not send a content length
+		total := int64(0)
+		if resp.ContentLength >= 0 {
+			total = offset + resp.ContentLength
+		}
+		file := fmt.Sprintf("File %s:", filepath.Base(filePath))
+		bar = p.AddBar(total,
+			mpb.PrependDecorators(
+				decor.Name(file, decor.WC{W: len(file) + 1, C: decor.DidentRight}),
+				decor.Name("downloading", decor.WCSyncSpaceR),
+				decor.Counters(decor.SizeB1024(0), "% .1f / % .1f"),
+			),
+			mpb.AppendDecorators(
+				decor.OnComplete(decor.Percentage(decor.WC{W: 5}), "done"),
+				decor.OnComplete(decor.EwmaSpeed(decor.SizeB1024(0), "% .1f", 30, decor.WCSyncSpace), ""),
+				decor.OnComplete(decor.EwmaETA(decor.ET_STYLE_GO, 30, decor.WCSyncSpace), ""),
+			),
+		)
+		bar.SetCurrent(offset)
+		dst = &helpers.CustomWriter{W: out, Bar: bar}
+	}
 
 	// Write the body to file
-	_, err = io.Copy(out, resp.Body)
-	defer out.Close()
+	_, err = io.Copy(dst, resp.Body)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		if bar != nil {
+			bar.Abort(false)
+		}
+
+		return err
+	}
+	if bar != nil {
+		// Mark the bar as done, also when the size was unknown
+		bar.SetTotal(-1, true)
+	}
+
+	if *verifyDownload {
+		md5sum, err := fileMD5(partialPath)
+		if err != nil {
+			return err
+		}
+		if err := verifyETag(filePath, md5sum, resp.Header.Get("ETag")); err != nil {
+			// The file is downloaded from the beginning on the next attempt
+			if err := removePartial(partialPath); err != nil {
+				log.Errorf("failed to remove %s, reason: %v", partialPath, err)
+			}
+
+			return err
+		}
+	}
+
+	if err := os.Rename(partialPath, filePath); err != nil {
+		return err
+	}
+	if err := os.Remove(partialPath + etagSuffix); err != nil && !os.IsNotExist(err) {
+		log.Warnf("failed to remove %s, reason: %v", partialPath+etagSuffix, err)
+	}
+
+	return nil
+}
+
+// readETag returns the ETag saved for the partial file at partialPath, or an
+// empty string if there is none.
+func readETag(partialPath string) string {
+	etag, err := os.ReadFile(filepath.Clean(partialPath + etagSuffix))
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(etag))
+}
+
+// writeETag saves the ETag of the file that is downloaded to partialPath. No
+// ETag is saved if the server did not send one, or if it is a weak ETag that
+// can not be used to resume the download.
+func writeETag(partialPath, etag string) error {
+	etagPath := partialPath + etagSuffix
+	if etag == "" || strings.HasPrefix(etag, "W/") {
+		if err := os.Remove(etagPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		return nil
+	}
+
+	return os.WriteFile(etagPath, []byte(etag), 0600)
+}
+
+// removePartial removes the partial file at partialPath and its saved ETag.
+func removePartial(partialPath string) error {
+	for _, name := range []string{partialPath, partialPath + etagSuffix} {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// VerifyDownload checks that the sha256 checksum of the file at path matches
+// expectedSHA256.
+func VerifyDownload(path string, expectedSHA256 string) error {
+	f, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return err
+	}
+
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	if !strings.EqualFold(checksum, expectedSHA256) {
+		return fmt.Errorf("verification of %s failed, expected sha256 %s, got %s", path, expectedSHA256, checksum)
+	}
+	log.Infof("verified download of %s, sha256: %s", path, checksum)
+
+	return nil
+}
+
+// fileMD5 returns the md5 checksum of the file at path
+func fileMD5(path string) (string, error) {
+	f, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := md5.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// verifyETag compares the md5 checksum of a downloaded file with the ETag
+// sent by the archive. The ETag of objects that were uploaded in several
+// parts is not the md5 checksum of the data, so those can not be verified.
+func verifyETag(name, md5sum, etag string) error {
+	etag = strings.Trim(etag, `"`)
+	switch {
+	case etag == "":
+		log.Warningf("no checksum available for %s, skipping verification", name)
+
+		return nil
+	case strings.Contains(etag, "-"):
+		log.Warningf("%s was uploaded in parts, skipping verification", name)
+
+		return nil
+	case !strings.EqualFold(etag, md5sum):
+		return fmt.Errorf("verification of %s failed, checksum does not match the archive", name)
+	}
+	log.Infof("verified download of %s, md5: %s", name, md5sum)
+
+	return nil
+}
+
+// responseError checks the response status and returns the S3 error response
+// for failed requests. Errors that are not worth retrying are wrapped in a
+// helpers.PermanentError.
+func responseError(resp *http.Response) error {
+	if resp.StatusCode < 400 {
+		return nil
+	}
+
+	s3Error, err := helpers.ParseS3ErrorResponse(resp.Body)
+	if err != nil {
+		log.Error(err.Error())
+		err = fmt.Errorf("request failed with `%s`", resp.Status)
+	} else {
+		err = fmt.Errorf("request failed with `%s`, details: %w", resp.Status, s3Error)
+	}
+	// Only server errors, timeouts and throttling are worth retrying
+	if resp.StatusCode < 500 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		return &helpers.PermanentError{Err: err}
+	}
 
 	return err
+}
+
+// streamFile writes the file at url to out, decrypting it with privateKey
+// unless it is nil. Only the request is retried on failure, since data that
+// has been written to out can not be taken back.
+func streamFile(url string, out io.Writer, privateKey *[32]byte) error {
+	var resp *http.Response
+	err := helpers.RetryWithBackoff(*maxRetries+1, retryDelay, func() error {
+		r, err := http.Get(url)
+		if err != nil {
+			return fmt.Errorf("failed to download file, reason: %w", err)
+		}
+		if err := responseError(r); err != nil {
+			r.Body.Close()
+
+			return err
+		}
+		resp = r
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// The checksum of the encrypted data is computed while streaming, so
+	// a failed verification is reported after the data has been written.
+	// Decrypted data is also authenticated by the crypt4gh reader.
+	hash := md5.New()
+	tee := io.TeeReader(resp.Body, hash)
+	body := tee
+	if privateKey != nil {
+		body, err = streaming.NewCrypt4GHReader(body, *privateKey, nil)
+		if err != nil {
+			return fmt.Errorf("could not create crypt4gh reader: %w", err)
+		}
+	}
+
+	if _, err := io.Copy(out, body); err != nil {
+		return fmt.Errorf("failed to download file, reason: %w", err)
+	}
+
+	if *verifyDownload {
+		// Make sure that all encrypted data has been read
+		if _, err := io.Copy(io.Discard, tee); err != nil {
+			return fmt.Errorf("failed to download file, reason: %w", err)
+		}
+
+		return verifyETag(url, hex.EncodeToString(hash.Sum(nil)), resp.Header.Get("ETag"))
+	}
+
+	return nil
+}
 
+// privateKeyPath returns the private key file given with -privkey, or else the
+// private_key in the configuration
+func privateKeyPath() (string, error) {
+	if *privateKeyFile != "" {
+		return *privateKeyFile, nil
+	}
+
+	errNoKey := helpers.WithCategory(helpers.ErrConfig,
+		errors.New("a private key is required to decrypt, give one with -privkey or private_key in the configuration"))
+	configPath, err := helpers.FindConfigFile("", "")
+	if err != nil {
+		return "", errNoKey
+	}
+	config, err := helpers.ReadConfigFile(configPath, "")
+	if err != nil {
+		return "", helpers.WithCategory(helpers.ErrConfig, fmt.Errorf("failed to load config file, reason: %w", err))
+	}
+	if config.PrivateKey == "" {
+		return "", errNoKey
+	}
+
+	return config.PrivateKey, nil
+}
+
+// decryptDownload decrypts a downloaded file next to it, without the .c4gh
+// suffix, and removes the encrypted file with -rm-encrypted. The encrypted
+// file is kept if the decryption fails.
+func decryptDownload(fileName string, privateKey [32]byte, p *mpb.Progress) error {
+	decryptedName := strings.TrimSuffix(fileName, ".c4gh")
+	if decryptedName == fileName {
+		return fmt.Errorf("cannot decrypt %s, it does not have the .c4gh suffix", fileName)
+	}
+
+	if err := decrypt.DecryptFile(fileName, decryptedName, privateKey, p); err != nil {
+		return fmt.Errorf("failed to decrypt %s, the encrypted file is kept, reason: %w", fileName, err)
+	}
+	fmt.Printf("decrypted file %s\n", decryptedName)
+
+	if *rmEncrypted {
+		if err := os.Remove(fileName); err != nil {
+			return fmt.Errorf("failed to remove %s, reason: %w", fileName, err)
+		}
+	}
+
+	return nil
+}
+
+// presignTargets writes a presigned URL for each target to out, one per line.
+// The URLs are signed with the credentials of the configuration, for the
+// objects in the user's bucket for files from a manifest, and otherwise for
+// the bucket and key in the path of the url.
+func presignTargets(targets []downloadTarget, out io.Writer) error {
+	signer, err := newObjectSigner()
+	if err != nil {
+		return err
+	}
+	warnPresign(os.Stderr, signer.config, *presignExpires)
+
+	for _, target := range targets {
+		bucket, key := signer.config.AccessKey, target.key
+		if key == "" {
+			bucket, key, err = objectFromURL(target.url)
+			if err != nil {
+				return err
+			}
+		}
+
+		presignedURL, err := signer.presign(bucket, key, *presignExpires)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, presignedURL)
+	}
+
+	return nil
+}
+
+// objectSigner presigns requests for objects with the credentials of the
+// configuration
+type objectSigner struct {
+	config *helpers.Config
+	svc    *s3.S3
+}
+
+// newObjectSigner returns an objectSigner for the configuration of the
+// previous login, or the one given with the global flags
+func newObjectSigner() (*objectSigner, error) {
+	config, err := helpers.GetAuth("", "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config file, reason: %w", err)
+	}
+	if err := helpers.WarnTokenExpiration(config); err != nil {
+		return nil, err
+	}
+
+	sess, err := helpers.NewS3Session(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &objectSigner{config: config, svc: s3.New(sess)}, nil
+}
+
+// presign returns a presigned URL to get the object, which is valid for the
+// given time
+func (s *objectSigner) presign(bucket, key string, expires time.Duration) (string, error) {
+	req, _ := s.svc.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	presignedURL, err := req.Presign(expires)
+	if err != nil {
+		return "", fmt.Errorf("failed to presign %s, reason: %w", key, err)
+	}
+
+	return presignedURL, nil
+}
+
+// downloadURLExpires is how long the presigned URLs that the files of a
+// manifest are downloaded from are valid. The downloads only need to start
+// within this time.
+const downloadURLExpires = time.Hour
+
+// downloadURL returns the URL to download the target from. Files from a
+// manifest are in the user's bucket, which can only be read with the
+// credentials of the configuration, so they are downloaded from a presigned
+// URL for their key instead of their location.
+func downloadURL(target downloadTarget, signer *objectSigner) (string, error) {
+	if target.key == "" || signer == nil {
+		return target.url, nil
+	}
+
+	return signer.presign(signer.config.AccessKey, target.key, downloadURLExpires)
+}
+
+// warnPresign writes a warning to w that the presigned URLs contain the access
+// token, which is sent as the session token of the S3 credentials, and that
+// the URLs stop working when the token expires if that is before expires, or
+// do not work at all if the token has already expired
+func warnPresign(w io.Writer, config *helpers.Config, expires time.Duration) {
+	if config.AccessToken == "" {
+		return
+	}
+	fmt.Fprintln(w, "WARNING: The presigned URLs contain your access token, which gives access to all of your files. Do not share the URLs with anyone.")
+
+	remaining, err := helpers.TokenTimeRemaining(config.AccessToken)
+	if err != nil {
+		return
+	}
+	switch {
+	case remaining <= 0:
+		fmt.Fprintln(w, "The access token has expired, so the URLs do not work. Log in again to get a new token.")
+	case remaining < expires:
+		fmt.Fprintf(w, "The URLs stop working when the access token expires, in %s, before the %v given with -presign-expires.\n", helpers.FormatTimeRemaining(remaining), expires)
+	}
+}
+
+// objectFromURL returns the bucket and the key of the object at a path-style
+// S3 url
+func objectFromURL(rawURL string) (string, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to parse url %s, reason: %w", rawURL, err)
+	}
+	bucket, key, found := strings.Cut(strings.TrimPrefix(u.Path, "/"), "/")
+	if !found || bucket == "" || key == "" {
+		return "", "", fmt.Errorf("failed to find the bucket and the key of the file in %s", rawURL)
+	}
+
+	return bucket, key, nil
+}
+
+// downloadFileWithRetry downloads a file like downloadFile, retrying failed
+// downloads up to -max-retries times
+func downloadFileWithRetry(url string, filePath string, p *mpb.Progress) error {
+	return helpers.RetryWithBackoff(*maxRetries+1, retryDelay, func() error {
+		return downloadFile(url, filePath, p)
+	})
 }
 
 // GetURLsFile reads the urls_list.txt file and returns the urls of the files in a list
@@ -135,7 +675,7 @@ func GetURLsListFile(currentPath string, fileLocation string) (urlsFilePath stri
 	// e.g. https://some/url/to/folder/
 	case strings.HasSuffix(fileLocation, "/") && regexp.MustCompile(`https?://`).MatchString(fileLocation):
 		urlsFilePath = currentPath + "/urls_list.txt"
-		err = downloadFile(fileLocation+"urls_list.txt", urlsFilePath)
+		err = downloadFileWithRetry(fileLocation+"urls_list.txt", urlsFilePath, nil)
 		if err != nil {
 			return "", err
 		}
@@ -143,7 +683,7 @@ func GetURLsListFile(currentPath string, fileLocation string) (urlsFilePath stri
 	// e.g. https://some/url/to/urls_list.txt
 	case regexp.MustCompile(`https?://`).MatchString(fileLocation):
 		urlsFilePath = currentPath + "/urls_list.txt"
-		err = downloadFile(fileLocation, urlsFilePath)
+		err = downloadFileWithRetry(fileLocation, urlsFilePath, nil)
 		if err != nil {
 			return "", err
 		}
@@ -163,48 +703,248 @@ func Download(args []string) error {
 	// Call ParseArgs to take care of all the flag parsing
 	err := helpers.ParseArgs(args, Args)
 	if err != nil {
-		return fmt.Errorf("failed parsing arguments, reason: %v", err)
+		return fmt.Errorf("failed parsing arguments, reason: %w", err)
 	}
 
 	// Args() returns the non-flag arguments, which we assume are filenames.
 	urls := Args.Args()
-	if len(urls) == 0 {
+	if len(urls) == 0 && *manifestFile == "" {
 		return fmt.Errorf("failed to find location of files, no argument passed")
 	}
 
-	var currentPath, urlsFilePath string
-	currentPath, err = os.Getwd()
-	if err != nil {
-		return fmt.Errorf("failed to get current path, reason: %v", err)
+	// A '-' after the location of the files selects stdout as target
+	stdoutMode := *toStdout || (len(urls) > 0 && urls[len(urls)-1] == "-")
+	if *privateKeyFile != "" && !stdoutMode && !*decryptFiles {
+		return errors.New("-privkey can only be used when downloading to stdout or with -decrypt")
+	}
+	if *rmEncrypted && !*decryptFiles {
+		return errors.New("-rm-encrypted can only be used with -decrypt")
+	}
+	if *presign && (stdoutMode || *decryptFiles) {
+		return errors.New("-presign can not be used when downloading to stdout or with -decrypt")
+	}
+	if *presignExpires <= 0 || *presignExpires > maxPresignExpires {
+		return fmt.Errorf("-presign-expires must be between 0 and %v", maxPresignExpires)
 	}
 
-	urlsFilePath, err = GetURLsListFile(currentPath, urls[0])
-	if err != nil {
-		return fmt.Errorf("failed to urls list file, reason: %v", err)
+	var targets []downloadTarget
+	if *manifestFile != "" {
+		manifest, err := helpers.ReadManifest(*manifestFile)
+		if err != nil {
+			return err
+		}
+		for _, entry := range manifest.Files {
+			targets = append(targets, downloadTarget{
+				url:      entry.Location,
+				fileName: filepath.Join(*outDir, filepath.FromSlash(entry.Key)),
+				key:      entry.Key,
+				sha256:   entry.SHA256,
+			})
+		}
+	} else {
+		var currentPath, urlsFilePath string
+		currentPath, err = os.Getwd()
+		if err != nil {
+			return fmt.Errorf("failed to get current path, reason: %w", err)
+		}
+
+		urlsFilePath, err = GetURLsListFile(currentPath, urls[0])
+		if err != nil {
+			return fmt.Errorf("failed to urls list file, reason: %w", err)
+		}
+
+		// Open urls_list.txt file and loop through file urls
+		urlsList, err := GetURLsFile(urlsFilePath)
+		if err != nil {
+			return err
+		}
+		for _, url := range urlsList {
+			targets = append(targets, downloadTarget{url: url})
+		}
 	}
 
-	// Open urls_list.txt file and loop through file urls
-	urlsList, err := GetURLsFile(urlsFilePath)
-	if err != nil {
-		return err
+	if *withIndex {
+		targets = withIndexFiles(targets)
+	}
+
+	if *presign {
+		return presignTargets(targets, os.Stdout)
 	}
 
-	// Download the files and create the folder structure
-	for _, file := range urlsList {
+	// The files of a manifest are downloaded with the credentials of the
+	// configuration
+	var signer *objectSigner
+	if *manifestFile != "" {
+		signer, err = newObjectSigner()
+		if err != nil {
+			return err
+		}
+	}
+
+	if stdoutMode {
+		if len(targets) != 1 {
+			return fmt.Errorf("only a single file can be downloaded to stdout, found %d files", len(targets))
+		}
+
+		var privateKey *[32]byte
+		if *privateKeyFile != "" {
+			privateKey, err = decrypt.ReadPrivateKeyFile(*privateKeyFile)
+			if err != nil {
+				return err
+			}
+		}
 
-		fileName, err := createFilePathFromURL(file, *outDir)
+		location, err := downloadURL(targets[0], signer)
 		if err != nil {
 			return err
 		}
 
-		err = downloadFile(file, fileName)
+		return streamFile(location, os.Stdout, privateKey)
+	}
+
+	if *concurrency < 1 {
+		return errors.New("concurrency must be at least 1")
+	}
+
+	// The key is read before the downloads start, since reading it may
+	// prompt for its password
+	var privateKey *[32]byte
+	if *decryptFiles {
+		keyFile, err := privateKeyPath()
 		if err != nil {
 			return err
 		}
-		fmt.Printf("downloaded file from url %s\n", fileName)
+		privateKey, err = decrypt.ReadPrivateKeyFile(keyFile)
+		if err != nil {
+			return helpers.WithCategory(helpers.ErrCrypto, err)
+		}
+	}
+
+	// create progress bar instance, shared by all downloads
+	p := helpers.NewProgress()
+	defer p.Shutdown()
+
+	// Download the files using a pool of at most `concurrency` workers and
+	// create the folder structure. No new downloads are started after a
+	// download has failed.
+	var g helpers.ErrGroup
+	g.SetLimit(*concurrency)
+	var failed atomic.Bool
+	for _, target := range targets {
+		if failed.Load() {
+			break
+		}
+
+		target := target
+		g.Go(func() error {
+			// A download may have failed while waiting for a worker
+			if failed.Load() {
+				return nil
+			}
+			err := fetchTarget(target, signer, privateKey, p)
+			if err != nil {
+				failed.Store(true)
+			}
+
+			return err
+		})
+	}
+	if errs := g.Wait(); len(errs) > 0 {
+		return errs[0]
 	}
 
 	fmt.Println("finished downloading files from url")
 
 	return nil
 }
+
+// withIndexFiles returns the targets with the index file of each target, see
+// helpers.IndexFile, added after it, unless the index file is already a
+// target
+func withIndexFiles(targets []downloadTarget) []downloadTarget {
+	included := map[string]bool{}
+	for _, target := range targets {
+		included[target.url] = true
+	}
+
+	var allTargets []downloadTarget
+	for _, target := range targets {
+		allTargets = append(allTargets, target)
+
+		index, found := indexTarget(target)
+		if !found || included[index.url] {
+			continue
+		}
+		included[index.url] = true
+		allTargets = append(allTargets, index)
+	}
+
+	return allTargets
+}
+
+// indexTarget returns the target of the index file of the target, which has
+// the URL, file name and key of the target with the extension of the index.
+// The checksum of the index file is not known.
+func indexTarget(target downloadTarget) (downloadTarget, bool) {
+	u, err := url.Parse(target.url)
+	if err != nil {
+		return downloadTarget{}, false
+	}
+	indexPath, found := helpers.IndexFile(u.Path)
+	if !found {
+		return downloadTarget{}, false
+	}
+	u.Path = indexPath
+	u.RawPath = ""
+
+	index := downloadTarget{url: u.String()}
+	if target.fileName != "" {
+		index.fileName, _ = helpers.IndexFile(target.fileName)
+	}
+	if target.key != "" {
+		index.key, _ = helpers.IndexFile(target.key)
+	}
+
+	return index, true
+}
+
+// fetchTarget downloads the target, see downloadURL, in the folder structure
+// of its URL unless it has a file name, verifies it if it has a checksum, and
+// decrypts it if a private key is given. The progress is shown in bars added
+// to `p`.
+func fetchTarget(target downloadTarget, signer *objectSigner, privateKey *[32]byte, p *mpb.Progress) error {
+	var err error
+	fileName := target.fileName
+	if fileName == "" {
+		fileName, err = createFilePathFromURL(target.url, *outDir)
+	} else {
+		err = os.MkdirAll(filepath.Dir(fileName), os.ModePerm)
+	}
+	if err != nil {
+		return err
+	}
+
+	location, err := downloadURL(target, signer)
+	if err != nil {
+		return err
+	}
+	if err := downloadFileWithRetry(location, fileName, p); err != nil {
+		return err
+	}
+	if *verifyDownload && target.sha256 != "" {
+		if err := VerifyDownload(fileName, target.sha256); err != nil {
+			if err := os.Remove(fileName); err != nil {
+				log.Errorf("failed to remove %s, reason: %v", fileName, err)
+			}
+
+			return err
+		}
+	}
+	fmt.Printf("downloaded file from url %s\n", fileName)
+
+	if privateKey != nil {
+		return decryptDownload(fileName, *privateKey, p)
+	}
+
+	return nil
+}
@@ -1,6 +1,8 @@
 package download
 
 import (
+	"bytes"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
@@ -10,7 +12,14 @@ import (
 	"runtime"
 	"strings"
 	"testing"
-
+	"time"
+
+	"github.com/NBISweden/sda-cli/helpers"
+	"github.com/golang-jwt/jwt"
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+	"github.com/neicnordic/crypt4gh/keys"
+	"github.com/neicnordic/crypt4gh/streaming"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 )
@@ -24,7 +33,8 @@ func TestConfigTestSuite(t *testing.T) {
 }
 
 func (suite *TestSuite) SetupTest() {
-
+	// Keep retries of failing requests short
+	retryDelay = time.Millisecond
 }
 
 func (suite *TestSuite) TestNoArgument() {
@@ -39,7 +49,7 @@ func (suite *TestSuite) TestdownloadFileWrongUrl() {
 
 	url := "someUrl"
 	filePath := "."
-	err := downloadFile(url, filePath)
+	err := downloadFile(url, filePath, nil)
 
 	assert.EqualError(suite.T(), err, "failed to download file, reason: Get \"someUrl\": unsupported protocol scheme \"\"")
 }
@@ -107,7 +117,7 @@ func (suite *TestSuite) TestDownloadFile() {
 	defer ts.Close()
 
 	file := "somefile.c4gh"
-	err := downloadFile(ts.URL, file)
+	err := downloadFile(ts.URL, file, nil)
 	assert.NoError(suite.T(), err)
 
 	// Remove the file created from the downloadFile function
@@ -127,7 +137,7 @@ func (suite *TestSuite) TestdownloadFileErrorStatusCode() {
 	}))
 	defer ts.Close()
 
-	err := downloadFile(ts.URL, file)
+	err := downloadFile(ts.URL, file, nil)
 	assert.EqualError(suite.T(), err, "request failed with `404 Not Found`, details: {Code:NoSuchKey Message:The specified key does not exist. Resource:/download/A352764B-2KB4-4738-B6B5-BA55D25FB469}")
 
 	// Case when the user tried to download from a private bucket
@@ -137,9 +147,15 @@ func (suite *TestSuite) TestdownloadFileErrorStatusCode() {
 	}))
 	defer ts.Close()
 
-	err = downloadFile(ts.URL, file)
+	err = downloadFile(ts.URL, file, nil)
 	assert.EqualError(suite.T(), err, "request failed with `403 Forbidden`, details: {Code:AllAccessDisabled Message:All access to this bucket has been disabled. Resource:/minio/test/dummy/data_file1.c4gh}")
 
+	// The S3 error can be inspected by its code
+	var s3Error *helpers.S3Error
+	if assert.ErrorAs(suite.T(), err, &s3Error) {
+		assert.Equal(suite.T(), "AllAccessDisabled", s3Error.Code)
+	}
+
 	// Check that the downloadFile function did not create any file in case of error
 	msg := "stat somefile.c4gh: no such file or directory"
 	if runtime.GOOS == "windows" {
@@ -149,6 +165,366 @@ func (suite *TestSuite) TestdownloadFileErrorStatusCode() {
 	assert.EqualError(suite.T(), err, msg)
 }
 
+// Test that failed downloads are retried on server errors, but not on
+// client errors
+func (suite *TestSuite) TestDownloadFileWithRetry() {
+	file := "somefile.c4gh"
+	defer os.Remove(file)
+
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+
+			return
+		}
+		_, _ = io.WriteString(w, "content")
+	}))
+	defer ts.Close()
+
+	err := downloadFileWithRetry(ts.URL, file, nil)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 3, requests)
+	content, err := os.ReadFile(file)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "content", string(content))
+
+	// Give up after -max-retries retries
+	*maxRetries = 1
+	defer func() { *maxRetries = 3 }()
+	requests = 0
+	err = downloadFileWithRetry(ts.URL, file, nil)
+	assert.ErrorContains(suite.T(), err, "request failed with `503 Service Unavailable`")
+	assert.Equal(suite.T(), 2, requests)
+
+	// Client errors are not retried
+	requests = 0
+	ts404 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts404.Close()
+
+	err = downloadFileWithRetry(ts404.URL, file, nil)
+	assert.ErrorContains(suite.T(), err, "request failed with `404 Not Found`")
+	assert.Equal(suite.T(), 1, requests)
+}
+
+// Test that partially downloaded files are continued with a range request
+func (suite *TestSuite) TestDownloadFileResume() {
+	file := "somefile.c4gh"
+	defer os.Remove(file)
+	content := "some content to download"
+
+	etag := `"c0ffee"`
+	var rangeHeader, ifRangeHeader string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rangeHeader = r.Header.Get("Range")
+		ifRangeHeader = r.Header.Get("If-Range")
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, file, time.Time{}, strings.NewReader(content))
+	}))
+	defer ts.Close()
+
+	err := os.WriteFile(file+partialSuffix, []byte(content[:5]), 0600)
+	assert.NoError(suite.T(), err)
+	err = os.WriteFile(file+partialSuffix+etagSuffix, []byte(etag), 0600)
+	assert.NoError(suite.T(), err)
+
+	err = downloadFile(ts.URL, file, nil)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "bytes=5-", rangeHeader)
+	assert.Equal(suite.T(), etag, ifRangeHeader)
+	data, err := os.ReadFile(file)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), content, string(data))
+
+	// The partial file is renamed and the ETag is removed once the download
+	// is complete
+	_, err = os.Stat(file + partialSuffix)
+	assert.True(suite.T(), os.IsNotExist(err))
+	_, err = os.Stat(file + partialSuffix + etagSuffix)
+	assert.True(suite.T(), os.IsNotExist(err))
+
+	// A partial file of a file that has changed is downloaded again
+	err = os.WriteFile(file+partialSuffix, []byte("xxxxx"), 0600)
+	assert.NoError(suite.T(), err)
+	err = os.WriteFile(file+partialSuffix+etagSuffix, []byte(`"old"`), 0600)
+	assert.NoError(suite.T(), err)
+	err = downloadFile(ts.URL, file, nil)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), `"old"`, ifRangeHeader)
+	data, err = os.ReadFile(file)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), content, string(data))
+
+	// A partial file without an ETag is not continued
+	err = os.WriteFile(file+partialSuffix, []byte("xxxxx"), 0600)
+	assert.NoError(suite.T(), err)
+	err = downloadFile(ts.URL, file, nil)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "", rangeHeader)
+	data, err = os.ReadFile(file)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), content, string(data))
+
+	// A partial file that is larger than the remote file is discarded
+	err = os.WriteFile(file+partialSuffix, []byte(content+content), 0600)
+	assert.NoError(suite.T(), err)
+	err = os.WriteFile(file+partialSuffix+etagSuffix, []byte(etag), 0600)
+	assert.NoError(suite.T(), err)
+	err = downloadFile(ts.URL, file, nil)
+	assert.NoError(suite.T(), err)
+	data, err = os.ReadFile(file)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), content, string(data))
+
+	// With -no-resume the whole file is downloaded again
+	*noResume = true
+	defer func() { *noResume = false }()
+	err = os.WriteFile(file+partialSuffix, []byte("xxxxx"), 0600)
+	assert.NoError(suite.T(), err)
+	err = downloadFile(ts.URL, file, nil)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "", rangeHeader)
+	data, err = os.ReadFile(file)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), content, string(data))
+}
+
+func (suite *TestSuite) TestConcurrentDownload() {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "content of "+filepath.Base(r.URL.Path))
+	}))
+	defer ts.Close()
+
+	dir, err := os.MkdirTemp(os.TempDir(), "download-")
+	assert.NoError(suite.T(), err)
+	defer os.RemoveAll(dir)
+
+	var urls string
+	for i := 0; i < 5; i++ {
+		urls += fmt.Sprintf("%s/A352744B-2CB4-4738-B6B5-BA55D25FB469/dir/file%d.c4gh\n", ts.URL, i)
+	}
+	urlsFile := filepath.Join(dir, "urls_list.txt")
+	err = os.WriteFile(urlsFile, []byte(urls), 0600)
+	assert.NoError(suite.T(), err)
+
+	defer func() { *concurrency = 1; *outDir = "" }()
+	os.Args = []string{"download", "-concurrency", "3", "-outdir", dir, urlsFile}
+	assert.NoError(suite.T(), Download(os.Args))
+
+	for i := 0; i < 5; i++ {
+		data, err := os.ReadFile(filepath.Join(dir, "dir", fmt.Sprintf("file%d.c4gh", i)))
+		assert.NoError(suite.T(), err)
+		assert.Equal(suite.T(), fmt.Sprintf("content of file%d.c4gh", i), string(data))
+	}
+
+	os.Args = []string{"download", "-concurrency", "0", urlsFile}
+	assert.EqualError(suite.T(), Download(os.Args), "concurrency must be at least 1")
+}
+
+func (suite *TestSuite) TestDownloadWithIndex() {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "content of "+filepath.Base(r.URL.Path))
+	}))
+	defer ts.Close()
+
+	dir, err := os.MkdirTemp(os.TempDir(), "download-")
+	assert.NoError(suite.T(), err)
+	defer os.RemoveAll(dir)
+
+	urls := ts.URL + "/A352744B-2CB4-4738-B6B5-BA55D25FB469/dir/reads.bam.c4gh\n" + ts.URL + "/A352744B-2CB4-4738-B6B5-BA55D25FB469/dir/notes.txt.c4gh\n"
+	urlsFile := filepath.Join(dir, "urls_list.txt")
+	err = os.WriteFile(urlsFile, []byte(urls), 0600)
+	assert.NoError(suite.T(), err)
+
+	defer func() { *withIndex = false; *outDir = "" }()
+	os.Args = []string{"download", "-with-index", "-outdir", dir, urlsFile}
+	assert.NoError(suite.T(), Download(os.Args))
+
+	for _, name := range []string{"reads.bam.c4gh", "reads.bam.bai.c4gh", "notes.txt.c4gh"} {
+		data, err := os.ReadFile(filepath.Join(dir, "dir", name))
+		assert.NoError(suite.T(), err)
+		assert.Equal(suite.T(), "content of "+name, string(data))
+	}
+	assert.NoFileExists(suite.T(), filepath.Join(dir, "dir", "notes.txt.bai.c4gh"))
+}
+
+func (suite *TestSuite) TestWithIndexFiles() {
+	targets := withIndexFiles([]downloadTarget{
+		{url: "https://example.org/dummy/calls.vcf.gz.c4gh?token=1", fileName: "out/calls.vcf.gz.c4gh", key: "calls.vcf.gz.c4gh", sha256: "abc"},
+		{url: "https://example.org/dummy/ref.fa"},
+		{url: "https://example.org/dummy/ref.fa.fai"},
+	})
+	assert.Equal(suite.T(), []downloadTarget{
+		{url: "https://example.org/dummy/calls.vcf.gz.c4gh?token=1", fileName: "out/calls.vcf.gz.c4gh", key: "calls.vcf.gz.c4gh", sha256: "abc"},
+		{url: "https://example.org/dummy/calls.vcf.gz.tbi.c4gh?token=1", fileName: "out/calls.vcf.gz.tbi.c4gh", key: "calls.vcf.gz.tbi.c4gh"},
+		{url: "https://example.org/dummy/ref.fa"},
+		{url: "https://example.org/dummy/ref.fa.fai"},
+	}, targets)
+}
+
+func (suite *TestSuite) TestStreamFile() {
+	publicKey, privateKey, err := keys.GenerateKeyPair()
+	assert.NoError(suite.T(), err)
+
+	// Encrypt some content to serve
+	var encrypted bytes.Buffer
+	c4ghWriter, err := streaming.NewCrypt4GHWriter(&encrypted, privateKey, [][32]byte{publicKey}, nil)
+	assert.NoError(suite.T(), err)
+	_, err = c4ghWriter.Write([]byte("some secret content"))
+	assert.NoError(suite.T(), err)
+	assert.NoError(suite.T(), c4ghWriter.Close())
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(encrypted.Bytes())
+	}))
+	defer ts.Close()
+
+	// Without a key, the encrypted data is written as it is
+	var out bytes.Buffer
+	err = streamFile(ts.URL, &out, nil)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), encrypted.Bytes(), out.Bytes())
+
+	// With a key, the data is decrypted
+	out.Reset()
+	err = streamFile(ts.URL, &out, &privateKey)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "some secret content", out.String())
+}
+
+func (suite *TestSuite) TestDownloadStdoutSingleFile() {
+	urlsFile, err := os.CreateTemp(os.TempDir(), "urls_list-")
+	assert.NoError(suite.T(), err)
+	defer os.Remove(urlsFile.Name())
+
+	err = os.WriteFile(urlsFile.Name(), []byte("http://url/to/file1.c4gh\nhttp://url/to/file2.c4gh\n"), 0600)
+	assert.NoError(suite.T(), err)
+
+	os.Args = []string{"download", urlsFile.Name(), "-"}
+	assert.EqualError(suite.T(), Download(os.Args), "only a single file can be downloaded to stdout, found 2 files")
+
+	os.Args = []string{"download", "-privkey", "some.sec.pem", urlsFile.Name()}
+	assert.EqualError(suite.T(), Download(os.Args), "-privkey can only be used when downloading to stdout or with -decrypt")
+	*privateKeyFile = ""
+}
+
+func (suite *TestSuite) TestVerifyDownload() {
+	file, err := os.CreateTemp(os.TempDir(), "download-")
+	assert.NoError(suite.T(), err)
+	defer os.Remove(file.Name())
+	_, err = file.WriteString("content")
+	assert.NoError(suite.T(), err)
+	file.Close()
+
+	sha256sum := "ed7002b439e9ac845f22357d822bac1444730fbdb6016d3ec9432297b9ec9f73"
+	assert.NoError(suite.T(), VerifyDownload(file.Name(), sha256sum))
+	assert.NoError(suite.T(), VerifyDownload(file.Name(), strings.ToUpper(sha256sum)))
+	assert.EqualError(suite.T(), VerifyDownload(file.Name(), "abc"), fmt.Sprintf("verification of %s failed, expected sha256 abc, got %s", file.Name(), sha256sum))
+
+	md5sum, err := fileMD5(file.Name())
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "9a0364b9e99bb480dd25e1f0284c8555", md5sum)
+
+	assert.NoError(suite.T(), verifyETag("file", md5sum, `"9a0364b9e99bb480dd25e1f0284c8555"`))
+	assert.NoError(suite.T(), verifyETag("file", md5sum, ""))
+	assert.NoError(suite.T(), verifyETag("file", md5sum, `"0123456789abcdef0123456789abcdef-2"`))
+	assert.EqualError(suite.T(), verifyETag("file", md5sum, `"0123456789abcdef0123456789abcdef"`), "verification of file failed, checksum does not match the archive")
+}
+
+// Test that downloads with a wrong checksum are not kept with -verify
+func (suite *TestSuite) TestDownloadFileVerify() {
+	file := "somefile.c4gh"
+	defer os.Remove(file)
+
+	etag := `"9a0364b9e99bb480dd25e1f0284c8555"`
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag)
+		_, _ = io.WriteString(w, "content")
+	}))
+	defer ts.Close()
+
+	*verifyDownload = true
+	defer func() { *verifyDownload = false }()
+
+	assert.NoError(suite.T(), downloadFile(ts.URL, file, nil))
+	_, err := os.Stat(file)
+	assert.NoError(suite.T(), err)
+	assert.NoError(suite.T(), os.Remove(file))
+
+	etag = `"0123456789abcdef0123456789abcdef"`
+	assert.EqualError(suite.T(), downloadFile(ts.URL, file, nil), "verification of somefile.c4gh failed, checksum does not match the archive")
+	_, err = os.Stat(file)
+	assert.True(suite.T(), os.IsNotExist(err))
+	_, err = os.Stat(file + partialSuffix)
+	assert.True(suite.T(), os.IsNotExist(err))
+
+	var out bytes.Buffer
+	assert.EqualError(suite.T(), streamFile(ts.URL, &out, nil), fmt.Sprintf("verification of %s failed, checksum does not match the archive", ts.URL))
+}
+
+func (suite *TestSuite) TestDownloadManifest() {
+	backend := s3mem.New()
+	faker := gofakes3.New(backend).Server()
+	// As the inbox, only signed requests are allowed
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("X-Amz-Signature") == "" {
+			w.WriteHeader(http.StatusForbidden)
+
+			return
+		}
+		faker.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	assert.NoError(suite.T(), backend.CreateBucket("dummy"))
+	for _, key := range []string{"dir/file1.c4gh", "file2.c4gh"} {
+		_, err := backend.PutObject("dummy", key, map[string]string{}, strings.NewReader("content"), 7)
+		assert.NoError(suite.T(), err)
+	}
+
+	accessToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"exp": time.Now().Add(72 * time.Hour).Unix()}).SignedString([]byte("secret"))
+	assert.NoError(suite.T(), err)
+	dir := suite.T().TempDir()
+	configFile := filepath.Join(dir, "s3cmd.conf")
+	assert.NoError(suite.T(), os.WriteFile(configFile, []byte("access_key = dummy\naccess_token = "+accessToken+"\nhost_base = "+ts.URL+"\nuse_https = False\n"), 0600))
+	suite.T().Setenv("SDA_CLI_CONFIG", configFile)
+
+	manifest := &helpers.Manifest{Files: []helpers.ManifestEntry{
+		{Key: "dir/file1.c4gh", Location: ts.URL + "/dummy/dir/file1.c4gh", SHA256: "ed7002b439e9ac845f22357d822bac1444730fbdb6016d3ec9432297b9ec9f73"},
+		{Key: "file2.c4gh", Location: ts.URL + "/dummy/file2.c4gh", SHA256: "ed7002b439e9ac845f22357d822bac1444730fbdb6016d3ec9432297b9ec9f73"},
+	}}
+	manifestPath := filepath.Join(dir, "manifest.json")
+	assert.NoError(suite.T(), manifest.Write(manifestPath))
+
+	// The location can not be read without the credentials
+	resp, err := http.Get(manifest.Files[0].Location)
+	assert.NoError(suite.T(), err)
+	resp.Body.Close()
+	assert.Equal(suite.T(), http.StatusForbidden, resp.StatusCode)
+
+	defer func() { *manifestFile = ""; *outDir = ""; *verifyDownload = false }()
+	os.Args = []string{"download", "-manifest", manifestPath, "-outdir", filepath.Join(dir, "out"), "-verify"}
+	assert.NoError(suite.T(), Download(os.Args))
+
+	for _, name := range []string{"dir/file1.c4gh", "file2.c4gh"} {
+		data, err := os.ReadFile(filepath.Join(dir, "out", filepath.FromSlash(name)))
+		assert.NoError(suite.T(), err)
+		assert.Equal(suite.T(), "content", string(data))
+	}
+
+	// Files that do not match the checksum in the manifest are removed
+	manifest.Files = manifest.Files[1:]
+	manifest.Files[0].SHA256 = "abc"
+	assert.NoError(suite.T(), manifest.Write(manifestPath))
+	os.Args = []string{"download", "-manifest", manifestPath, "-outdir", filepath.Join(dir, "new"), "-verify"}
+	assert.ErrorContains(suite.T(), Download(os.Args), "expected sha256 abc")
+	_, err = os.Stat(filepath.Join(dir, "new", "file2.c4gh"))
+	assert.True(suite.T(), os.IsNotExist(err))
+}
+
 func (suite *TestSuite) TestCreateFilePath() {
 
 	fileName := "https://some/base/A352744B-2CB4-4738-B6B5-BA55D25FB469/some/file.txt"
@@ -247,3 +623,136 @@ http://url/to/file3.c4gh
 	_ = os.Remove(urlsFilePath)
 
 }
+
+func (suite *TestSuite) TestDownloadDecrypt() {
+	publicKey, privateKey, err := keys.GenerateKeyPair()
+	assert.NoError(suite.T(), err)
+	var encrypted bytes.Buffer
+	c4ghWriter, err := streaming.NewCrypt4GHWriter(&encrypted, privateKey, [][32]byte{publicKey}, nil)
+	assert.NoError(suite.T(), err)
+	_, err = c4ghWriter.Write([]byte("some secret content"))
+	assert.NoError(suite.T(), err)
+	assert.NoError(suite.T(), c4ghWriter.Close())
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(filepath.Base(r.URL.Path), "broken") {
+			_, _ = io.WriteString(w, "not encrypted")
+
+			return
+		}
+		_, _ = w.Write(encrypted.Bytes())
+	}))
+	defer ts.Close()
+
+	dir := suite.T().TempDir()
+	keyFile := filepath.Join(dir, "key.sec.pem")
+	f, err := os.Create(keyFile)
+	assert.NoError(suite.T(), err)
+	assert.NoError(suite.T(), keys.WriteCrypt4GHX25519PrivateKey(f, privateKey, []byte("")))
+	f.Close()
+
+	urlsFile := filepath.Join(dir, "urls_list.txt")
+	assert.NoError(suite.T(), os.WriteFile(urlsFile, []byte(ts.URL+"/A352744B-2CB4-4738-B6B5-BA55D25FB469/dir/file.c4gh\n"), 0600))
+	defer func() { *decryptFiles = false; *rmEncrypted = false; *privateKeyFile = ""; *outDir = "" }()
+
+	os.Args = []string{"download", "-rm-encrypted", urlsFile}
+	assert.EqualError(suite.T(), Download(os.Args), "-rm-encrypted can only be used with -decrypt")
+	*rmEncrypted = false
+
+	// Without -rm-encrypted, the encrypted file is kept
+	os.Args = []string{"download", "-decrypt", "-privkey", keyFile, "-outdir", filepath.Join(dir, "kept"), urlsFile}
+	assert.NoError(suite.T(), Download(os.Args))
+	data, err := os.ReadFile(filepath.Join(dir, "kept", "dir", "file"))
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "some secret content", string(data))
+	assert.FileExists(suite.T(), filepath.Join(dir, "kept", "dir", "file.c4gh"))
+
+	// The private key can be given in the configuration
+	configFile := filepath.Join(dir, "s3cmd.conf")
+	assert.NoError(suite.T(), os.WriteFile(configFile, []byte("private_key = "+keyFile+"\n"), 0600))
+	suite.T().Setenv("SDA_CLI_CONFIG", configFile)
+	*privateKeyFile = ""
+	os.Args = []string{"download", "-decrypt", "-rm-encrypted", "-outdir", filepath.Join(dir, "removed"), urlsFile}
+	assert.NoError(suite.T(), Download(os.Args))
+	assert.FileExists(suite.T(), filepath.Join(dir, "removed", "dir", "file"))
+	assert.NoFileExists(suite.T(), filepath.Join(dir, "removed", "dir", "file.c4gh"))
+
+	// The encrypted file is kept if the decryption fails
+	assert.NoError(suite.T(), os.WriteFile(urlsFile, []byte(ts.URL+"/A352744B-2CB4-4738-B6B5-BA55D25FB469/dir/broken.c4gh\n"), 0600))
+	os.Args = []string{"download", "-decrypt", "-rm-encrypted", "-outdir", filepath.Join(dir, "broken"), urlsFile}
+	err = Download(os.Args)
+	assert.ErrorContains(suite.T(), err, "the encrypted file is kept")
+	assert.Equal(suite.T(), helpers.ExitCryptoError, helpers.ExitCode(err))
+	assert.FileExists(suite.T(), filepath.Join(dir, "broken", "dir", "broken.c4gh"))
+	assert.NoFileExists(suite.T(), filepath.Join(dir, "broken", "dir", "broken"))
+}
+
+func (suite *TestSuite) TestDownloadPresign() {
+	backend := s3mem.New()
+	ts := httptest.NewServer(gofakes3.New(backend).Server())
+	defer ts.Close()
+	assert.NoError(suite.T(), backend.CreateBucket("dummy"))
+	_, err := backend.PutObject("dummy", "dir/file.c4gh", map[string]string{}, strings.NewReader("content"), 7)
+	assert.NoError(suite.T(), err)
+
+	accessToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"exp": time.Now().Add(72 * time.Hour).Unix()}).SignedString([]byte("secret"))
+	assert.NoError(suite.T(), err)
+	dir := suite.T().TempDir()
+	configFile := filepath.Join(dir, "s3cmd.conf")
+	assert.NoError(suite.T(), os.WriteFile(configFile, []byte("access_key = dummy\naccess_token = "+accessToken+"\nhost_base = "+ts.URL+"\nuse_https = False\n"), 0600))
+	suite.T().Setenv("SDA_CLI_CONFIG", configFile)
+
+	manifest := &helpers.Manifest{Files: []helpers.ManifestEntry{{Key: "dir/file.c4gh"}}}
+	manifestPath := filepath.Join(dir, "manifest.json")
+	assert.NoError(suite.T(), manifest.Write(manifestPath))
+	defer func() { *presign = false; *presignExpires = 24 * time.Hour; *manifestFile = "" }()
+
+	os.Args = []string{"download", "-presign", "-presign-expires", "200h", "-manifest", manifestPath}
+	assert.EqualError(suite.T(), Download(os.Args), "-presign-expires must be between 0 and 168h0m0s")
+
+	// The presigned URLs are written instead of the files
+	var out bytes.Buffer
+	*presignExpires = time.Hour
+	targets := []downloadTarget{{key: "dir/file.c4gh"}, {url: ts.URL + "/dummy/dir/file.c4gh"}}
+	assert.NoError(suite.T(), presignTargets(targets, &out))
+	presignedURLs := strings.Fields(out.String())
+	assert.Len(suite.T(), presignedURLs, 2)
+	for _, presignedURL := range presignedURLs {
+		assert.True(suite.T(), strings.HasPrefix(presignedURL, ts.URL+"/dummy/dir/file.c4gh?"), presignedURL)
+		assert.Contains(suite.T(), presignedURL, "X-Amz-Expires=3600")
+
+		resp, err := http.Get(presignedURL)
+		assert.NoError(suite.T(), err)
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.NoError(suite.T(), err)
+		assert.Equal(suite.T(), "content", string(data))
+	}
+
+	err = presignTargets([]downloadTarget{{url: ts.URL + "/dummy"}}, &out)
+	assert.EqualError(suite.T(), err, "failed to find the bucket and the key of the file in "+ts.URL+"/dummy")
+}
+
+func (suite *TestSuite) TestWarnPresign() {
+	accessToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"exp": time.Now().Add(2*time.Hour + 30*time.Second).Unix()}).SignedString([]byte("secret"))
+	assert.NoError(suite.T(), err)
+
+	var out bytes.Buffer
+	warnPresign(&out, &helpers.Config{AccessToken: accessToken}, time.Hour)
+	assert.Equal(suite.T(), "WARNING: The presigned URLs contain your access token, which gives access to all of your files. Do not share the URLs with anyone.\n", out.String())
+
+	// The URLs are not valid after the token has expired
+	out.Reset()
+	warnPresign(&out, &helpers.Config{AccessToken: accessToken}, 24*time.Hour)
+	assert.Contains(suite.T(), out.String(), "The URLs stop working when the access token expires, in 2h 0m, before the 24h0m0s given with -presign-expires.\n")
+
+	expired, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()}).SignedString([]byte("secret"))
+	assert.NoError(suite.T(), err)
+	out.Reset()
+	warnPresign(&out, &helpers.Config{AccessToken: expired}, time.Hour)
+	assert.Contains(suite.T(), out.String(), "The access token has expired, so the URLs do not work. Log in again to get a new token.\n")
+
+	out.Reset()
+	warnPresign(&out, &helpers.Config{}, time.Hour)
+	assert.Empty(suite.T(), out.String())
+}
@@ -9,7 +9,6 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"path"
 	"path/filepath"
 	"regexp"
 	"strings"
@@ -19,6 +18,9 @@ import (
 	"github.com/neicnordic/crypt4gh/keys"
 	"github.com/neicnordic/crypt4gh/streaming"
 	log "github.com/sirupsen/logrus"
+	"github.com/vbauerster/mpb/v8"
+	"github.com/vbauerster/mpb/v8/decor"
+	"golang.org/x/exp/slices"
 )
 
 // Help text and command line flags.
@@ -26,7 +28,7 @@ import (
 // Usage text that will be displayed as command line help text when using the
 // `help encrypt` command
 var Usage = `
-USAGE: %s encrypt -key <public-key-file> (-outdir <dir>) (-continue=true) [file(s)]
+USAGE: %s encrypt -key|-pubkey <public-key-file> (-outdir <dir>) (-continue=true) (-force-overwrite) (-verify-key) (-outfile <file>) (-filelist <file>) (-profile <name>) [file(s)]
 
 encrypt:
     Encrypts files according to the crypt4gh standard used in the
@@ -37,31 +39,61 @@ encrypt:
         - checksum_encrypted.md5
         - checksum_unencrypted.sha256
         - checksum_encrypted.sha256
+    Existing encrypted files are not overwritten, unless
+    '-force-overwrite' is given.  Give several public keys to encrypt
+    the files for more than one recipient.  With '-verify-key' the
+    public keys are only checked, and no files are encrypted.  Use '-'
+    as the file to encrypt data read from stdin, which is written to the
+    file given with '-outfile'.  Many files can be given in a file list
+    with '-filelist', one file per line.  Without a public key, the key
+    of the previous login session, or of the profile given with
+    '-profile', is used.
 `
 
 // ArgHelp is the suffix text that will be displayed after the argument list in
 // the module help
 var ArgHelp = `
     [files]
-        All flagless arguments will be used as filenames for encryption.`
+        All flagless arguments will be used as filenames for encryption.
+        A single '-' reads the data to encrypt from stdin.`
 
 // Args is a flagset that needs to be exported so that it can be written to the
 // main program help
 var Args = flag.NewFlagSet("encrypt", flag.ExitOnError)
 
 var outDir = Args.String("outdir", "",
-	"Output directory for encrypted files.")
+	"Output directory for encrypted files. It is created if it does not exist.")
+
+var outFileName = Args.String("outfile", "",
+	"Output file for the encrypted data when encrypting from stdin (-).")
+
+var fileList = Args.String("filelist", "",
+	"File with the files to encrypt, one per line. Empty lines and lines\n"+
+		"starting with # are ignored.")
 
 var continueEncrypt = Args.Bool("continue", false, "Do not exit on file errors but skip and continue.")
 
+var forceOverwrite = Args.Bool("force-overwrite", false, "Overwrite encrypted output files that already exist.")
+
+var forceReencrypt = Args.Bool("force-reencrypt", false, "Encrypt input files even if they are already encrypted.")
+
+var verifyKey = Args.Bool("verify-key", false, "Only check that the public key(s) are valid, without encrypting any files.")
+
+var profile = Args.String("profile", "", "Named profile in ~/.sda-cli/config to take the public key from, if no key is given.")
+
 var publicKeyFileList []string
 
 func init() {
-	Args.Func("key", "Public key file(s) to use for encryption. Use multiple times to encrypt\nwith more public keys. Key file(s) may contain many concatenated keys.", func(s string) error {
+	addPublicKey := func(s string) error {
 		publicKeyFileList = append(publicKeyFileList, s)
 
 		return nil
-	})
+	}
+	Args.Func("key", "Public key file(s) to use for encryption. Use multiple times to encrypt\nwith more public keys. Key file(s) may contain many concatenated keys.", addPublicKey)
+	Args.Func("pubkey", "Same as -key. Use once per recipient to encrypt a file that every\nrecipient can decrypt with their own private key.", addPublicKey)
+	Args.Func("public-key", "Same as -key.", addPublicKey)
+	helpers.AliasFlag(Args, "outdir", "output-dir")
+	helpers.AliasFlag(Args, "outfile", "output-file")
 }
 
 // Encrypt takes a set of arguments, parses them, and attempts to encrypt the
@@ -78,13 +110,23 @@ func Encrypt(args []string) error {
 	// no key provided, check for one in the session file
 	if len(publicKeyFileList) == 0 {
 
-		sesKey, err := helpers.GetPublicKey()
+		sesKey, err := helpers.GetPublicKey(*profile)
 		if err != nil {
-			return fmt.Errorf("public key not provided or %v", err)
+			return fmt.Errorf("public key not provided or %w", err)
 		}
 		publicKeyFileList = append(publicKeyFileList, sesKey)
 	}
 
+	// Check the keys before any files are touched
+	if *verifyKey {
+		if _, err := createPubKeyList(publicKeyFileList, newKeySpecs()); err != nil {
+			return helpers.WithCategory(helpers.ErrCrypto, fmt.Errorf("invalid public key, reason: %w", err))
+		}
+		fmt.Printf("Public key(s) valid: %s\n", strings.Join(publicKeyFileList, ", "))
+
+		return nil
+	}
+
 	// Each filename is first read into a helper struct (sliced for combatibility with checkFiles)
 	eachFile := make([]helpers.EncryptionFileSet, 1)
 
@@ -102,15 +144,52 @@ func Encrypt(args []string) error {
 		}
 	}()
 
-	// Args() returns the non-flag arguments, which we assume are filenames.
+	// The files to encrypt are the non-flag arguments, followed by the
+	// files in the file list
+	inputs := Args.Args()
+	if *fileList != "" {
+		listed, err := helpers.ReadFileList(*fileList)
+		if err != nil {
+			return err
+		}
+		inputs = append(inputs, listed...)
+	}
+
+	// Data from stdin ("-") is encrypted into the file given with -outfile
+	stdinInput := slices.Contains(inputs, "-")
+	switch {
+	case stdinInput && len(inputs) > 1:
+		return errors.New("reading from stdin (-) cannot be combined with other input files")
+	case stdinInput && *outFileName == "":
+		return errors.New("an output file must be given with -outfile when encrypting from stdin")
+	case !stdinInput && *outFileName != "":
+		return errors.New("-outfile can only be used when encrypting from stdin (-)")
+	}
+
+	// Create the output directory if it does not exist
+	if *outDir != "" {
+		if err := os.MkdirAll(*outDir, 0750); err != nil {
+			return fmt.Errorf("failed to create output directory %s, reason: %v", *outDir, err)
+		}
+	}
+
 	log.Info("Checking files")
-	for _, filename := range Args.Args() {
+	for _, filename := range inputs {
+
+		if filename == "-" {
+			if helpers.FileExists(*outFileName) && !*forceOverwrite {
+				return fmt.Errorf("outfile %s already exists", *outFileName)
+			}
+			files = append(files, helpers.EncryptionFileSet{Unencrypted: filename, Encrypted: *outFileName})
 
-		// Set directory for the output file
+			continue
+		}
+
+		// Set directory for the output file, keeping only the file name of
+		// the input file
 		outFilename := filename + ".c4gh"
 		if *outDir != "" {
-			_, basename := path.Split(filename)
-			outFilename = path.Join(*outDir, basename) + ".c4gh"
+			outFilename = filepath.Join(*outDir, filepath.Base(filename)) + ".c4gh"
 		}
 
 		eachFile[0] = helpers.EncryptionFileSet{Unencrypted: filename, Encrypted: outFilename}
@@ -143,13 +222,13 @@ func Encrypt(args []string) error {
 	// key will be able to decrypt the file.
 	pubKeyList, err := createPubKeyList(publicKeyFileList, c4ghKeySpecs)
 	if err != nil {
-		return err
+		return helpers.WithCategory(helpers.ErrCrypto, err)
 	}
 
 	// Generate a random private key to encrypt the data
 	privateKey, err := generatePrivateKey()
 	if err != nil {
-		return err
+		return helpers.WithCategory(helpers.ErrCrypto, err)
 	}
 
 	// Open all checksum files
@@ -193,18 +272,25 @@ func Encrypt(args []string) error {
 		}
 	}()
 
+	// create progress bar instance, shared by all files
+	p := helpers.NewProgress()
+	defer p.Shutdown()
+
 	// encrypt the input files
 	numFiles := len(files)
 	for i, file := range files {
 		log.Infof("Encrypting file %v/%v: %s", i+1, numFiles, file.Unencrypted)
 
-		// encrypt the file
-		err = encrypt(file.Unencrypted, file.Encrypted, pubKeyList, *privateKey)
-		if err != nil {
-			return err
+		// encrypt the file and calculate hashes
+		var hashes *hashSet
+		if file.Unencrypted == "-" {
+			hashes, err = encryptStdin(file.Encrypted, pubKeyList, *privateKey)
+		} else {
+			err = encrypt(file.Unencrypted, file.Encrypted, pubKeyList, *privateKey, p)
+			if err == nil {
+				hashes, err = calculateHashes(file)
+			}
 		}
-		// calculate hashes
-		hashes, err := calculateHashes(file)
 		if err != nil {
 			return err
 		}
@@ -237,32 +323,21 @@ func checkFiles(files []helpers.EncryptionFileSet) error {
 	for _, file := range files {
 		// check that the input file exists and is readable
 		if !helpers.FileIsReadable(file.Unencrypted) {
-			return fmt.Errorf("cannot read input file %s", file.Unencrypted)
+			return helpers.WithCategory(helpers.ErrIO, fmt.Errorf("cannot read input file %s", file.Unencrypted))
 		}
 
-		// check that the output file doesn't exist
-		if helpers.FileExists(file.Encrypted) {
-			return fmt.Errorf("outfile %s already exists", file.Encrypted)
+		// check that the output file doesn't exist, unless it should be
+		// overwritten
+		if helpers.FileExists(file.Encrypted) && !*forceOverwrite {
+			return helpers.WithCategory(helpers.ErrIO, fmt.Errorf("outfile %s already exists", file.Encrypted))
 		}
 
 		// Check if the input file is already encrypted
-		unEncryptedFile, err := os.Open(file.Unencrypted)
+		encrypted, err := helpers.IsCrypt4GHFile(file.Unencrypted)
 		if err != nil {
 			return err
 		}
-		defer func() {
-			if err := unEncryptedFile.Close(); err != nil {
-				log.Errorf("Error closing file: %s\n", err)
-			}
-		}()
-
-		// Extracting the first 8 bytes of the header - crypt4gh
-		magicWord := make([]byte, 8)
-		_, err = unEncryptedFile.Read(magicWord)
-		if err != nil {
-			return fmt.Errorf("error reading input file %s, reason: %v", file.Unencrypted, err)
-		}
-		if string(magicWord) == "crypt4gh" {
+		if encrypted && !*forceReencrypt {
 			return fmt.Errorf("input file %s is already encrypted(.c4gh)", file.Unencrypted)
 		}
 	}
@@ -397,10 +472,11 @@ func generatePrivateKey() (*[32]byte, error) {
 }
 
 // Encrypts the data from `filename` into `outFilename` for the given `pubKey`,
-// using the given `privateKey`.
-func encrypt(filename, outFilename string, pubKeyList [][32]byte, privateKey [32]byte) error {
+// using the given `privateKey`. The progress is shown in a bar added to `p`,
+// unless `p` is nil.
+func encrypt(filename, outFilename string, pubKeyList [][32]byte, privateKey [32]byte, p *mpb.Progress) error {
 	// check if outfile exists
-	if helpers.FileExists(outFilename) {
+	if helpers.FileExists(outFilename) && !*forceOverwrite {
 		return fmt.Errorf("outfile %s already exists", outFilename)
 	}
 
@@ -415,33 +491,95 @@ func encrypt(filename, outFilename string, pubKeyList [][32]byte, privateKey [32
 		}
 	}()
 
-	// open outfile for writing
-	outFile, err := os.Create(filepath.Clean(outFilename))
+	var in io.Reader = inFile
+	if p != nil {
+		fileInfo, err := inFile.Stat()
+		if err != nil {
+			return err
+		}
+		file := fmt.Sprintf("File %s:", filepath.Base(filename))
+		// The progress bar starts with the file name, followed by the
+		// encrypting status, the processed bytes and the estimated time
+		// remaining. It is marked as done when the encryption is complete
+		bar := p.AddBar(fileInfo.Size(),
+			mpb.PrependDecorators(
+				decor.Name(file, decor.WC{W: len(file) + 1, C: decor.DidentRight}),
+				decor.Name("encrypting", decor.WCSyncSpaceR),
+				decor.Counters(decor.SizeB1024(0), "% .1f / % .1f"),
+			),
+			mpb.AppendDecorators(
+				decor.OnComplete(decor.Percentage(decor.WC{W: 5}), "done"),
+				decor.OnComplete(decor.EwmaETA(decor.ET_STYLE_GO, 30, decor.WC{W: 4}), ""),
+			),
+		)
+		in = bar.ProxyReader(inFile)
+	}
+
+	return encryptReader(in, outFilename, pubKeyList, privateKey)
+}
+
+// Encrypts the data read from stdin into `outFilename`. Since stdin can only
+// be read once, the checksums of the unencrypted data are calculated while
+// it is encrypted.
+func encryptStdin(outFilename string, pubKeyList [][32]byte, privateKey [32]byte) (*hashSet, error) {
+	// check if outfile exists
+	if helpers.FileExists(outFilename) && !*forceOverwrite {
+		return nil, fmt.Errorf("outfile %s already exists", outFilename)
+	}
+
+	md5Hash := md5.New()
+	shaHash := sha256.New()
+	tee := io.TeeReader(os.Stdin, io.MultiWriter(md5Hash, shaHash))
+	if err := encryptReader(tee, outFilename, pubKeyList, privateKey); err != nil {
+		return nil, err
+	}
+
+	hashes := hashSet{
+		unencryptedMd5:    hex.EncodeToString(md5Hash.Sum(nil)),
+		unencryptedSha256: hex.EncodeToString(shaHash.Sum(nil)),
+	}
+
+	encryptedFile, err := os.Open(filepath.Clean(outFilename))
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer func() {
-		if err := outFile.Close(); err != nil {
+		if err := encryptedFile.Close(); err != nil {
 			log.Errorf("Error closing file: %s\n", err)
 		}
 	}()
 
-	// Create crypt4gh writer
-
-	crypt4GHWriter, err := streaming.NewCrypt4GHWriter(outFile,
-		privateKey, pubKeyList, nil)
-	if err != nil {
-		return err
+	md5Hash.Reset()
+	shaHash.Reset()
+	if _, err := io.Copy(io.MultiWriter(md5Hash, shaHash), encryptedFile); err != nil {
+		return nil, err
 	}
-	defer crypt4GHWriter.Close()
+	hashes.encryptedMd5 = hex.EncodeToString(md5Hash.Sum(nil))
+	hashes.encryptedSha256 = hex.EncodeToString(shaHash.Sum(nil))
 
-	// Encrypt the data
-	_, err = io.Copy(crypt4GHWriter, inFile)
-	if err != nil {
-		return err
-	}
+	return &hashes, nil
+}
 
-	return nil
+// Encrypts the data from `inFile` into `outFilename` for the given `pubKey`,
+// using the given `privateKey`. The output file is only created once all data
+// is encrypted, so that no partially encrypted file is left behind.
+func encryptReader(inFile io.Reader, outFilename string, pubKeyList [][32]byte, privateKey [32]byte) error {
+	return helpers.AtomicWriter(outFilename, func(outFile io.Writer) error {
+		// Create crypt4gh writer
+		crypt4GHWriter, err := streaming.NewCrypt4GHWriter(outFile,
+			privateKey, pubKeyList, nil)
+		if err != nil {
+			return err
+		}
+
+		// Encrypt the data
+		_, err = io.Copy(crypt4GHWriter, inFile)
+		if closeErr := crypt4GHWriter.Close(); err == nil {
+			err = closeErr
+		}
+
+		return err
+	})
 }
 
 // Checks the first n bytes of a file for text matching the given regex pattern.
@@ -2,14 +2,17 @@ package encrypt
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"testing"
 
 	"github.com/NBISweden/sda-cli/helpers"
 	"github.com/neicnordic/crypt4gh/keys"
+	"github.com/neicnordic/crypt4gh/streaming"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 )
@@ -127,6 +130,12 @@ func (suite *EncryptTests) TestcheckFiles() {
 	err = checkFiles([]helpers.EncryptionFileSet{testHasEncrypted})
 	assert.EqualError(suite.T(), err, fmt.Sprintf("outfile %s already exists", suite.fileOk.Name()))
 
+	// encrypted exists, but overwriting is forced
+	*forceOverwrite = true
+	err = checkFiles([]helpers.EncryptionFileSet{testHasEncrypted})
+	assert.NoError(suite.T(), err)
+	*forceOverwrite = false
+
 	// unencrypted isn't readable
 	testNoUnencrypted := helpers.EncryptionFileSet{Unencrypted: "does-not-exist", Encrypted: suite.fileOk.Name()}
 	err = checkFiles([]helpers.EncryptionFileSet{testNoUnencrypted})
@@ -137,6 +146,11 @@ func (suite *EncryptTests) TestcheckFiles() {
 	err = checkFiles([]helpers.EncryptionFileSet{verifyUnencrypted})
 	assert.EqualError(suite.T(), err, fmt.Sprintf("input file %s is already encrypted(.c4gh)", suite.encryptedFile.Name()))
 
+	// Encrypted file is given as input and re-encryption is forced
+	*forceReencrypt = true
+	defer func() { *forceReencrypt = false }()
+	err = checkFiles([]helpers.EncryptionFileSet{verifyUnencrypted})
+	assert.NoError(suite.T(), err)
 }
 
 func (suite *EncryptTests) TestreadPublicKey() {
@@ -214,9 +228,11 @@ func (suite *EncryptTests) TestcalculateHashes() {
 
 func (suite *EncryptTests) TestEncryptFunction() {
 	// pub key not given
+	configHome := suite.T().TempDir()
+	suite.T().Setenv("XDG_CONFIG_HOME", configHome)
 	os.Args = []string{"encrypt", suite.fileOk.Name()}
 	err := Encrypt(os.Args)
-	assert.EqualError(suite.T(), err, "public key not provided or configuration file (.sda-cli-session) not found")
+	assert.EqualError(suite.T(), err, fmt.Sprintf("public key not provided or configuration file (%s) not found", filepath.Join(configHome, "sda-cli", "session")))
 
 	// no such pub key file
 	msg := "open somekey: no such file or directory"
@@ -227,3 +243,123 @@ func (suite *EncryptTests) TestEncryptFunction() {
 	err = Encrypt(os.Args)
 	assert.EqualError(suite.T(), err, msg)
 }
+
+func (suite *EncryptTests) TestEncryptMultipleRecipients() {
+	// Generate a second key pair for another recipient
+	otherPubKeyData, otherSecKeyData, err := keys.GenerateKeyPair()
+	assert.NoError(suite.T(), err)
+	otherPublicKey, err := os.CreateTemp(suite.tempDir, "pubkey-")
+	assert.NoError(suite.T(), err)
+	defer os.Remove(otherPublicKey.Name())
+	assert.NoError(suite.T(), keys.WriteCrypt4GHX25519PublicKey(otherPublicKey, otherPubKeyData))
+
+	// The output directory is created when it does not exist
+	outDirectory := filepath.Join(suite.tempDir, "out", "encrypted")
+	defer os.RemoveAll(filepath.Join(suite.tempDir, "out"))
+	defer func() { *outDir = "" }()
+	for _, name := range []string{"checksum_unencrypted.md5", "checksum_encrypted.md5", "checksum_unencrypted.sha256", "checksum_encrypted.sha256"} {
+		defer os.Remove(name)
+	}
+
+	os.Args = []string{"encrypt", "-pubkey", suite.publicKey.Name(), "-pubkey", otherPublicKey.Name(), "-outdir", outDirectory, suite.fileOk.Name()}
+	assert.NoError(suite.T(), Encrypt(os.Args))
+
+	// Both recipients can decrypt the file with their own private key
+	encrypted := filepath.Join(outDirectory, filepath.Base(suite.fileOk.Name())+".c4gh")
+	for _, secKey := range [][32]byte{suite.secKeyData, otherSecKeyData} {
+		f, err := os.Open(encrypted)
+		assert.NoError(suite.T(), err)
+		reader, err := streaming.NewCrypt4GHReader(f, secKey, nil)
+		assert.NoError(suite.T(), err)
+		content, err := io.ReadAll(reader)
+		assert.NoError(suite.T(), err)
+		assert.Equal(suite.T(), "content", string(content))
+		f.Close()
+	}
+}
+
+func (suite *EncryptTests) TestVerifyKey() {
+	defer func() { *verifyKey = false }()
+
+	// Valid keys are accepted without any files to encrypt
+	os.Args = []string{"encrypt", "-verify-key", "-key", suite.publicKey.Name(), "-key", suite.multiPublicKey.Name()}
+	assert.NoError(suite.T(), Encrypt(os.Args))
+
+	// A file that is not a public key is rejected
+	os.Args = []string{"encrypt", "-verify-key", "-key", suite.fileOk.Name()}
+	err := Encrypt(os.Args)
+	assert.ErrorContains(suite.T(), err, "invalid public key, reason:")
+
+	// A key with a malformed body is rejected
+	malformed := filepath.Join(suite.tempDir, "malformed.pub.pem")
+	err = os.WriteFile(malformed, []byte("-----BEGIN CRYPT4GH PUBLIC KEY-----\nc2hvcnQ=\n-----END CRYPT4GH PUBLIC KEY-----\n"), 0600)
+	assert.NoError(suite.T(), err)
+	defer os.Remove(malformed)
+	os.Args = []string{"encrypt", "-verify-key", "-key", malformed}
+	err = Encrypt(os.Args)
+	assert.ErrorContains(suite.T(), err, "invalid public key, reason:")
+}
+
+func (suite *EncryptTests) TestEncryptStdin() {
+	defer func() { *outFileName = "" }()
+	for _, name := range []string{"checksum_unencrypted.md5", "checksum_encrypted.md5", "checksum_unencrypted.sha256", "checksum_encrypted.sha256"} {
+		defer os.Remove(name)
+	}
+
+	// The output file is required, and stdin can not be mixed with files
+	os.Args = []string{"encrypt", "-key", suite.publicKey.Name(), "-"}
+	assert.EqualError(suite.T(), Encrypt(os.Args), "an output file must be given with -outfile when encrypting from stdin")
+
+	encrypted := filepath.Join(suite.tempDir, "stdin.c4gh")
+	os.Args = []string{"encrypt", "-key", suite.publicKey.Name(), "-outfile", encrypted, "-", suite.fileOk.Name()}
+	assert.EqualError(suite.T(), Encrypt(os.Args), "reading from stdin (-) cannot be combined with other input files")
+
+	os.Args = []string{"encrypt", "-key", suite.publicKey.Name(), "-outfile", encrypted, suite.fileOk.Name()}
+	assert.EqualError(suite.T(), Encrypt(os.Args), "-outfile can only be used when encrypting from stdin (-)")
+
+	// Encrypt data piped to stdin
+	r, w, err := os.Pipe()
+	assert.NoError(suite.T(), err)
+	rescueStdin := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = rescueStdin }()
+	_, err = w.WriteString("content from stdin")
+	assert.NoError(suite.T(), err)
+	w.Close()
+
+	os.Args = []string{"encrypt", "-key", suite.publicKey.Name(), "-outfile", encrypted, "-"}
+	assert.NoError(suite.T(), Encrypt(os.Args))
+	defer os.Remove(encrypted)
+
+	f, err := os.Open(encrypted)
+	assert.NoError(suite.T(), err)
+	defer f.Close()
+	reader, err := streaming.NewCrypt4GHReader(f, suite.secKeyData, nil)
+	assert.NoError(suite.T(), err)
+	content, err := io.ReadAll(reader)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "content from stdin", string(content))
+
+	// The checksum of the data read from stdin is recorded
+	checksums, err := os.ReadFile("checksum_unencrypted.sha256")
+	assert.NoError(suite.T(), err)
+	assert.Contains(suite.T(), string(checksums), "d8d85de18ffb62d39a48d489b0be6f5ec6dccb68512a8aff586d485a9cdfe075 -")
+}
+
+func (suite *EncryptTests) TestEncryptFileList() {
+	list := filepath.Join(suite.tempDir, "files.txt")
+	defer os.Remove(list)
+
+	// The listed files are encrypted
+	err := os.WriteFile(list, []byte(suite.fileOk.Name()+"\n"), 0600)
+	assert.NoError(suite.T(), err)
+	defer func() { *fileList = "" }()
+	for _, name := range []string{"checksum_unencrypted.md5", "checksum_encrypted.md5", "checksum_unencrypted.sha256", "checksum_encrypted.sha256"} {
+		defer os.Remove(name)
+	}
+	defer os.Remove(suite.fileOk.Name() + ".c4gh")
+
+	os.Args = []string{"encrypt", "-key", suite.publicKey.Name(), "-filelist", list}
+	assert.NoError(suite.T(), Encrypt(os.Args))
+	assert.FileExists(suite.T(), suite.fileOk.Name()+".c4gh")
+}
@@ -0,0 +1,252 @@
+package export
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/NBISweden/sda-cli/helpers"
+	log "github.com/sirupsen/logrus"
+)
+
+// Help text and command line flags.
+
+// Usage text that will be displayed as command line help text when using the
+// `help export` command
+var Usage = `
+USAGE: %s export [-config <s3config-file>] [-profile <name>] (-format s3cmd|rclone|aws-cli) (-out <file>) (-force-overwrite)
+
+export:
+    Writes the configuration of the previous login as a configuration
+    file for another S3 tool, so that the tool can be used with the
+    same credentials.  The format is chosen with '-format', which is
+    s3cmd by default, and the file is written to stdout, or to the file
+    given with '-out'.  The file contains the access token, so keep it
+    private.  If no config is specified, the tool will look for a
+    previous session, or the profile given with '-profile' in
+    ~/.sda-cli/config.
+`
+
+// ArgHelp is the suffix text that will be displayed after the argument list in
+// the module help
+var ArgHelp = `
+    export does not take any arguments`
+
+// Args is a flagset that needs to be exported so that it can be written to the
+// main program help
+var Args = flag.NewFlagSet("export", flag.ExitOnError)
+
+var configPath = Args.String("config", "",
+	"S3 config file to export.")
+
+var profile = Args.String("profile", "",
+	"Named profile in ~/.sda-cli/config to use instead of the session file.")
+
+var format = Args.String("format", "s3cmd",
+	"Format of the configuration file: s3cmd, rclone or aws-cli.")
+
+var outPath = Args.String("out", "",
+	"File to write the configuration to, instead of stdout.")
+
+var forceOverwrite = Args.Bool("force-overwrite", false,
+	"Overwrite the file given with -out if it exists.")
+
+// Long names of the short flags
+func init() {
+	helpers.AliasFlag(Args, "out", "output-file")
+}
+
+// setting is a key and value in a section of a configuration file
+type setting struct {
+	key   string
+	value string
+}
+
+// Export writes the configuration of the previous login in the format of
+// another S3 tool.
+func Export(args []string) error {
+	err := helpers.ParseArgs(args, Args)
+	if err != nil {
+		return fmt.Errorf("failed parsing arguments, reason: %w", err)
+	}
+	if len(Args.Args()) > 0 {
+		return errors.New("export does not take any arguments")
+	}
+
+	// Get the configuration file or the .sda-cli-session
+	config, err := helpers.GetAuth(*configPath, *profile)
+	if err != nil {
+		return fmt.Errorf("failed to load config file, reason: %w", err)
+	}
+
+	err = helpers.WarnTokenExpiration(config)
+	if err != nil {
+		return err
+	}
+
+	var out io.Writer = os.Stdout
+	if *outPath != "" {
+		if helpers.FileExists(*outPath) && !*forceOverwrite {
+			return fmt.Errorf("file %s already exists, use -force-overwrite to overwrite it", *outPath)
+		}
+		file, err := os.OpenFile(*outPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to create %s, reason: %w", *outPath, err)
+		}
+		defer file.Close()
+		out = file
+	}
+
+	err = writeConfig(out, config, *format, *profile)
+	if err != nil {
+		return err
+	}
+	if *outPath != "" {
+		fmt.Fprintf(os.Stderr, "Wrote the %s configuration to %s\n", *format, *outPath)
+	}
+
+	return nil
+}
+
+// writeConfig writes the configuration in the given format to w. The name of
+// the profile, if any, is used as the name of the section for the formats
+// that have named sections.
+func writeConfig(w io.Writer, config *helpers.Config, format, name string) error {
+	if config.TLSCert != "" {
+		log.Warnf("The TLS client certificate is not exported, configure it in the %s configuration if it is supported", format)
+	}
+
+	switch format {
+	case "s3cmd":
+		// s3cmd only reads the default section
+		writeSection(w, "default", s3cmdSettings(config))
+	case "rclone":
+		if name == "" {
+			name = "sda"
+		}
+		writeSection(w, name, rcloneSettings(config))
+	case "aws-cli":
+		writeSection(w, awsSection(name), awsSettings(config))
+	default:
+		return helpers.WithCategory(helpers.ErrConfig, fmt.Errorf("unsupported format: %s, use s3cmd, rclone or aws-cli", format))
+	}
+
+	return nil
+}
+
+// writeSection writes a section of an ini file with the settings to w.
+// Settings without a value are left out.
+func writeSection(w io.Writer, name string, settings []setting) {
+	fmt.Fprintf(w, "[%s]\n", name)
+	for _, s := range settings {
+		switch {
+		case s.value == "":
+		case strings.HasPrefix(s.value, "\n"):
+			// Nested settings start on the next line
+			fmt.Fprintf(w, "%s =%s\n", s.key, s.value)
+		default:
+			fmt.Fprintf(w, "%s = %s\n", s.key, s.value)
+		}
+	}
+}
+
+// s3cmdSettings returns the settings of the .s3cfg file of s3cmd. The host is
+// given without the scheme, which is set by use_https, and host_bucket is the
+// same as host_base so that s3cmd uses path style requests.
+func s3cmdSettings(config *helpers.Config) []setting {
+	host, useHTTPS := hostAndScheme(config)
+
+	return []setting{
+		{"access_key", config.AccessKey},
+		{"secret_key", config.AccessKey},
+		{"access_token", config.AccessToken},
+		{"host_base", host},
+		{"host_bucket", host},
+		{"use_https", pythonBool(useHTTPS)},
+		{"check_ssl_certificate", pythonBool(config.CheckSslCertificate)},
+		{"check_ssl_hostname", pythonBool(config.CheckSslHostname)},
+		{"ca_certs_file", config.CACert},
+		{"encoding", config.Encoding},
+		{"guess_mime_type", pythonBool(config.GuessMimeType)},
+		{"human_readable_sizes", pythonBool(config.HumanReadableSizes)},
+		{"multipart_chunk_size_mb", fmt.Sprint(config.MultipartChunkSizeMb)},
+		{"socket_timeout", fmt.Sprint(int(helpers.SocketTimeout(*config).Seconds()))},
+	}
+}
+
+// rcloneSettings returns the settings of a S3 remote in rclone.conf. The
+// access token is sent as the session token, as by this tool.
+func rcloneSettings(config *helpers.Config) []setting {
+	return []setting{
+		{"type", "s3"},
+		{"provider", "Other"},
+		{"access_key_id", config.AccessKey},
+		{"secret_access_key", config.AccessKey},
+		{"session_token", config.AccessToken},
+		{"endpoint", endpointURL(config)},
+		{"region", helpers.S3Region},
+		{"force_path_style", "true"},
+		{"no_check_bucket", "true"},
+	}
+}
+
+// awsSettings returns the settings of a profile in the config file of the
+// AWS CLI, which can also hold the credentials. The nested s3 settings are
+// written last.
+func awsSettings(config *helpers.Config) []setting {
+	return []setting{
+		{"aws_access_key_id", config.AccessKey},
+		{"aws_secret_access_key", config.AccessKey},
+		{"aws_session_token", config.AccessToken},
+		{"endpoint_url", endpointURL(config)},
+		{"region", helpers.S3Region},
+		{"ca_bundle", config.CACert},
+		{"s3", "\n    addressing_style = path"},
+	}
+}
+
+// awsSection returns the name of the section of a profile in the config file
+// of the AWS CLI, where other profiles than the default have a prefix
+func awsSection(name string) string {
+	if name == "" || name == "default" {
+		return "default"
+	}
+
+	return "profile " + name
+}
+
+// hostAndScheme returns the host of the configuration without the scheme,
+// and whether it uses https
+func hostAndScheme(config *helpers.Config) (string, bool) {
+	switch {
+	case strings.HasPrefix(config.HostBase, "https://"):
+		return strings.TrimPrefix(config.HostBase, "https://"), true
+	case strings.HasPrefix(config.HostBase, "http://"):
+		return strings.TrimPrefix(config.HostBase, "http://"), false
+	default:
+		return config.HostBase, config.UseHTTPS
+	}
+}
+
+// endpointURL returns the URL of the host of the configuration, with the
+// scheme
+func endpointURL(config *helpers.Config) string {
+	host, useHTTPS := hostAndScheme(config)
+	if useHTTPS {
+		return "https://" + host
+	}
+
+	return "http://" + host
+}
+
+// pythonBool formats a bool as in the configuration files of s3cmd
+func pythonBool(value bool) string {
+	if value {
+		return "True"
+	}
+
+	return "False"
+}
@@ -1,28 +1,47 @@
 package helpers
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/xml"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/golang-jwt/jwt"
+	"github.com/inhies/go-bytesize"
 	"github.com/manifoldco/promptui"
 	"github.com/neicnordic/crypt4gh/keys"
 	log "github.com/sirupsen/logrus"
 	"github.com/vbauerster/mpb/v8"
-	"golang.org/x/exp/slices"
+	"github.com/zalando/go-keyring"
+	"golang.org/x/term"
+	"golang.org/x/time/rate"
 	"gopkg.in/ini.v1"
 )
 
@@ -39,6 +58,35 @@ func FileExists(filename string) bool {
 	return err == nil
 }
 
+// AtomicWriter calls fn with a temporary file next to path, which is renamed
+// to path if fn succeeds, so that an interrupted or failed write never leaves
+// a partial file at path. The temporary file is removed if fn fails. The file
+// is only readable by the user, and replaces any existing file at path.
+func AtomicWriter(path string, fn func(io.Writer) error) error {
+	path = filepath.Clean(path)
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return WithCategory(ErrIO, fmt.Errorf("could not create output file %s: %w", path, err))
+	}
+
+	err = fn(tmpFile)
+	if closeErr := tmpFile.Close(); err == nil && closeErr != nil {
+		err = WithCategory(ErrIO, fmt.Errorf("could not write output file %s: %w", path, closeErr))
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), path)
+	}
+	if err != nil {
+		if rmErr := os.Remove(tmpFile.Name()); rmErr != nil && !os.IsNotExist(rmErr) {
+			log.Errorf("could not remove temporary file %s: %s", tmpFile.Name(), rmErr)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
 // FileIsReadable checks that a file exists, and is readable by the program.
 func FileIsReadable(filename string) bool {
 	fileInfo, err := os.Stat(filename)
@@ -62,6 +110,118 @@ func FileIsReadable(filename string) bool {
 	return err == nil
 }
 
+// ReadFileList reads a list of files from a text file with one file per line.
+// Surrounding whitespace is trimmed, and empty lines and lines starting with
+// "#" are skipped.
+func ReadFileList(filename string) ([]string, error) {
+	f, err := os.Open(filepath.Clean(filename))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file list, reason: %w", err)
+	}
+	defer f.Close()
+
+	var files []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		files = append(files, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read file list, reason: %w", err)
+	}
+
+	return files, nil
+}
+
+// KeyringService is the name under which private key passphrases are stored
+// in the system keyring
+const KeyringService = "sda-cli"
+
+// keyringUser returns the keyring user name for a private key file, which is
+// the base name of the file, so that the key is found from any directory and
+// after the key file has been moved.
+func keyringUser(keyFile string) string {
+	return filepath.Base(keyFile)
+}
+
+// GetKeyringPassphrase returns the passphrase of a private key file stored in
+// the system keyring. The returned bool is false if no passphrase is stored
+// for the file.
+func GetKeyringPassphrase(keyFile string) (string, bool, error) {
+	passphrase, err := keyring.Get(KeyringService, keyringUser(keyFile))
+	switch {
+	case errors.Is(err, keyring.ErrNotFound):
+		return "", false, nil
+	case err != nil:
+		return "", false, fmt.Errorf("failed to read passphrase from keyring, reason: %w", err)
+	}
+
+	return passphrase, true, nil
+}
+
+// SetKeyringPassphrase stores the passphrase of a private key file in the
+// system keyring.
+func SetKeyringPassphrase(keyFile, passphrase string) error {
+	if err := keyring.Set(KeyringService, keyringUser(keyFile), passphrase); err != nil {
+		return fmt.Errorf("failed to store passphrase in keyring, reason: %w", err)
+	}
+
+	return nil
+}
+
+// IsCrypt4GHFile checks if a file is encrypted with crypt4gh, by comparing the
+// first 8 bytes of the file with the crypt4gh magic word. Files shorter than
+// the magic word are reported as not encrypted.
+func IsCrypt4GHFile(path string) (bool, error) {
+	f, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.Errorf("Error closing file: %s\n", err)
+		}
+	}()
+
+	magicWord := make([]byte, 8)
+	_, err = io.ReadFull(f, magicWord)
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return false, nil
+	case err != nil:
+		return false, fmt.Errorf("error reading input file %s, reason: %v", path, err)
+	}
+
+	return string(magicWord) == "crypt4gh", nil
+}
+
+// indexExtensions are the extensions of the index files of the genomics file
+// formats that have one, by the extension of the indexed file
+var indexExtensions = []struct{ file, index string }{
+	{".bam", ".bai"},
+	{".vcf.gz", ".tbi"},
+	{".fa", ".fai"},
+}
+
+// IndexFile returns the name of the index file next to a BAM, VCF or FASTA
+// file, which is the name of the file with the extension of the index added,
+// e.g. reads.bam.bai for reads.bam. The .c4gh extension of encrypted files is
+// kept last, as in reads.bam.bai.c4gh. The second value is false for files
+// without an index.
+func IndexFile(name string) (string, bool) {
+	base := strings.TrimSuffix(name, ".c4gh")
+	for _, ext := range indexExtensions {
+		if strings.HasSuffix(base, ext.file) {
+			return base + ext.index + name[len(base):], true
+		}
+	}
+
+	return "", false
+}
+
 // FormatSubcommandUsage moves the lines in the standard usage strings around so
 // that the usage string is indented under the help text instead of above it.
 func FormatSubcommandUsage(usageString string) string {
@@ -97,45 +257,133 @@ func PromptPassword(message string) (password string, err error) {
 	return prompt.Run()
 }
 
-// ParseS3ErrorResponse checks if reader stream is xml encoded and if yes unmarshals
-// the xml response and returns it.
-func ParseS3ErrorResponse(respBody io.Reader) (string, error) {
+// AssumeYes answers yes to all confirmation prompts, set by the global -y
+// flag
+var AssumeYes bool
 
-	respMsg, err := io.ReadAll(respBody)
-	if err != nil {
-		return "", fmt.Errorf("failed to read from response body, reason: %v", err)
+// PromptConfirm asks a yes or no question, with a [y/N] prompt, and returns
+// true only if the answer is y or yes. Since the question cannot be answered
+// when stdin is not a terminal, e.g. in a script, an error is returned then,
+// so that nothing is removed by accident. With the global -y flag, the
+// question is answered with yes, and a warning is logged instead.
+func PromptConfirm(message string) (bool, error) {
+	if AssumeYes {
+		log.Warnf("%s Answered yes with -y", message)
+
+		return true, nil
+	}
+	if !IsTerminal(os.Stdin) {
+		return false, errors.New("cannot ask for confirmation, stdin is not a terminal, use -y to confirm")
+	}
+
+	prompt := promptui.Prompt{
+		Label: message + " [y/N]",
 	}
+	answer, err := prompt.Run()
+	switch {
+	case errors.Is(err, promptui.ErrInterrupt), errors.Is(err, promptui.ErrEOF):
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+
+	return isYes(answer), nil
+}
+
+// PromptSelect shows a menu of the items, where one is chosen with the arrow
+// keys, and returns the chosen item. An error is returned if stdin is not a
+// terminal, since nothing can be chosen then.
+func PromptSelect(label string, items []string) (string, error) {
+	if !IsTerminal(os.Stdin) {
+		return "", errors.New("cannot ask to choose, stdin is not a terminal")
+	}
+
+	prompt := promptui.Select{
+		Label: label,
+		Items: items,
+	}
+	_, item, err := prompt.Run()
+
+	return item, err
+}
 
-	if !strings.Contains(string(respMsg), `xml version`) {
-		return "", fmt.Errorf("cannot parse response body, reason: not xml")
+// isYes returns true if the answer to a yes or no question is yes
+func isYes(answer string) bool {
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	default:
+		return false
 	}
+}
+
+// IsTerminal returns true if the file is a terminal, where colors can be used
+func IsTerminal(f *os.File) bool {
+	return term.IsTerminal(int(f.Fd()))
+}
+
+// ParseS3ErrorResponse reads an error response of the S3 backend, which is
+// XML encoded, or JSON encoded as by some S3-compatible backends like Ceph
+// RGW, and returns it as an S3Error.
+func ParseS3ErrorResponse(respBody io.Reader) (*S3Error, error) {
 
-	xmlErrorResponse := XMLerrorResponse{}
-	err = xml.Unmarshal(respMsg, &xmlErrorResponse)
+	respMsg, err := io.ReadAll(respBody)
 	if err != nil {
-		return "", fmt.Errorf("failed to unmarshal xml response, reason: %v", err)
+		return nil, fmt.Errorf("failed to read from response body, reason: %w", err)
+	}
+
+	body := bytes.TrimSpace(respMsg)
+	s3Error := &S3Error{}
+	switch {
+	case bytes.HasPrefix(body, []byte("<")):
+		err = xml.Unmarshal(body, s3Error)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal xml response, reason: %w", err)
+		}
+	case bytes.HasPrefix(body, []byte("{")):
+		// The error is either the object itself or nested in an Error
+		// field, and the field names are matched case-insensitively
+		var jsonError struct {
+			S3Error
+			Error *S3Error `json:"Error"`
+		}
+		err = json.Unmarshal(body, &jsonError)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal json response, reason: %w", err)
+		}
+		*s3Error = jsonError.S3Error
+		if jsonError.Error != nil {
+			*s3Error = *jsonError.Error
+		}
+	default:
+		return nil, errors.New("cannot parse response body, reason: not xml or json")
 	}
 
-	return fmt.Sprintf("%+v", xmlErrorResponse), nil
+	return s3Error, nil
 }
 
-// Removes all positional arguments from args, and returns them.
-// This function assumes that all flags have exactly one value.
-func getPositional(args []string) ([]string, []string) {
-	argList := []string{"-r", "--r", "--force-overwrite", "-force-overwrite", "--force-unencrypted", "-force-unencrypted"}
+// Removes all positional arguments from args, and returns them. The flags of
+// argFlags are looked up to know which of them take a value, which is the
+// next argument unless it is given as -flag=value.
+func getPositional(args []string, argFlags *flag.FlagSet) ([]string, []string) {
 	i := 1
 	var positional []string
 	for i < len(args) {
 		switch {
-		case slices.Contains(argList, args[i]):
-			// if the current args is a boolean flag, skip it
-			i++
-		case args[i][0] == '-':
-			// if the current arg is a flag, skip the flag and its value
-			i += 2
+		case args[i] == "--":
+			// everything after the terminator is positional
+			return append(positional, args[i+1:]...), args[:i+1]
+		case args[i][0] == '-' && args[i] != "-":
+			if takesValue(args[i], argFlags) {
+				// skip the flag and its value
+				i += 2
+			} else {
+				// skip the boolean flag, or the flag with its value
+				i++
+			}
 		default:
-			// if the current arg is positional, remove it and add it to
-			// `positional`
+			// if the current arg is positional (a single "-" stands for
+			// stdin), remove it and add it to `positional`
 			positional = append(positional, args[i])
 			args = append(args[:i], args[i+1:]...)
 		}
@@ -144,9 +392,39 @@ func getPositional(args []string) ([]string, []string) {
 	return positional, args
 }
 
+// takesValue returns true if the flag argument arg, e.g. -config, is a flag
+// of argFlags whose value is given in the next argument. Boolean flags, flags
+// given as -flag=value and unknown flags, which fail the parsing, do not.
+func takesValue(arg string, argFlags *flag.FlagSet) bool {
+	name := strings.TrimLeft(arg, "-")
+	if strings.Contains(name, "=") {
+		return false
+	}
+	f := argFlags.Lookup(name)
+	if f == nil {
+		return false
+	}
+	if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+		return false
+	}
+
+	return true
+}
+
+// AliasFlag registers alias as another name of the flag name in argFlags,
+// which sets the same variable, e.g. a long name for a short flag. It panics
+// if the flag does not exist, as for flags that are defined twice.
+func AliasFlag(argFlags *flag.FlagSet, name, alias string) {
+	f := argFlags.Lookup(name)
+	if f == nil {
+		panic(fmt.Sprintf("%s flag alias of undefined flag: %s", argFlags.Name(), name))
+	}
+	argFlags.Var(f.Value, alias, "Same as -"+name+".")
+}
+
 func ParseArgs(args []string, argFlags *flag.FlagSet) error {
 	var pos []string
-	pos, args = getPositional(args)
+	pos, args = getPositional(args, argFlags)
 	// append positional args back at the end of args
 	args = append(args, pos...)
 	err := argFlags.Parse(args[1:])
@@ -165,16 +443,98 @@ type EncryptionFileSet struct {
 	Encrypted   string
 }
 
-// struct type to unmarshall xml error response from s3 server
-type XMLerrorResponse struct {
-	Code     string `xml:"Code"`
-	Message  string `xml:"Message"`
-	Resource string `xml:"Resource"`
+// S3Error is an error response from the S3 backend. The Code can be used to
+// check for specific errors, like NoSuchKey.
+type S3Error struct {
+	Code     string `xml:"Code" json:"Code"`
+	Message  string `xml:"Message" json:"Message"`
+	Resource string `xml:"Resource" json:"Resource"`
+}
+
+func (e *S3Error) Error() string {
+	return fmt.Sprintf("{Code:%s Message:%s Resource:%s}", e.Code, e.Message, e.Resource)
+}
+
+// NoProgress disables the progress bars of all commands, set by the global
+// -no-progress flag
+var NoProgress bool
+
+// ProgressEnabled returns true if progress bars should be shown, which is
+// when stdout is a terminal, and they are not disabled with the -no-progress
+// flag or the SDA_CLI_NO_PROGRESS environment variable
+func ProgressEnabled() bool {
+	if NoProgress {
+		return false
+	}
+	if disabled, err := strconv.ParseBool(os.Getenv("SDA_CLI_NO_PROGRESS")); err == nil && disabled {
+		return false
+	}
+
+	return IsTerminal(os.Stdout)
+}
+
+// NewProgress returns the container of the progress bars of a command. The
+// bars are written to stdout, or discarded if progress bars are disabled, so
+// that the commands can update them either way.
+func NewProgress() *mpb.Progress {
+	if !ProgressEnabled() {
+		return mpb.New(mpb.WithOutput(io.Discard))
+	}
+
+	return mpb.New()
+}
+
+// ErrGroup runs functions concurrently, like errgroup.Group, but collects the
+// errors of all of them instead of stopping at the first one. The zero value
+// runs any number of functions at the same time, see SetLimit.
+type ErrGroup struct {
+	wg   sync.WaitGroup
+	sem  chan struct{}
+	mu   sync.Mutex
+	errs []error
+}
+
+// SetLimit limits the number of functions running at the same time to n, so
+// that Go blocks until one of them returns. It must be called before Go.
+func (g *ErrGroup) SetLimit(n int) {
+	if n > 0 {
+		g.sem = make(chan struct{}, n)
+	}
+}
+
+// Go runs f in a new goroutine, and keeps the error it returns, if any
+func (g *ErrGroup) Go(f func() error) {
+	if g.sem != nil {
+		g.sem <- struct{}{}
+	}
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		if g.sem != nil {
+			defer func() { <-g.sem }()
+		}
+
+		if err := f(); err != nil {
+			g.mu.Lock()
+			g.errs = append(g.errs, err)
+			g.mu.Unlock()
+		}
+	}()
+}
+
+// Wait waits for all functions to return, and returns their errors in the
+// order they occurred
+func (g *ErrGroup) Wait() []error {
+	g.wg.Wait()
+
+	return g.errs
 }
 
 // progress bar definitions
 // Produces a progress bar with decorators that can produce different styles
 // Check https://github.com/vbauerster/mpb for more info and how to use it
+// If a Limiter is given, reads are delayed so that data is sent at most at the
+// rate allowed by the limiter.
 type CustomReader struct {
 	Fp      *os.File
 	Size    int64
@@ -182,6 +542,7 @@ type CustomReader struct {
 	Bar     *mpb.Bar
 	SignMap map[int64]struct{}
 	Mux     sync.Mutex
+	Limiter *rate.Limiter
 }
 
 func (r *CustomReader) Read(p []byte) (int, error) {
@@ -198,7 +559,8 @@ func (r *CustomReader) ReadAt(p []byte, off int64) (int, error) {
 
 	r.Mux.Lock()
 	// Ignore the first signature call
-	if _, ok := r.SignMap[off]; ok {
+	_, sending := r.SignMap[off]
+	if sending {
 		r.Reads += int64(n)
 		r.Bar.SetCurrent(r.Reads)
 	} else {
@@ -206,13 +568,136 @@ func (r *CustomReader) ReadAt(p []byte, off int64) (int, error) {
 	}
 	r.Mux.Unlock()
 
+	// Only the data that is actually sent counts towards the rate limit
+	if sending && r.Limiter != nil {
+		return n, WaitForRate(r.Limiter, n)
+	}
+
 	return n, err
 }
 
+// WaitForRate blocks until the limiter allows n bytes to be transferred.
+// Requests larger than the burst size of the limiter are split into several
+// waits.
+func WaitForRate(limiter *rate.Limiter, n int) error {
+	for n > 0 {
+		chunk := n
+		if chunk > limiter.Burst() {
+			chunk = limiter.Burst()
+		}
+		if err := limiter.WaitN(context.Background(), chunk); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+
+	return nil
+}
+
+// ParseRate parses transfer rates like "10MB/s" or "500KB/s" and returns the
+// rate in bytes per second.
+func ParseRate(rateString string) (int64, error) {
+	size, err := bytesize.Parse(strings.TrimSuffix(strings.TrimSpace(rateString), "/s"))
+	if err != nil || size < 1 {
+		return 0, fmt.Errorf("invalid transfer rate: %s", rateString)
+	}
+
+	return int64(size), nil
+}
+
+// FormatBytes formats a size in bytes in a human-readable form, like "512 B",
+// "12.1 KB" or "1.2 GB", which is used for all sizes shown by the commands.
+// Units are powers of 1024, and sizes of a kilobyte or more are shown with one
+// decimal.
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	value := float64(n)
+	units := []string{"KB", "MB", "GB", "TB", "PB", "EB"}
+	i := -1
+	for value >= unit && i < len(units)-1 {
+		value /= unit
+		i++
+	}
+
+	return fmt.Sprintf("%.1f %s", value, units[i])
+}
+
+// PermanentError wraps an error that will not go away by retrying the
+// operation, e.g. a denied request.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// RetryWithBackoff calls fn until it succeeds, for at most attempts times.
+// The delay between two calls starts at initialDelay and is doubled after
+// every failed call, with a random jitter of +/- 50% added. Errors wrapped in
+// a PermanentError are returned immediately. The error of the last call is
+// returned if all attempts fail.
+func RetryWithBackoff(attempts int, initialDelay time.Duration, fn func() error) error {
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	delay := initialDelay
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if err == nil {
+			return nil
+		}
+
+		var permanent *PermanentError
+		if errors.As(err, &permanent) {
+			return permanent.Err
+		}
+		if attempt >= attempts {
+			return err
+		}
+
+		// #nosec G404 -- the jitter does not need to be cryptographically secure
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay)+1))
+		log.Warningf("attempt %d of %d failed, retrying in %v, reason: %v", attempt, attempts, wait.Round(time.Millisecond), err)
+		time.Sleep(wait)
+		delay *= 2
+	}
+}
+
 func (r *CustomReader) Seek(offset int64, whence int) (int64, error) {
 	return r.Fp.Seek(offset, whence)
 }
 
+// CustomWriter wraps a writer and updates the progress bar with the bytes
+// written to it, for streams such as the body of a download. The time since
+// the previous write is used for the speed and time left shown by the bar.
+type CustomWriter struct {
+	W    io.Writer
+	Bar  *mpb.Bar
+	last time.Time
+}
+
+func (w *CustomWriter) Write(p []byte) (int, error) {
+	if w.last.IsZero() {
+		w.last = time.Now()
+	}
+	n, err := w.W.Write(p)
+	w.Bar.EwmaIncrBy(n, time.Since(w.last))
+	w.last = time.Now()
+
+	return n, err
+}
+
 // Config struct for storing the s3cmd file values
 type Config struct {
 	AccessKey            string `ini:"access_key"`
@@ -229,170 +714,1244 @@ type Config struct {
 	SocketTimeout        int    `ini:"socket_timeout"`
 	HumanReadableSizes   bool   `ini:"human_readable_sizes"`
 	PublicKey            string `ini:"public_key"`
+	RefreshToken         string `ini:"refresh_token"`
+	TLSCert              string `ini:"tls_cert"`
+	TLSKey               string `ini:"tls_key"`
+	CACert               string `ini:"ca_cert"`
+	PrivateKey           string `ini:"private_key"`
 }
 
-// LoadConfigFile loads ini configuration file to the Config struct
-func LoadConfigFile(path string) (*Config, error) {
+// awsDebug enables the debug logging of the AWS SDK
+var awsDebug bool
 
-	config := &Config{}
+// debugTransport logs every HTTP request and the status of its response
+type debugTransport struct {
+	next http.RoundTripper
+}
 
-	cfg, err := ini.Load(path)
+func (t debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	log.Debugf("HTTP request: %s %s", req.Method, req.URL.Redacted())
+	resp, err := t.next.RoundTrip(req)
 	if err != nil {
-		return config, err
-	}
-
-	// ini sees a DEFAULT section by default
-	var iniSection string
-	if len(cfg.SectionStrings()) > 1 {
-		iniSection = cfg.SectionStrings()[1]
-	} else {
-		iniSection = cfg.SectionStrings()[0]
-	}
+		log.Debugf("HTTP request failed: %s %s, reason: %v", req.Method, req.URL.Redacted(), err)
 
-	if err := cfg.Section(iniSection).MapTo(config); err != nil {
 		return nil, err
 	}
+	log.Debugf("HTTP response: %s %s: %s", req.Method, req.URL.Redacted(), resp.Status)
+
+	return resp, nil
+}
 
-	if config.AccessKey == "" || config.AccessToken == "" {
-		return nil, errors.New("failed to find credentials in configuration file")
+// EnableDebugLogging sets the log level to debug, and logs every HTTP request
+// made with the default HTTP client. With awsLogging, the debug logging of the
+// AWS SDK is enabled as well.
+func EnableDebugLogging(awsLogging bool) {
+	log.SetLevel(log.DebugLevel)
+	if _, ok := http.DefaultTransport.(debugTransport); !ok {
+		http.DefaultTransport = debugTransport{next: http.DefaultTransport}
 	}
+	awsDebug = awsDebug || awsLogging
+}
 
-	if config.HostBase == "" {
-		return nil, errors.New("failed to find endpoint in configuration file")
+// SetLogFormat sets the format of the logs, text, which is the default, or
+// json for log aggregation systems
+func SetLogFormat(format string) error {
+	switch format {
+	case "", "text":
+		log.SetFormatter(&log.TextFormatter{})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return WithCategory(ErrConfig, fmt.Errorf("unsupported log format: %s, use text or json", format))
 	}
 
-	if config.UseHTTPS {
-		config.HostBase = "https://" + config.HostBase
+	return nil
+}
+
+// levelWriterHook is a log hook that writes the entries of the given levels
+// to w, in addition to the output of the logger
+type levelWriterHook struct {
+	w      io.Writer
+	levels []log.Level
+}
+
+func (h *levelWriterHook) Levels() []log.Level {
+	return h.levels
+}
+
+func (h *levelWriterHook) Fire(entry *log.Entry) error {
+	line, err := entry.Bytes()
+	if err != nil {
+		return err
 	}
+	_, err = h.w.Write(line)
 
-	if config.Encoding == "" {
-		config.Encoding = "UTF-8"
+	return err
+}
+
+// SetLogFile writes all log entries, at the debug level, to the file at path,
+// which is appended to. The entries are still written to stderr at the
+// current level, the warning level or the debug level with -v.
+func SetLogFile(path string) error {
+	if path == "" {
+		return nil
 	}
 
-	// Where 15 is the default chunk size of the library
-	if config.MultipartChunkSizeMb <= 15 {
-		config.MultipartChunkSizeMb = 15
+	file, err := os.OpenFile(filepath.Clean(path), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return WithCategory(ErrConfig, fmt.Errorf("failed to open log file %s, reason: %w", path, err))
 	}
 
-	return config, nil
-}
+	stderrLevel := log.GetLevel()
+	EnableDebugLogging(false)
+	log.SetOutput(file)
+	log.AddHook(&levelWriterHook{w: os.Stderr, levels: log.AllLevels[:stderrLevel+1]})
 
-// GetAuth calls LoadConfig if we have a config file, otherwise try to load .sda-cli-session
-func GetAuth(path string) (*Config, error) {
+	return nil
+}
 
-	if path != "" {
-		return LoadConfigFile(path)
+// SetProxy makes the default HTTP client, which is used for the S3 and the
+// OIDC connections, go through the proxy at the given URL, or else at the URL
+// in the SDA_CLI_PROXY environment variable. Without either, the standard
+// HTTP_PROXY and HTTPS_PROXY environment variables are used.
+func SetProxy(proxy string) error {
+	if proxy == "" {
+		proxy = os.Getenv("SDA_CLI_PROXY")
 	}
-	if FileExists(".sda-cli-session") {
-		return LoadConfigFile(".sda-cli-session")
+	if proxy == "" {
+		return nil
 	}
 
-	return nil, errors.New("failed to read the configuration file")
-}
+	proxyURL, err := url.Parse(proxy)
+	if err != nil || proxyURL.Host == "" {
+		return WithCategory(ErrConfig, fmt.Errorf("invalid proxy URL: %s", proxy))
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return WithCategory(ErrConfig, fmt.Errorf("unsupported proxy scheme: %s", proxyURL.Scheme))
+	}
 
-func GetPublicKey() (string, error) {
-	// Check if the ".sda-cli-session" file exists
-	if !FileExists(".sda-cli-session") {
-		return "", errors.New("configuration file (.sda-cli-session) not found")
+	transport := http.DefaultTransport
+	if debug, ok := transport.(debugTransport); ok {
+		transport = debug.next
 	}
+	httpTransport, ok := transport.(*http.Transport)
+	if !ok {
+		return errors.New("failed to set the proxy of the HTTP client")
+	}
+	httpTransport.Proxy = http.ProxyURL(proxyURL)
+	log.Debugf("Using the proxy %s", proxyURL.Redacted())
 
-	if FileExists(".sda-cli-session") {
-		file, err := os.Open(".sda-cli-session")
-		if err != nil {
-			fmt.Println("could not read file:", file)
-		}
+	return nil
+}
+
+// SetCACert makes the default HTTP client, which is used for the S3 and the
+// OIDC connections, trust the CA certificates in the PEM file at path, in
+// addition to the system's CA certificates.
+func SetCACert(path string) error {
+	if path == "" {
+		return nil
 	}
 
-	// Load the configuration file
-	config, err := LoadConfigFile(".sda-cli-session")
+	roots, err := loadCACert(path)
 	if err != nil {
-		return "", fmt.Errorf("failed to load configuration file: %w", err)
+		return err
 	}
 
-	// Check if the PublicKey field is present in the config
-	if config.PublicKey == "" {
-		return "", errors.New("public key not found in the configuration")
+	transport := http.DefaultTransport
+	if debug, ok := transport.(debugTransport); ok {
+		transport = debug.next
+	}
+	httpTransport, ok := transport.(*http.Transport)
+	if !ok {
+		return errors.New("failed to set the CA certificates of the HTTP client")
 	}
+	if httpTransport.TLSClientConfig == nil {
+		httpTransport.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	httpTransport.TLSClientConfig.RootCAs = roots
 
-	// Create a fixed-size array to hold the public key data
-	var publicKeyData [32]byte
-	b := []byte(config.PublicKey)
-	copy(publicKeyData[:], b)
+	return nil
+}
 
-	// Open or create a file named "key-from-oidc.pub.pem" in write-only mode with file permissions 0600
-	pubFile, err := os.OpenFile(filepath.Clean("key-from-oidc.pub.pem"), os.O_WRONLY|os.O_CREATE, 0600)
+// loadCACert returns the system's CA certificates together with the CA
+// certificates in the PEM file at path
+func loadCACert(path string) (*x509.CertPool, error) {
+	pemData, err := os.ReadFile(filepath.Clean(path))
 	if err != nil {
-		return "", fmt.Errorf("failed to open or create the public key file: %w", err)
+		return nil, WithCategory(ErrConfig, fmt.Errorf("failed to read the CA certificate, reason: %w", err))
 	}
-	defer func() {
-		// Close the file and log any error that may occur
-		if cerr := pubFile.Close(); cerr != nil {
-			log.Errorf("Error closing file: %s\n", cerr)
-		}
-	}()
 
-	// Write the publicKeyData array to the "key-from-oidc.pub.pem" file in Crypt4GHX25519 public key format
-	err = keys.WriteCrypt4GHX25519PublicKey(pubFile, publicKeyData)
+	roots, err := x509.SystemCertPool()
 	if err != nil {
-		return "", fmt.Errorf("failed to write the public key data: %w", err)
+		roots = x509.NewCertPool()
+	}
+	if !roots.AppendCertsFromPEM(pemData) {
+		return nil, WithCategory(ErrConfig, fmt.Errorf("no CA certificates found in %s", path))
 	}
+	log.Debugf("Using the CA certificates in %s", path)
 
-	// If everything is successful, return the name of the generated public key file
-	return "key-from-oidc.pub.pem", nil
+	return roots, nil
 }
 
-// CheckTokenExpiration is used to determine whether the token is expiring in less than a day
-func CheckTokenExpiration(accessToken string) (bool, error) {
+// AWSLogLevel returns the log level for the sessions of the AWS SDK
+func AWSLogLevel() *aws.LogLevelType {
+	if awsDebug {
+		return aws.LogLevel(aws.LogDebug | aws.LogDebugWithRequestRetries | aws.LogDebugWithRequestErrors)
+	}
 
-	// Parse jwt token with unverifies, since we don't need to check the signatures here
-	token, _, err := new(jwt.Parser).ParseUnverified(accessToken, jwt.MapClaims{})
+	return aws.LogLevel(aws.LogOff)
+}
+
+// ProfilesPath returns the path of the file with the named profiles,
+// ~/.sda-cli/config
+func ProfilesPath() (string, error) {
+	home, err := os.UserHomeDir()
 	if err != nil {
-		return false, fmt.Errorf("could not parse token, reason: %s", err)
+		return "", fmt.Errorf("failed to find home directory, reason: %w", err)
 	}
 
-	var expiration time.Time
-	if claims, ok := token.Claims.(jwt.MapClaims); ok {
-		// Check if the token has exp claim
-		if claims["exp"] == nil {
-			return false, fmt.Errorf("could not parse token, reason: no expiration date")
-		}
-		switch iat := claims["exp"].(type) {
-		case float64:
-			expiration = time.Unix(int64(iat), 0)
-		case json.Number:
-			tmp, _ := iat.Int64()
-			expiration = time.Unix(tmp, 0)
+	return filepath.Join(home, ".sda-cli", "config"), nil
+}
+
+// SessionPath returns the path of the session file written by login,
+// $XDG_CONFIG_HOME/sda-cli/session, or ~/.config/sda-cli/session if
+// XDG_CONFIG_HOME is not set
+func SessionPath() (string, error) {
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("failed to find home directory, reason: %w", err)
 		}
-	} else {
-		return false, fmt.Errorf("broken token (claims are empty): %v\nerror: %s", claims, err)
+		configHome = filepath.Join(home, ".config")
 	}
 
-	tomorrow := time.Now().AddDate(0, 0, 1)
-
-	return tomorrow.After(expiration), nil
+	return filepath.Join(configHome, "sda-cli", "session"), nil
 }
 
-func ListFiles(config Config, prefix string) (result *s3.ListObjectsV2Output, err error) {
-	sess := session.Must(session.NewSession(&aws.Config{
-		// The region for the backend is always the specified one
-		// and not present in the configuration from auth - hardcoded
-		Region:           aws.String("us-west-2"),
-		Credentials:      credentials.NewStaticCredentials(config.AccessKey, config.AccessKey, config.AccessToken),
-		Endpoint:         aws.String(config.HostBase),
+// FindSessionFile returns the path of the session file of a previous login.
+// If there is none in the config directory, the .sda-cli-session file in the
+// current directory, where older versions stored the session, is used instead
+// with a deprecation notice.
+func FindSessionFile() (string, error) {
+	sessionPath, err := SessionPath()
+	if err != nil {
+		return "", err
+	}
+	if FileExists(sessionPath) {
+		return sessionPath, nil
+	}
+	if FileExists(".sda-cli-session") {
+		fmt.Fprintf(os.Stderr, "Using .sda-cli-session in the current directory, which is deprecated.\n"+
+			"Log in again to store the session in %s\n", sessionPath)
+
+		return ".sda-cli-session", nil
+	}
+
+	return "", fmt.Errorf("configuration file (%s) not found", sessionPath)
+}
+
+// isSessionFile returns true if the file at path is the session file written
+// by login, in the config directory or in the current directory as by older
+// versions
+func isSessionFile(path string) bool {
+	if filepath.Base(path) == ".sda-cli-session" {
+		return true
+	}
+	sessionPath, err := SessionPath()
+
+	return err == nil && filepath.Clean(path) == sessionPath
+}
+
+// LoadConfigFile loads ini configuration file to the Config struct, see
+// ReadConfigFile, and checks its fields with ValidateConfig, so that the
+// commands can use the configuration without checking it again.
+func LoadConfigFile(path, profile string) (*Config, error) {
+	log.Debugf("Loading configuration from %s, profile: %q", path, profile)
+
+	config, err := ReadConfigFile(path, profile)
+	if err != nil {
+		return config, err
+	}
+
+	if errs := ValidateConfig(config); len(errs) > 0 {
+		return nil, invalidConfigError{source: "configuration file", errs: errs}
+	}
+	// Earlier versions of login wrote check_ssl_certificate = False and
+	// check_ssl_hostname = False to every session file, so the settings are
+	// not honoured in session files, where only -insecure disables the
+	// verification
+	if isSessionFile(path) && (!config.CheckSslCertificate || !config.CheckSslHostname) {
+		log.Debugf("Ignoring the disabled TLS verification in the session file %s", path)
+		config.CheckSslCertificate = true
+		config.CheckSslHostname = true
+	}
+	setConfigDefaults(config)
+	log.Debugf("Using the access key %s and the access token %s for %s", config.AccessKey, TruncateKey(config.AccessToken, 10), config.HostBase)
+
+	return config, nil
+}
+
+// setConfigDefaults adds the scheme to the host if the configuration uses
+// https, and sets the default values of the unset optional fields
+func setConfigDefaults(config *Config) {
+	if config.UseHTTPS {
+		config.HostBase = "https://" + config.HostBase
+	}
+
+	if config.Encoding == "" {
+		config.Encoding = "UTF-8"
+	}
+
+	// Where 15 is the default chunk size of the library
+	if config.MultipartChunkSizeMb <= 15 {
+		config.MultipartChunkSizeMb = 15
+	}
+}
+
+// ConfigFromEnvironment returns a configuration with the credentials in the
+// standard AWS environment variables, AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY
+// and AWS_SESSION_TOKEN, which holds the access token, and the host in
+// SDA_CLI_HOST_BASE. A host without a scheme uses https. It returns false if
+// AWS_ACCESS_KEY_ID is not set.
+func ConfigFromEnvironment() (*Config, bool, error) {
+	accessKey := os.Getenv("AWS_ACCESS_KEY_ID")
+	if accessKey == "" {
+		return nil, false, nil
+	}
+	log.Debug("Using the credentials in the AWS environment variables")
+
+	hostBase := os.Getenv("SDA_CLI_HOST_BASE")
+	config := &Config{
+		AccessKey:           accessKey,
+		SecretKey:           os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		AccessToken:         os.Getenv("AWS_SESSION_TOKEN"),
+		HostBase:            hostBase,
+		UseHTTPS:            hostBase != "" && !strings.Contains(hostBase, "://"),
+		CheckSslCertificate: true,
+		CheckSslHostname:    true,
+		HumanReadableSizes:  true,
+	}
+	if errs := ValidateConfig(config); len(errs) > 0 {
+		return nil, true, invalidConfigError{source: "AWS environment variables", errs: errs}
+	}
+	setConfigDefaults(config)
+
+	return config, true, nil
+}
+
+// maxMultipartChunkSizeMb is the largest multipart_chunk_size_mb, which is the
+// largest part size of S3 multipart uploads. Smaller chunk sizes than the
+// smallest part size are raised to the default when the configuration is
+// loaded, see setConfigDefaults.
+const maxMultipartChunkSizeMb = 5 * 1024
+
+// encodingPattern matches the names of character encodings, like UTF-8, which
+// are sent as the content encoding of the uploaded files
+var encodingPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._:-]*$`)
+
+// ValidateConfig checks the fields of the configuration that the commands
+// need to connect to the archive, and returns an error for every field that
+// is missing or invalid. Unset optional fields are valid, since they get
+// default values when the configuration is loaded, as are chunk sizes that are
+// too small, which are raised to the default.
+func ValidateConfig(c *Config) []error {
+	var errs []error
+	if c.AccessKey == "" {
+		errs = append(errs, errors.New("access_key is missing"))
+	}
+	if c.AccessToken == "" {
+		errs = append(errs, errors.New("access_token is missing"))
+	}
+	if c.HostBase == "" {
+		errs = append(errs, errors.New("host_base is missing"))
+	} else if err := ValidateHostBase(c.HostBase, c.UseHTTPS); err != nil {
+		errs = append(errs, fmt.Errorf("host_base is invalid, %w", err))
+	}
+	if c.MultipartChunkSizeMb > maxMultipartChunkSizeMb {
+		errs = append(errs, fmt.Errorf("multipart_chunk_size_mb must be at most %d, not %d", maxMultipartChunkSizeMb, c.MultipartChunkSizeMb))
+	}
+	if c.Encoding != "" && !encodingPattern.MatchString(c.Encoding) {
+		errs = append(errs, fmt.Errorf("encoding %q is not a valid character encoding name", c.Encoding))
+	}
+	if c.SocketTimeout < 0 {
+		errs = append(errs, fmt.Errorf("socket_timeout must not be negative, not %d", c.SocketTimeout))
+	}
+
+	return errs
+}
+
+// ValidateHostBase checks that the host, which may be given without a scheme
+// as in s3cmd configuration files, is a valid http(s) URL
+func ValidateHostBase(hostBase string, useHTTPS bool) error {
+	host := hostBase
+	if useHTTPS || !strings.Contains(host, "://") {
+		host = "https://" + host
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%s is not a valid URL", hostBase)
+	}
+
+	return nil
+}
+
+// invalidConfigError is returned by LoadConfigFile and ConfigFromEnvironment
+// with the errors of ValidateConfig
+type invalidConfigError struct {
+	source string
+	errs   []error
+}
+
+func (e invalidConfigError) Error() string {
+	problems := make([]string, len(e.errs))
+	for i, err := range e.errs {
+		problems[i] = err.Error()
+	}
+
+	return "invalid " + e.source + ": " + strings.Join(problems, ", ")
+}
+
+func (e invalidConfigError) Unwrap() []error {
+	return e.errs
+}
+
+// ReadConfigFile reads ini configuration file to the Config struct, without
+// checking the values. If a profile, or a remote with the global -remote flag,
+// is given, the configuration is read from the section with that name,
+// otherwise from the first section of the file.
+func ReadConfigFile(path, profile string) (*Config, error) {
+	// TLS verification is enabled unless the file disables it, as in s3cmd,
+	// and sizes are shown in human readable form unless the file disables it
+	config := &Config{CheckSslCertificate: true, CheckSslHostname: true, HumanReadableSizes: true}
+
+	cfg, err := ini.Load(path)
+	if err != nil {
+		return config, err
+	}
+
+	// ini sees a DEFAULT section by default
+	var iniSection string
+	if len(cfg.SectionStrings()) > 1 {
+		iniSection = cfg.SectionStrings()[1]
+	} else {
+		iniSection = cfg.SectionStrings()[0]
+	}
+	profile = profileOrRemote(profile)
+	if profile != "" {
+		if !cfg.HasSection(profile) {
+			return nil, fmt.Errorf("profile %s not found in %s", profile, path)
+		}
+		iniSection = profile
+	}
+
+	if err := cfg.Section(iniSection).MapTo(config); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// ConfigPath is the configuration file given with the global -config flag,
+// which is used by all commands unless they are given a file of their own
+var ConfigPath string
+
+// Remote is the named profile given with the global -remote flag, which is
+// used by all commands unless they are given a profile of their own
+var Remote string
+
+// profileOrRemote returns the profile, or the remote given with the global
+// -remote flag if no profile is given
+func profileOrRemote(profile string) string {
+	if profile == "" {
+		return Remote
+	}
+
+	return profile
+}
+
+// FindConfigFile returns the configuration file to use, which is the first of
+// the given path, the file given with the global -config flag, the file in the
+// SDA_CLI_CONFIG environment variable, ~/.sda-cli/config if a profile or a
+// remote is given, or else the session file of a previous login.
+func FindConfigFile(path, profile string) (string, error) {
+	switch {
+	case path != "":
+		return path, nil
+	case ConfigPath != "":
+		return ConfigPath, nil
+	case os.Getenv("SDA_CLI_CONFIG") != "":
+		return os.Getenv("SDA_CLI_CONFIG"), nil
+	case profileOrRemote(profile) != "":
+		return ProfilesPath()
+	default:
+		return FindSessionFile()
+	}
+}
+
+// GetAuth calls LoadConfig with the configuration file to use, see
+// FindConfigFile, and the profile to read from it if one is given. If no
+// configuration file is found, the credentials in the AWS environment
+// variables are used instead, see ConfigFromEnvironment, or else the profile
+// chosen by the user if there are several in ~/.sda-cli/config.
+func GetAuth(path, profile string) (*Config, error) {
+
+	configPath, findErr := FindConfigFile(path, profile)
+	if findErr != nil {
+		config, found, envErr := ConfigFromEnvironment()
+		switch {
+		case envErr != nil:
+			return nil, WithCategory(ErrConfig, envErr)
+		case found:
+			return config, nil
+		}
+
+		// Without a session, one of several profiles can be chosen
+		var err error
+		configPath, profile, err = selectProfile()
+		if err != nil {
+			return nil, err
+		}
+		if configPath == "" {
+			return nil, WithCategory(ErrConfig, fmt.Errorf("failed to read the configuration file, reason: %w", findErr))
+		}
+	}
+
+	config, err := LoadConfigFile(configPath, profile)
+	if err != nil {
+		return nil, WithCategory(ErrConfig, err)
+	}
+
+	return config, nil
+}
+
+// selectProfile lets the user choose one of the profiles in ~/.sda-cli/config,
+// if there are several and stdin is a terminal, and returns the path of the
+// file and the chosen profile. The path is empty if there is nothing to choose.
+func selectProfile() (string, string, error) {
+	if !IsTerminal(os.Stdin) {
+		return "", "", nil
+	}
+	profilesPath, err := ProfilesPath()
+	if err != nil {
+		return "", "", nil
+	}
+	profiles := profileNames(profilesPath)
+	if len(profiles) < 2 {
+		return "", "", nil
+	}
+
+	profile, err := PromptSelect("Choose a profile", profiles)
+	if err != nil {
+		return "", "", err
+	}
+
+	return profilesPath, profile, nil
+}
+
+// profileNames returns the names of the profiles in the file at path, which
+// are none if the file cannot be read
+func profileNames(path string) []string {
+	cfg, err := ini.Load(path)
+	if err != nil {
+		return nil
+	}
+
+	var names []string
+	for _, name := range cfg.SectionStrings() {
+		if name != ini.DefaultSection {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// PublicKeyFile is the key file that GetPublicKey writes the public key from
+// the configuration to
+const PublicKeyFile = "key-from-oidc.pub.pem"
+
+// GetPublicKey writes the public key from the configuration, see
+// FindConfigFile, to a key file and returns its name. If the public key in the
+// configuration is a https URL, the key is downloaded from it instead.
+func GetPublicKey(profile string) (string, error) {
+	path, err := FindConfigFile("", profile)
+	if err != nil {
+		return "", WithCategory(ErrConfig, err)
+	}
+	// Check if the configuration file exists
+	if !FileExists(path) {
+		return "", WithCategory(ErrConfig, fmt.Errorf("configuration file (%s) not found", path))
+	}
+
+	// Load the configuration file
+	config, err := LoadConfigFile(path, profile)
+	if err != nil {
+		return "", WithCategory(ErrConfig, fmt.Errorf("failed to load configuration file: %w", err))
+	}
+
+	return ConfigPublicKey(config)
+}
+
+// ConfigPublicKey writes the public key in the configuration to a key file, or
+// downloads it if it is a https URL, and returns the name of the key file.
+func ConfigPublicKey(config *Config) (string, error) {
+	// Check if the PublicKey field is present in the config
+	if config.PublicKey == "" {
+		return "", WithCategory(ErrConfig, errors.New("public key not found in the configuration"))
+	}
+
+	// The key is downloaded with the client of the S3 sessions, so that the
+	// CA certificates, the TLS settings, the proxy and the timeout of the
+	// configuration are used for it as well
+	if strings.HasPrefix(config.PublicKey, "https://") {
+		client, err := s3HTTPClient(*config)
+		if err != nil {
+			return "", err
+		}
+
+		return fetchPublicKey(client, config.PublicKey)
+	}
+
+	// Create a fixed-size array to hold the public key data
+	var publicKeyData [32]byte
+	b := []byte(config.PublicKey)
+	copy(publicKeyData[:], b)
+
+	// Open or create a file named "key-from-oidc.pub.pem" in write-only mode with file permissions 0600
+	pubFile, err := os.OpenFile(filepath.Clean(PublicKeyFile), os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return "", fmt.Errorf("failed to open or create the public key file: %w", err)
+	}
+	defer func() {
+		// Close the file and log any error that may occur
+		if cerr := pubFile.Close(); cerr != nil {
+			log.Errorf("Error closing file: %s\n", cerr)
+		}
+	}()
+
+	// Write the publicKeyData array to the "key-from-oidc.pub.pem" file in Crypt4GHX25519 public key format
+	err = keys.WriteCrypt4GHX25519PublicKey(pubFile, publicKeyData)
+	if err != nil {
+		return "", fmt.Errorf("failed to write the public key data: %w", err)
+	}
+
+	// If everything is successful, return the name of the generated public key file
+	return PublicKeyFile, nil
+}
+
+// fetchPublicKey downloads the crypt4gh public key at keyURL, checks that it
+// is a valid key, and saves it to PublicKeyFile, whose name is returned.
+func fetchPublicKey(client *http.Client, keyURL string) (string, error) {
+	log.Debugf("Downloading the public key from %s", keyURL)
+
+	resp, err := client.Get(keyURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to download the public key: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", WithCategory(ErrNetwork, fmt.Errorf("failed to download the public key from %s, server returned status %s", keyURL, resp.Status))
+	}
+
+	// A public key file is a few lines, anything much larger is not a key
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return "", fmt.Errorf("failed to download the public key: %w", err)
+	}
+
+	err = checkPublicKey(body)
+	if err != nil {
+		return "", WithCategory(ErrCrypto, fmt.Errorf("the file at %s is not a valid crypt4gh public key: %w", keyURL, err))
+	}
+
+	err = os.WriteFile(filepath.Clean(PublicKeyFile), body, 0600)
+	if err != nil {
+		return "", fmt.Errorf("failed to write the public key data: %w", err)
+	}
+
+	return PublicKeyFile, nil
+}
+
+// checkPublicKey returns an error if data is not a crypt4gh public key. Since
+// keys.ReadPublicKey panics if the key is malformed, the panic is returned as
+// an error.
+func checkPublicKey(data []byte) (err error) {
+	defer func() {
+		if recover() != nil {
+			err = errors.New("malformed key file")
+		}
+	}()
+
+	_, err = keys.ReadPublicKey(bytes.NewReader(data))
+
+	return err
+}
+
+// CheckTokenExpiration is used to determine whether the token is expiring in less than a day
+func CheckTokenExpiration(accessToken string) (bool, error) {
+	remaining, err := TokenTimeRemaining(accessToken)
+	if err != nil {
+		log.Debugf("Could not read the expiration of the token %s", TruncateKey(accessToken, 10))
+
+		return false, err
+	}
+	if remaining > 0 {
+		log.Debugf("The token %s expires in %s", TruncateKey(accessToken, 10), FormatTimeRemaining(remaining))
+	} else {
+		log.Debugf("The token %s has expired", TruncateKey(accessToken, 10))
+	}
+
+	return remaining < 24*time.Hour, nil
+}
+
+// TruncateKey returns the first visible characters of a secret, like an
+// access token, followed by ***, so that it can be logged without revealing
+// it. Secrets that are not longer than visible are hidden completely.
+func TruncateKey(s string, visible int) string {
+	runes := []rune(s)
+	switch {
+	case len(runes) == 0:
+		return ""
+	case visible <= 0, len(runes) <= visible:
+		return "***"
+	default:
+		return string(runes[:visible]) + "***"
+	}
+}
+
+// TokenTimeRemaining returns the time until the token expires, which is
+// negative if the token has expired
+func TokenTimeRemaining(accessToken string) (time.Duration, error) {
+	expiration, err := TokenExpiration(accessToken)
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Until(expiration), nil
+}
+
+// FormatTimeRemaining formats the time until a token expires like "2h 34m",
+// with days for longer times, like "3d 4h", and "less than a minute" for
+// shorter times. A token without any time remaining is "expired".
+func FormatTimeRemaining(d time.Duration) string {
+	switch {
+	case d <= 0:
+		return "expired"
+	case d >= 24*time.Hour:
+		return fmt.Sprintf("%dd %dh", d/(24*time.Hour), d%(24*time.Hour)/time.Hour)
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh %dm", d/time.Hour, d%time.Hour/time.Minute)
+	case d >= time.Minute:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	default:
+		return "less than a minute"
+	}
+}
+
+// TokenExpiration returns the expiration time in the exp claim of a token
+func TokenExpiration(accessToken string) (time.Time, error) {
+
+	// Parse jwt token with unverifies, since we don't need to check the signatures here
+	token, _, err := new(jwt.Parser).ParseUnverified(accessToken, jwt.MapClaims{})
+	if err != nil {
+		return time.Time{}, fmt.Errorf("could not parse token, reason: %s", err)
+	}
+
+	var expiration time.Time
+	if claims, ok := token.Claims.(jwt.MapClaims); ok {
+		// Check if the token has exp claim
+		if claims["exp"] == nil {
+			return time.Time{}, fmt.Errorf("could not parse token, reason: no expiration date")
+		}
+		switch iat := claims["exp"].(type) {
+		case float64:
+			expiration = time.Unix(int64(iat), 0)
+		case json.Number:
+			tmp, _ := iat.Int64()
+			expiration = time.Unix(tmp, 0)
+		}
+	} else {
+		return time.Time{}, fmt.Errorf("broken token (claims are empty): %v\nerror: %s", claims, err)
+	}
+
+	return expiration, nil
+}
+
+// Exit codes for the different categories of errors, so that scripts can
+// handle specific failures
+const (
+	ExitError        = 1
+	ExitConfigError  = 2
+	ExitNetworkError = 3
+	ExitCryptoError  = 4
+	ExitIOError      = 5
+)
+
+// Sentinel errors for the categories of errors that can not be told from the
+// type of the error
+var (
+	ErrConfig  = errors.New("configuration error")
+	ErrNetwork = errors.New("network error")
+	ErrCrypto  = errors.New("crypt4gh error")
+	ErrIO      = errors.New("io error")
+)
+
+// categoryError is an error marked with a category, with the message of the
+// error itself
+type categoryError struct {
+	category error
+	err      error
+}
+
+func (e categoryError) Error() string {
+	return e.err.Error()
+}
+
+func (e categoryError) Unwrap() []error {
+	return []error{e.category, e.err}
+}
+
+// WithCategory marks err with one of the category errors, ErrConfig,
+// ErrNetwork, ErrCrypto or ErrIO, without changing its message
+func WithCategory(category, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return categoryError{category: category, err: err}
+}
+
+// ExitCode returns the exit code for an error, from the category it is marked
+// with, or else from the type of the errors it wraps
+func ExitCode(err error) int {
+	var netErr net.Error
+	var awsErr awserr.Error
+	var pathErr *fs.PathError
+	var linkErr *os.LinkError
+
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, ErrConfig):
+		return ExitConfigError
+	case errors.Is(err, ErrNetwork):
+		return ExitNetworkError
+	case errors.Is(err, ErrCrypto):
+		return ExitCryptoError
+	case errors.Is(err, ErrIO):
+		return ExitIOError
+	// Checked before net.Error, which the syscall errors of a failed file
+	// operation also implement
+	case errors.As(err, &pathErr), errors.As(err, &linkErr):
+		return ExitIOError
+	case errors.As(err, &netErr), errors.As(err, &awsErr):
+		return ExitNetworkError
+	default:
+		return ExitError
+	}
+}
+
+// jsonError is the error printed by PrintJSONError
+type jsonError struct {
+	Error string `json:"error"`
+	Code  int    `json:"code"`
+}
+
+// PrintJSONError writes err to w as a JSON object with the error message and
+// the exit code of the error, for tools that parse the errors.
+func PrintJSONError(w io.Writer, err error) {
+	// Marshalling a struct of a string and an int can not fail
+	out, _ := json.Marshal(jsonError{Error: err.Error(), Code: ExitCode(err)})
+	fmt.Fprintln(w, string(out))
+}
+
+// WarnTokenExpiration prints a warning to stderr if the access token in the
+// configuration expires in less than a day. If the configuration has a
+// refresh token, the user is told how to refresh the access token.
+func WarnTokenExpiration(config *Config) error {
+	remaining, err := TokenTimeRemaining(config.AccessToken)
+	if err != nil {
+		return err
+	}
+	if remaining < 24*time.Hour {
+		if remaining > 0 {
+			fmt.Fprintf(os.Stderr, "The provided token expires in %s\n", FormatTimeRemaining(remaining))
+		} else {
+			fmt.Fprintln(os.Stderr, "The provided token has expired")
+		}
+		if config.RefreshToken != "" {
+			fmt.Fprintln(os.Stderr, "Refresh the token with: sda-cli login -refresh <login-target>")
+		} else {
+			fmt.Fprintln(os.Stderr, "Consider renewing the token.")
+		}
+	}
+
+	return nil
+}
+
+// Insecure disables the TLS certificate verification of the S3 connections,
+// set by the global -insecure flag
+var Insecure bool
+
+// DefaultSocketTimeout is the socket timeout of the S3 connections when the
+// configuration does not have a socket_timeout
+const DefaultSocketTimeout = 30 * time.Second
+
+// Timeout overrides the socket_timeout of the configuration, set by the
+// global -timeout flag
+var Timeout time.Duration
+
+// s3ClientKey is the TLS settings and the socket timeout of an S3 HTTP client
+type s3ClientKey struct {
+	cert, key, caCert          string
+	skipVerify, skipVerifyHost bool
+	timeout                    time.Duration
+}
+
+// s3Client is the HTTP client of the S3 sessions, which is shared by all
+// sessions with the same TLS settings
+var s3Client struct {
+	sync.Mutex
+	key    s3ClientKey
+	client *http.Client
+}
+
+// S3Region is the region of the S3 sessions. The region for the backend is
+// always the specified one and not present in the configuration from auth.
+const S3Region = "us-west-2"
+
+// NewS3Session returns a session for the S3 inbox in the configuration, which
+// all commands use for their S3 requests. The session has the credentials, the
+// socket timeout, the TLS settings and the proxy of the configuration and the
+// global flags. If the configuration has a TLS client certificate, it is used
+// for all requests.
+func NewS3Session(config *Config) (*session.Session, error) {
+	client, err := s3HTTPClient(*config)
+	if err != nil {
+		return nil, err
+	}
+
+	return session.NewSession(&aws.Config{
+		Region:           aws.String(S3Region),
+		Credentials:      credentials.NewStaticCredentials(config.AccessKey, config.AccessKey, config.AccessToken),
+		Endpoint:         aws.String(config.HostBase),
 		DisableSSL:       aws.Bool(!config.UseHTTPS),
 		S3ForcePathStyle: aws.Bool(true),
-	}))
+		LogLevel:         AWSLogLevel(),
+		HTTPClient:       client,
+	})
+}
+
+// s3HTTPClient returns the HTTP client for the S3 sessions, with the socket
+// timeout, the TLS client certificate, the CA certificates and the TLS
+// verification settings of the configuration. The client keeps the proxy and
+// the debug logging of the default client.
+func s3HTTPClient(config Config) (*http.Client, error) {
+	if (config.TLSCert == "") != (config.TLSKey == "") {
+		return nil, WithCategory(ErrConfig, errors.New("both tls_cert and tls_key must be given for TLS client authentication"))
+	}
+
+	// TLS verification only matters for https connections
+	https := config.UseHTTPS || strings.HasPrefix(config.HostBase, "https://")
+	key := s3ClientKey{
+		cert:           config.TLSCert,
+		key:            config.TLSKey,
+		caCert:         config.CACert,
+		skipVerify:     https && (Insecure || !config.CheckSslCertificate),
+		skipVerifyHost: https && !config.CheckSslHostname,
+		timeout:        SocketTimeout(config),
+	}
+
+	s3Client.Lock()
+	defer s3Client.Unlock()
+	if s3Client.client != nil && s3Client.key == key {
+		return s3Client.client, nil
+	}
+
+	transport := http.DefaultTransport
+	debug, debugging := transport.(debugTransport)
+	if debugging {
+		transport = debug.next
+	}
+	httpTransport, ok := transport.(*http.Transport)
+	if !ok {
+		return nil, errors.New("failed to set the TLS settings of the HTTP client")
+	}
+	httpTransport = httpTransport.Clone()
+	setSocketTimeout(httpTransport, key.timeout)
+	if httpTransport.TLSClientConfig == nil {
+		httpTransport.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	tlsConfig := httpTransport.TLSClientConfig
+
+	if key.cert != "" {
+		certificate, err := tls.LoadX509KeyPair(key.cert, key.key)
+		if err != nil {
+			return nil, WithCategory(ErrConfig, fmt.Errorf("failed to load the TLS client certificate, reason: %w", err))
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+		log.Debugf("Using the TLS client certificate %s", key.cert)
+	}
+
+	if key.caCert != "" {
+		roots, err := loadCACert(key.caCert)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = roots
+	}
+
+	switch {
+	case key.skipVerify:
+		tlsConfig.InsecureSkipVerify = true // #nosec G402 -- disabled on request, with a warning
+		fmt.Fprintln(os.Stderr, "WARNING: TLS certificate verification is disabled, the connection to the archive is not secure.")
+		if !Insecure {
+			fmt.Fprintln(os.Stderr, "It is disabled by check_ssl_certificate = False in the configuration.")
+		}
+	case key.skipVerifyHost:
+		// Verify the certificate chain, but not that it is for the host
+		tlsConfig.InsecureSkipVerify = true // #nosec G402 -- the chain is verified below
+		tlsConfig.VerifyConnection = verifyCertificateChain(tlsConfig.RootCAs)
+		fmt.Fprintln(os.Stderr, "WARNING: TLS hostname verification is disabled by check_ssl_hostname = False in the configuration.")
+	}
+
+	var roundTripper http.RoundTripper = httpTransport
+	if debugging {
+		roundTripper = debugTransport{next: httpTransport}
+	}
+	s3Client.key = key
+	s3Client.client = &http.Client{Transport: roundTripper}
+
+	return s3Client.client, nil
+}
+
+// SocketTimeout returns the socket timeout of the S3 connections, which is
+// the -timeout flag, the socket_timeout of the configuration, or else
+// DefaultSocketTimeout
+func SocketTimeout(config Config) time.Duration {
+	switch {
+	case Timeout > 0:
+		return Timeout
+	case config.SocketTimeout > 0:
+		return time.Duration(config.SocketTimeout) * time.Second
+	}
+
+	return DefaultSocketTimeout
+}
+
+// timeoutConn is a connection on which a read or write fails if it makes no
+// progress within the timeout. Unlike a timeout of the whole request, large
+// transfers are not cut off as long as data is moving.
+type timeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *timeoutConn) Read(b []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+
+	return c.Conn.Read(b)
+}
+
+func (c *timeoutConn) Write(b []byte) (int, error) {
+	if err := c.Conn.SetWriteDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+
+	return c.Conn.Write(b)
+}
+
+// setSocketTimeout makes the connections of the transport time out when
+// connecting, reading or writing takes longer than timeout
+func setSocketTimeout(transport *http.Transport, timeout time.Duration) {
+	dialer := &net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+
+		return &timeoutConn{Conn: conn, timeout: timeout}, nil
+	}
+	transport.TLSHandshakeTimeout = timeout
+}
+
+// SetTimeout sets the socket timeout of the S3 connections, overriding the
+// socket_timeout of the configuration, and of the default HTTP client, which
+// is used for the downloads and the OIDC connections. The timeout is a
+// duration such as "90s", and the defaults are kept if it is empty.
+func SetTimeout(timeout string) error {
+	if timeout == "" {
+		return nil
+	}
+	duration, err := time.ParseDuration(timeout)
+	if err != nil || duration <= 0 {
+		return WithCategory(ErrConfig, fmt.Errorf("invalid timeout: %s", timeout))
+	}
+	Timeout = duration
+
+	transport := http.DefaultTransport
+	if debug, ok := transport.(debugTransport); ok {
+		transport = debug.next
+	}
+	httpTransport, ok := transport.(*http.Transport)
+	if !ok {
+		return errors.New("failed to set the timeout of the HTTP client")
+	}
+	setSocketTimeout(httpTransport, duration)
+
+	return nil
+}
+
+// verifyCertificateChain returns a function that verifies the certificate
+// chain of a TLS connection against roots, or the system roots if nil, without
+// checking the hostname.
+func verifyCertificateChain(roots *x509.CertPool) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return errors.New("the server did not send a certificate")
+		}
+		intermediates := x509.NewCertPool()
+		for _, cert := range state.PeerCertificates[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates})
+
+		return err
+	}
+}
+
+// ListFiles lists the files under prefix in the given bucket, which is the
+// user's folder (config.AccessKey) or a dataset. Unless recursive is set, only
+// the files directly under prefix are listed, while deeper files are grouped
+// into folders, returned as common prefixes. All pages of the listing are
+// returned, so it is not limited to the first 1000 objects.
+func ListFiles(config Config, bucket, prefix string, recursive bool) (result *s3.ListObjectsV2Output, err error) {
+	sess, err := NewS3Session(&config)
+	if err != nil {
+		return nil, err
+	}
 
 	svc := s3.New(sess)
 
-	result, err = svc.ListObjectsV2(&s3.ListObjectsV2Input{
-		Bucket: aws.String(config.AccessKey + "/"),
-		Prefix: aws.String(config.AccessKey + "/" + prefix),
-	})
+	// The objects are listed in pages of at most 1000 objects, which are
+	// combined into one result
+	result = &s3.ListObjectsV2Output{}
+	err = svc.ListObjectsV2Pages(listObjectsInput(bucket, prefix, recursive), func(page *s3.ListObjectsV2Output, _ bool) bool {
+		result.Contents = append(result.Contents, page.Contents...)
+		result.CommonPrefixes = append(result.CommonPrefixes, page.CommonPrefixes...)
 
+		return true
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to list objects, reason: %v", err)
+		return nil, fmt.Errorf("failed to list objects, reason: %w", err)
 	}
 
 	return result, nil
 }
+
+// listObjectsInput returns the request to list the files under prefix in the
+// bucket, see ListFiles
+func listObjectsInput(bucket, prefix string, recursive bool) *s3.ListObjectsV2Input {
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket + "/"),
+		Prefix: aws.String(bucket + "/" + prefix),
+	}
+	if !recursive {
+		input.Delimiter = aws.String("/")
+	}
+
+	return input
+}
+
+// FileChecksums reads the file once and returns the ETag the file would get
+// when uploaded to S3, together with the sha256 checksum of the file. If
+// partSize is zero, the ETag of a regular upload is returned, otherwise the
+// ETag of a multipart upload with parts of partSize bytes.
+func FileChecksums(f *os.File, partSize int64) (string, string, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", "", err
+	}
+
+	shaHash := sha256.New()
+	if partSize == 0 {
+		md5Hash := md5.New()
+		if _, err := io.Copy(io.MultiWriter(md5Hash, shaHash), f); err != nil {
+			return "", "", err
+		}
+
+		return hex.EncodeToString(md5Hash.Sum(nil)), hex.EncodeToString(shaHash.Sum(nil)), nil
+	}
+
+	var partSums []byte
+	parts := 0
+	for {
+		partHash := md5.New()
+		n, err := io.Copy(io.MultiWriter(partHash, shaHash), io.LimitReader(f, partSize))
+		if err != nil {
+			return "", "", err
+		}
+		// Empty files are uploaded as one empty part
+		if n == 0 && parts > 0 {
+			break
+		}
+		partSums = append(partSums, partHash.Sum(nil)...)
+		parts++
+		if n < partSize {
+			break
+		}
+	}
+	etag := md5.Sum(partSums)
+
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(etag[:]), parts), hex.EncodeToString(shaHash.Sum(nil)), nil
+}
+
+// ManifestEntry describes a file that has been uploaded to the archive
+type ManifestEntry struct {
+	LocalPath  string    `json:"local_path"`
+	Key        string    `json:"key"`
+	Location   string    `json:"location"`
+	Size       int64     `json:"size"`
+	SHA256     string    `json:"sha256"`
+	UploadedAt time.Time `json:"uploaded_at"`
+}
+
+// Manifest lists the files uploaded in one run of the upload command, so
+// that they can be verified or downloaded again later
+type Manifest struct {
+	Files []ManifestEntry `json:"files"`
+}
+
+// ReadManifest reads a manifest file written by the upload command
+func ReadManifest(path string) (*Manifest, error) {
+	data, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest file, reason: %w", err)
+	}
+
+	manifest := &Manifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest file %s, reason: %v", path, err)
+	}
+
+	return manifest, nil
+}
+
+// Write writes the manifest as indented json to path
+func (m *Manifest) Write(path string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, append(data, '\n'), 0600)
+}
@@ -1,15 +1,21 @@
 package list
 
 import (
+	"encoding/csv"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-
+	"io"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/NBISweden/sda-cli/helpers"
-	"github.com/inhies/go-bytesize"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
 )
 
 // Help text and command line flags.
@@ -17,13 +23,25 @@ import (
 // Usage text that will be displayed as command line help text when using the
 // `help list` command
 var Usage = `
-USAGE: %s list [-config <s3config-file>] [prefix]
+USAGE: %s list [-config <s3config-file>] [-profile <name>] [-dataset <dataset-id>] [-r] [-h | -bytes] [-format <text|json|csv>] [-sort <order>] [-no-summary] [-ext <extension(s)>] [-after <date>] [-before <date>] [prefix]
 
 list:
-    Lists recursively all files under the user's folder in the Sensitive
-    Data Archive (SDA).  If the [prefix] parameter is used, only the
-    files under the specified path will be returned. If no config is
-	specified, the tool will look for a previous session.
+    Lists the files and folders in the user's folder in the Sensitive
+    Data Archive (SDA), or in a dataset given with '-dataset'.  Use '-r'
+    to list all files in the subfolders recursively.  If the [prefix]
+    parameter is used, only the files under the specified path will be
+    returned.  If no config is specified, the tool will look for a
+    previous session, or the profile given with '-profile' in
+    ~/.sda-cli/config.  The list can be printed as json or csv for use
+    in scripts and other tools with '-format'.  Use '-ext' to list only
+    files with the given extensions, and '-after' and '-before' to list
+    only files modified within a time range.  The files are sorted by
+    name, unless another order is given with '-sort'.  Sizes are shown
+    in human readable form, unless human_readable_sizes is disabled in
+    the configuration.  '-h' and '-bytes' show the sizes in human
+    readable form or in bytes, whatever the configuration says.  After
+    the list, the number and total size of the files is printed, unless
+    '-no-summary' is used.
 `
 
 // ArgHelp is the suffix text that will be displayed after the argument list in
@@ -39,12 +57,100 @@ var Args = flag.NewFlagSet("list", flag.ExitOnError)
 var configPath = Args.String("config", "",
 	"S3 config file to use for listing.")
 
+var profile = Args.String("profile", "",
+	"Named profile in ~/.sda-cli/config to use instead of the session file.")
+
+var dataset = Args.String("dataset", "",
+	"ID of a dataset to list the files of, instead of the user's folder.")
+
+var recursive = Args.Bool("r", false, "List the files in all subfolders recursively.")
+
+var humanReadable = Args.Bool("h", false,
+	"Show file sizes in human readable form, e.g. 345.0 MB, even if\n"+
+		"human_readable_sizes is disabled in the configuration.")
+
+var rawBytes = Args.Bool("bytes", false,
+	"Show file sizes in bytes, even if human_readable_sizes is enabled\n"+
+		"in the configuration.")
+
+var outputFormat = Args.String("format", "text",
+	"Output format of the list, text, json or csv.")
+
+var sortOrder = Args.String("sort", "name",
+	"Order of the listed files, one of name, size, size-desc, date\n"+
+		"or date-desc.")
+
+var noSummary = Args.Bool("no-summary", false,
+	"Do not print the number and total size of the listed files.")
+
+var extensions = Args.String("ext", "",
+	"List only files with these extensions, separated by commas,\n"+
+		"e.g. .c4gh,.bam")
+
+var after = Args.String("after", "",
+	"List only files modified at or after this time, given as a date\n"+
+		"(YYYY-MM-DD) or in RFC3339 format.")
+
+var before = Args.String("before", "",
+	"List only files modified before this time, given as a date\n"+
+		"(YYYY-MM-DD) or in RFC3339 format.")
+
+// Long names of the short flags
+func init() {
+	helpers.AliasFlag(Args, "r", "recursive")
+	helpers.AliasFlag(Args, "h", "human-readable")
+	helpers.AliasFlag(Args, "ext", "extensions")
+}
+
+// fileInfo is the description of a file in the json and csv output. Folders
+// have a key ending with "/" and no modification time or etag.
+type fileInfo struct {
+	Key          string     `json:"key"`
+	Size         int64      `json:"size"`
+	LastModified *time.Time `json:"last_modified,omitempty"`
+	ETag         string     `json:"etag,omitempty"`
+}
+
+// listSummary is the number and total size of the listed files
+type listSummary struct {
+	Count      int
+	TotalBytes int64
+}
+
 // List function lists the contents of an s3
 func List(args []string) error {
 	// Call ParseArgs to take care of all the flag parsing
 	err := helpers.ParseArgs(args, Args)
 	if err != nil {
-		return fmt.Errorf("failed parsing arguments, reason: %v", err)
+		return fmt.Errorf("failed parsing arguments, reason: %w", err)
+	}
+
+	switch *outputFormat {
+	case "text", "json", "csv":
+	default:
+		return fmt.Errorf("invalid output format: %s", *outputFormat)
+	}
+
+	if *humanReadable && *rawBytes {
+		return errors.New("-h and -bytes cannot be combined")
+	}
+
+	switch *sortOrder {
+	case "name", "size", "size-desc", "date", "date-desc":
+	default:
+		return fmt.Errorf("invalid sort order: %s", *sortOrder)
+	}
+
+	var afterTime, beforeTime time.Time
+	if *after != "" {
+		if afterTime, err = parseDate(*after); err != nil {
+			return fmt.Errorf("invalid date for -after: %s", *after)
+		}
+	}
+	if *before != "" {
+		if beforeTime, err = parseDate(*before); err != nil {
+			return fmt.Errorf("invalid date for -before: %s", *before)
+		}
 	}
 
 	prefix := ""
@@ -55,28 +161,237 @@ func List(args []string) error {
 	}
 
 	// // Get the configuration file or the .sda-cli-session
-	config, err := helpers.GetAuth(*configPath)
+	config, err := helpers.GetAuth(*configPath, *profile)
 	if err != nil {
-		return fmt.Errorf("failed to load config file, reason: %v", err)
+		return fmt.Errorf("failed to load config file, reason: %w", err)
 	}
 
-	expiring, err := helpers.CheckTokenExpiration(config.AccessToken)
+	err = helpers.WarnTokenExpiration(config)
+	if err != nil {
+		return err
+	}
+	bucket := config.AccessKey
+	if *dataset != "" {
+		bucket = *dataset
+	}
+	result, err := helpers.ListFiles(*config, bucket, prefix, *recursive)
 	if err != nil {
 		return err
 	}
-	if expiring {
-		fmt.Fprintln(os.Stderr, "The provided token expires in less than 24 hours")
-		fmt.Fprintln(os.Stderr, "Consider renewing the token.")
+
+	objects := result.Contents
+	if *extensions != "" {
+		objects = filterExtensions(objects, strings.Split(*extensions, ","))
+	}
+	if !afterTime.IsZero() || !beforeTime.IsZero() {
+		objects = filterDates(objects, afterTime, beforeTime)
+	}
+	sortObjects(objects, *sortOrder)
+
+	folders := result.CommonPrefixes
+
+	summary := summarize(objects)
+
+	switch *outputFormat {
+	case "json":
+		err = printJSON(os.Stdout, folders, objects)
+	case "csv":
+		err = printCSV(os.Stdout, folders, objects)
+	default:
+		err = printText(os.Stdout, folders, objects, humanReadableSizes(config))
 	}
-	result, err := helpers.ListFiles(*config, prefix)
 	if err != nil {
 		return err
 	}
 
-	for i := range result.Contents {
-		file := *result.Contents[i].Key
-		fmt.Printf("%s \t %s \n", bytesize.New(float64((*result.Contents[i].Size))), file[strings.Index(file, "/")+1:])
+	// The summary goes to stderr, to keep it out of piped output
+	if !*noSummary {
+		fmt.Fprintf(os.Stderr, "Total: %d objects, %s\n", summary.Count, helpers.FormatBytes(summary.TotalBytes))
 	}
 
 	return nil
 }
+
+// humanReadableSizes returns whether the text output shows the sizes in human
+// readable form, which is set by human_readable_sizes in the configuration,
+// unless the -h or -bytes flag is given
+func humanReadableSizes(config *helpers.Config) bool {
+	switch {
+	case *rawBytes:
+		return false
+	case *humanReadable:
+		return true
+	default:
+		return config.HumanReadableSizes
+	}
+}
+
+// summarize returns the number and total size of the objects
+func summarize(objects []*s3.Object) listSummary {
+	summary := listSummary{Count: len(objects)}
+	for _, object := range objects {
+		summary.TotalBytes += aws.Int64Value(object.Size)
+	}
+
+	return summary
+}
+
+// printText writes the listed folders and objects to w, one per line with the
+// size in a right-aligned column before the name. Sizes are formatted with
+// helpers.FormatBytes when humanReadable is set.
+func printText(w io.Writer, folders []*s3.CommonPrefix, objects []*s3.Object, humanReadable bool) error {
+	files := fileInfos(folders, objects)
+	sizes := make([]string, len(files))
+	width := 0
+	for i, file := range files {
+		switch {
+		case strings.HasSuffix(file.Key, "/") && file.LastModified == nil:
+			sizes[i] = "DIR"
+		case humanReadable:
+			sizes[i] = helpers.FormatBytes(file.Size)
+		default:
+			sizes[i] = strconv.FormatInt(file.Size, 10)
+		}
+		if len(sizes[i]) > width {
+			width = len(sizes[i])
+		}
+	}
+
+	for i, file := range files {
+		if _, err := fmt.Fprintf(w, "%*s  %s\n", width, sizes[i], file.Key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// filterExtensions returns the objects with keys ending with any of the given
+// extensions
+func filterExtensions(objects []*s3.Object, extensions []string) []*s3.Object {
+	var filtered []*s3.Object
+	for _, object := range objects {
+		key := aws.StringValue(object.Key)
+		for _, ext := range extensions {
+			if ext = strings.TrimSpace(ext); ext != "" && strings.HasSuffix(key, ext) {
+				filtered = append(filtered, object)
+
+				break
+			}
+		}
+	}
+
+	return filtered
+}
+
+// parseDate parses a time in RFC3339 format, or a date in YYYY-MM-DD format,
+// which is taken as the start of that day in UTC
+func parseDate(date string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, date); err == nil {
+		return t, nil
+	}
+
+	return time.Parse("2006-01-02", date)
+}
+
+// filterDates returns the objects last modified at or after `after` and
+// before `before`. A zero time leaves that end of the range open.
+func filterDates(objects []*s3.Object, after, before time.Time) []*s3.Object {
+	var filtered []*s3.Object
+	for _, object := range objects {
+		modified := aws.TimeValue(object.LastModified)
+		if !after.IsZero() && modified.Before(after) {
+			continue
+		}
+		if !before.IsZero() && !modified.Before(before) {
+			continue
+		}
+		filtered = append(filtered, object)
+	}
+
+	return filtered
+}
+
+// sortObjects sorts the objects in place in the given order. Objects that
+// compare equal are kept in name order.
+func sortObjects(objects []*s3.Object, order string) {
+	sort.SliceStable(objects, func(i, j int) bool {
+		a, b := objects[i], objects[j]
+		switch order {
+		case "size":
+			if aws.Int64Value(a.Size) != aws.Int64Value(b.Size) {
+				return aws.Int64Value(a.Size) < aws.Int64Value(b.Size)
+			}
+		case "size-desc":
+			if aws.Int64Value(a.Size) != aws.Int64Value(b.Size) {
+				return aws.Int64Value(a.Size) > aws.Int64Value(b.Size)
+			}
+		case "date":
+			if !aws.TimeValue(a.LastModified).Equal(aws.TimeValue(b.LastModified)) {
+				return aws.TimeValue(a.LastModified).Before(aws.TimeValue(b.LastModified))
+			}
+		case "date-desc":
+			if !aws.TimeValue(a.LastModified).Equal(aws.TimeValue(b.LastModified)) {
+				return aws.TimeValue(a.LastModified).After(aws.TimeValue(b.LastModified))
+			}
+		}
+
+		return aws.StringValue(a.Key) < aws.StringValue(b.Key)
+	})
+}
+
+// fileInfos returns the descriptions of the listed folders and objects, with
+// the user's folder removed from the keys
+func fileInfos(folders []*s3.CommonPrefix, objects []*s3.Object) []fileInfo {
+	files := make([]fileInfo, 0, len(folders)+len(objects))
+	for _, folder := range folders {
+		name := aws.StringValue(folder.Prefix)
+		files = append(files, fileInfo{Key: name[strings.Index(name, "/")+1:]})
+	}
+	for _, object := range objects {
+		key := aws.StringValue(object.Key)
+		files = append(files, fileInfo{
+			Key:          key[strings.Index(key, "/")+1:],
+			Size:         aws.Int64Value(object.Size),
+			LastModified: object.LastModified,
+			ETag:         strings.Trim(aws.StringValue(object.ETag), `"`),
+		})
+	}
+
+	return files
+}
+
+// printJSON writes the listed folders and objects to w as a json array
+func printJSON(w io.Writer, folders []*s3.CommonPrefix, objects []*s3.Object) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(fileInfos(folders, objects))
+}
+
+// printCSV writes the listed folders and objects to w as csv, with a header
+// row
+func printCSV(w io.Writer, folders []*s3.CommonPrefix, objects []*s3.Object) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write([]string{"key", "size", "last_modified", "etag"}); err != nil {
+		return err
+	}
+	for _, file := range fileInfos(folders, objects) {
+		var lastModified string
+		if file.LastModified != nil {
+			lastModified = file.LastModified.Format(time.RFC3339)
+		}
+		record := []string{
+			file.Key,
+			strconv.FormatInt(file.Size, 10),
+			lastModified,
+			file.ETag,
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+
+	return writer.Error()
+}
@@ -2,6 +2,7 @@ package list
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http/httptest"
@@ -9,7 +10,9 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/NBISweden/sda-cli/helpers"
 	"github.com/NBISweden/sda-cli/upload"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
@@ -39,7 +42,7 @@ func (suite *TestSuite) TestNoConfig() {
 	os.Args = []string{"list", "-config", ""}
 
 	err := List(os.Args)
-	assert.EqualError(suite.T(), err, "failed to load config file, reason: failed to read the configuration file")
+	assert.ErrorContains(suite.T(), err, "failed to load config file, reason: failed to read the configuration file, reason: configuration file (")
 }
 
 func (suite *TestSuite) TestTooManyArgs() {
@@ -50,6 +53,184 @@ func (suite *TestSuite) TestTooManyArgs() {
 	assert.EqualError(suite.T(), err, "failed to parse prefix, only one is allowed")
 }
 
+func (suite *TestSuite) TestInvalidFormat() {
+
+	os.Args = []string{"list", "-format", "yaml"}
+	defer func() { *outputFormat = "text" }()
+
+	err := List(os.Args)
+	assert.EqualError(suite.T(), err, "invalid output format: yaml")
+}
+
+func (suite *TestSuite) TestPrintJSON() {
+	modified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	objects := []*s3.Object{
+		{Key: aws.String("dummy/dir/file.c4gh"), Size: aws.Int64(42), LastModified: aws.Time(modified), ETag: aws.String(`"9a0364b9e99bb480dd25e1f0284c8555"`)},
+	}
+
+	var out bytes.Buffer
+	assert.NoError(suite.T(), printJSON(&out, nil, objects))
+
+	var files []map[string]interface{}
+	assert.NoError(suite.T(), json.Unmarshal(out.Bytes(), &files))
+	assert.Equal(suite.T(), []map[string]interface{}{
+		{"key": "dir/file.c4gh", "size": float64(42), "last_modified": "2024-01-02T03:04:05Z", "etag": "9a0364b9e99bb480dd25e1f0284c8555"},
+	}, files)
+
+	// An empty list is printed as an empty array
+	out.Reset()
+	assert.NoError(suite.T(), printJSON(&out, nil, nil))
+	assert.Equal(suite.T(), "[]\n", out.String())
+}
+
+func (suite *TestSuite) TestSummarize() {
+	objects := []*s3.Object{
+		{Key: aws.String("dummy/a"), Size: aws.Int64(1024)},
+		{Key: aws.String("dummy/b"), Size: aws.Int64(2048)},
+	}
+	assert.Equal(suite.T(), listSummary{Count: 2, TotalBytes: 3072}, summarize(objects))
+	assert.Equal(suite.T(), listSummary{}, summarize(nil))
+}
+
+func (suite *TestSuite) TestPrintCSV() {
+	modified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	objects := []*s3.Object{
+		{Key: aws.String("dummy/dir/file.c4gh"), Size: aws.Int64(42), LastModified: aws.Time(modified), ETag: aws.String(`"9a0364b9e99bb480dd25e1f0284c8555"`)},
+		{Key: aws.String("dummy/a,b.c4gh"), Size: aws.Int64(0), LastModified: aws.Time(modified), ETag: aws.String(`"d41d8cd98f00b204e9800998ecf8427e"`)},
+	}
+
+	var out bytes.Buffer
+	assert.NoError(suite.T(), printCSV(&out, []*s3.CommonPrefix{{Prefix: aws.String("dummy/folder/")}}, objects))
+	assert.Equal(suite.T(), `key,size,last_modified,etag
+folder/,0,,
+dir/file.c4gh,42,2024-01-02T03:04:05Z,9a0364b9e99bb480dd25e1f0284c8555
+"a,b.c4gh",0,2024-01-02T03:04:05Z,d41d8cd98f00b204e9800998ecf8427e
+`, out.String())
+}
+
+func (suite *TestSuite) TestFilterExtensions() {
+	objects := []*s3.Object{
+		{Key: aws.String("dummy/file.c4gh")},
+		{Key: aws.String("dummy/file.bam")},
+		{Key: aws.String("dummy/file.txt")},
+		{Key: aws.String("dummy/c4gh")},
+	}
+
+	filtered := filterExtensions(objects, []string{".c4gh"})
+	assert.Equal(suite.T(), objects[:1], filtered)
+
+	filtered = filterExtensions(objects, strings.Split(".c4gh, .bam", ","))
+	assert.Equal(suite.T(), objects[:2], filtered)
+
+	filtered = filterExtensions(objects, []string{".vcf"})
+	assert.Empty(suite.T(), filtered)
+}
+
+func (suite *TestSuite) TestParseDate() {
+	date, err := parseDate("2024-01-02")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), date)
+
+	date, err = parseDate("2024-01-02T03:04:05+01:00")
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), time.Date(2024, 1, 2, 2, 4, 5, 0, time.UTC).Equal(date))
+
+	_, err = parseDate("02/01/2024")
+	assert.Error(suite.T(), err)
+
+	os.Args = []string{"list", "-after", "yesterday"}
+	defer func() { *after = "" }()
+	assert.EqualError(suite.T(), List(os.Args), "invalid date for -after: yesterday")
+}
+
+func (suite *TestSuite) TestFilterDates() {
+	objects := []*s3.Object{
+		{Key: aws.String("dummy/old"), LastModified: aws.Time(time.Date(2023, 12, 31, 23, 59, 59, 0, time.UTC))},
+		{Key: aws.String("dummy/new"), LastModified: aws.Time(time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC))},
+		{Key: aws.String("dummy/newer"), LastModified: aws.Time(time.Date(2024, 2, 1, 12, 0, 0, 0, time.UTC))},
+	}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+
+	assert.Equal(suite.T(), objects[1:], filterDates(objects, start, time.Time{}))
+	assert.Equal(suite.T(), objects[:2], filterDates(objects, time.Time{}, end))
+	assert.Equal(suite.T(), objects[1:2], filterDates(objects, start, end))
+	assert.Empty(suite.T(), filterDates(objects, end, start))
+}
+
+func (suite *TestSuite) TestPrintText() {
+	modified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	folders := []*s3.CommonPrefix{{Prefix: aws.String("dummy/folder/")}}
+	objects := []*s3.Object{
+		{Key: aws.String("dummy/large.c4gh"), Size: aws.Int64(362283008), LastModified: aws.Time(modified)},
+		{Key: aws.String("dummy/small.c4gh"), Size: aws.Int64(12), LastModified: aws.Time(modified)},
+	}
+
+	var out bytes.Buffer
+	assert.NoError(suite.T(), printText(&out, folders, objects, false))
+	assert.Equal(suite.T(), `      DIR  folder/
+362283008  large.c4gh
+       12  small.c4gh
+`, out.String())
+
+	out.Reset()
+	assert.NoError(suite.T(), printText(&out, folders, objects, true))
+	assert.Equal(suite.T(), `     DIR  folder/
+345.5 MB  large.c4gh
+    12 B  small.c4gh
+`, out.String())
+}
+
+func (suite *TestSuite) TestHumanReadableSizes() {
+	defer func() { *humanReadable = false; *rawBytes = false }()
+
+	// The configuration decides, unless -h or -bytes is given
+	assert.True(suite.T(), humanReadableSizes(&helpers.Config{HumanReadableSizes: true}))
+	assert.False(suite.T(), humanReadableSizes(&helpers.Config{HumanReadableSizes: false}))
+
+	*humanReadable = true
+	assert.True(suite.T(), humanReadableSizes(&helpers.Config{HumanReadableSizes: false}))
+
+	*humanReadable = false
+	*rawBytes = true
+	assert.False(suite.T(), humanReadableSizes(&helpers.Config{HumanReadableSizes: true}))
+
+	os.Args = []string{"list", "-h", "-bytes"}
+	assert.EqualError(suite.T(), List(os.Args), "-h and -bytes cannot be combined")
+}
+
+func (suite *TestSuite) TestSortObjects() {
+	day := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	objects := []*s3.Object{
+		{Key: aws.String("dummy/b"), Size: aws.Int64(2), LastModified: aws.Time(day)},
+		{Key: aws.String("dummy/c"), Size: aws.Int64(1), LastModified: aws.Time(day.Add(time.Hour))},
+		{Key: aws.String("dummy/a"), Size: aws.Int64(2), LastModified: aws.Time(day.Add(-time.Hour))},
+	}
+	keys := func() []string {
+		var keys []string
+		for _, object := range objects {
+			keys = append(keys, aws.StringValue(object.Key))
+		}
+
+		return keys
+	}
+
+	sortObjects(objects, "name")
+	assert.Equal(suite.T(), []string{"dummy/a", "dummy/b", "dummy/c"}, keys())
+	sortObjects(objects, "size")
+	assert.Equal(suite.T(), []string{"dummy/c", "dummy/a", "dummy/b"}, keys())
+	sortObjects(objects, "size-desc")
+	assert.Equal(suite.T(), []string{"dummy/a", "dummy/b", "dummy/c"}, keys())
+	sortObjects(objects, "date")
+	assert.Equal(suite.T(), []string{"dummy/a", "dummy/b", "dummy/c"}, keys())
+	sortObjects(objects, "date-desc")
+	assert.Equal(suite.T(), []string{"dummy/c", "dummy/b", "dummy/a"}, keys())
+
+	os.Args = []string{"list", "-sort", "random"}
+	defer func() { *sortOrder = "name" }()
+	assert.EqualError(suite.T(), List(os.Args), "invalid sort order: random")
+}
+
 func (suite *TestSuite) TestFunctionality() {
 
 	// Create a fake s3 backend
@@ -129,6 +310,16 @@ func (suite *TestSuite) TestFunctionality() {
 	}
 	defer os.Remove(testfile.Name())
 
+	// Create a file in a subfolder, which is only listed with -r
+	err = os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	if err != nil {
+		log.Panic(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "sub", "nested"), []byte("content"), 0600)
+	if err != nil {
+		log.Panic(err)
+	}
+
 	var uploadOutput bytes.Buffer
 	log.SetOutput(&uploadOutput)
 
@@ -136,6 +327,7 @@ func (suite *TestSuite) TestFunctionality() {
 	os.Args = []string{"upload", "--force-unencrypted", "-config", configPath.Name(), "-r", dir}
 	err = upload.Upload(os.Args)
 	assert.NoError(suite.T(), err)
+	defer os.Remove("sda-upload-manifest.json")
 
 	// Check logs that file was uploaded
 	logMsg := fmt.Sprintf("%v", strings.TrimSuffix(uploadOutput.String(), "\n"))
@@ -157,4 +349,88 @@ func (suite *TestSuite) TestFunctionality() {
 	listOutput, _ := io.ReadAll(r)
 	msg1 := fmt.Sprintf("%v", filepath.Base(testfile.Name()))
 	assert.Contains(suite.T(), string(listOutput), msg1)
+
+	// Without -r, the subfolder is listed instead of its files
+	assert.Contains(suite.T(), string(listOutput), "DIR  sub/\n")
+	assert.NotContains(suite.T(), string(listOutput), "sub/nested")
+
+	r, w, _ = os.Pipe()
+	os.Stdout = w
+
+	os.Args = []string{"list", "-config", configPath.Name(), "-r"}
+	err = List(os.Args)
+	assert.NoError(suite.T(), err)
+	*recursive = false
+
+	w.Close()
+	os.Stdout = rescueStdout
+	listOutput, _ = io.ReadAll(r)
+	assert.Contains(suite.T(), string(listOutput), msg1)
+	assert.Contains(suite.T(), string(listOutput), "7 B  sub/nested\n")
+	assert.NotContains(suite.T(), string(listOutput), "DIR")
+
+	// The sizes are shown in bytes with -bytes
+	r, w, _ = os.Pipe()
+	os.Stdout = w
+
+	os.Args = []string{"list", "-config", configPath.Name(), "-r", "-bytes"}
+	err = List(os.Args)
+	assert.NoError(suite.T(), err)
+	*recursive = false
+	*rawBytes = false
+
+	w.Close()
+	os.Stdout = rescueStdout
+	listOutput, _ = io.ReadAll(r)
+	assert.Contains(suite.T(), string(listOutput), "7  sub/nested\n")
+
+	// and by default when the configuration disables human readable sizes,
+	// unless -h is given
+	noHumanConfig := strings.Replace(confFile, "human_readable_sizes = True", "human_readable_sizes = False", 1)
+	assert.NoError(suite.T(), os.WriteFile(configPath.Name(), []byte(noHumanConfig), 0600))
+	for _, test := range []struct {
+		args []string
+		line string
+	}{
+		{[]string{"list", "-config", configPath.Name(), "-r"}, "7  sub/nested\n"},
+		{[]string{"list", "-config", configPath.Name(), "-r", "-h"}, "7 B  sub/nested\n"},
+	} {
+		r, w, _ = os.Pipe()
+		os.Stdout = w
+
+		err = List(test.args)
+		assert.NoError(suite.T(), err)
+		*recursive = false
+		*humanReadable = false
+
+		w.Close()
+		os.Stdout = rescueStdout
+		listOutput, _ = io.ReadAll(r)
+		assert.Contains(suite.T(), string(listOutput), test.line)
+	}
+	assert.NoError(suite.T(), os.WriteFile(configPath.Name(), []byte(confFile), 0600))
+
+	// Files in a dataset are listed with -dataset
+	_, err = s3Client.CreateBucket(&s3.CreateBucketInput{Bucket: aws.String("egad00000000001")})
+	assert.NoError(suite.T(), err)
+	_, err = s3Client.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String("egad00000000001"),
+		Key:    aws.String("egad00000000001/dataset_file.c4gh"),
+		Body:   strings.NewReader("content"),
+	})
+	assert.NoError(suite.T(), err)
+
+	r, w, _ = os.Pipe()
+	os.Stdout = w
+
+	os.Args = []string{"list", "-config", configPath.Name(), "-dataset", "egad00000000001"}
+	err = List(os.Args)
+	assert.NoError(suite.T(), err)
+	*dataset = ""
+
+	w.Close()
+	os.Stdout = rescueStdout
+	listOutput, _ = io.ReadAll(r)
+	assert.Contains(suite.T(), string(listOutput), "dataset_file.c4gh")
+	assert.NotContains(suite.T(), string(listOutput), msg1)
 }
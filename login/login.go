@@ -7,12 +7,15 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"time"
 
+	"github.com/NBISweden/sda-cli/helpers"
 	"gopkg.in/ini.v1"
 )
 
@@ -22,25 +25,50 @@ import (
 // `help login` command
 var Usage = `
 
-USAGE: %s login <login-target>
+USAGE: %s login (-device-flow) (-refresh) (-profile <name>) <login-target>
 
 login:
-    logs in to the SDA using the provided login target.
+    logs in to the SDA using the provided login target, or the target
+    chosen from a menu of the known targets if none is given.  With
+    '-device-flow', no browser is opened.  Instead the login URL and a
+    code are shown, so that the login can be completed in a browser on
+    any device, e.g. when logging in from a server without a browser.
+    The login is saved in $XDG_CONFIG_HOME/sda-cli/session, or
+    ~/.config/sda-cli/session.  With '-refresh', the refresh token of
+    the previous login is used to get a new access token, without
+    logging in again.  With '-profile', the login is saved as a named
+    profile in ~/.sda-cli/config instead of in the session file, so
+    that several SDA instances can be used.
 `
 
 // ArgHelp is the suffix text that will be displayed after the argument list in
 // the module help
 var ArgHelp = `
     [login-target]
-        The login target can be one of the following: 
-			https://login.bp.nbis.se/
-			https://login.test.fega.nbis.se/
-			https://login.gdi.nbis.se/`
+        The login target can be one of the following, which can also be
+        chosen from a menu if no target is given: 
+			` + strings.Join(loginTargets, "\n\t\t\t")
+
+// loginTargets are the login services of the known SDA instances
+var loginTargets = []string{
+	"https://login.bp.nbis.se/",
+	"https://login.test.fega.nbis.se/",
+	"https://login.gdi.nbis.se/",
+}
 
 // Args is a flagset that needs to be exported so that it can be written to the
 // main program help
 var Args = flag.NewFlagSet("login", flag.ExitOnError)
 
+var deviceFlow = Args.Bool("device-flow", false,
+	"Show the login URL and code instead of opening a browser.")
+
+var refresh = Args.Bool("refresh", false,
+	"Refresh the access token of the previous login, without logging in again.")
+
+var profile = Args.String("profile", "",
+	"Save the login as a named profile in ~/.sda-cli/config.")
+
 type S3Config struct {
 	AccessKey            string `ini:"access_key"`
 	SecretKey            string `ini:"secret_key"`
@@ -56,6 +84,7 @@ type S3Config struct {
 	SocketTimeout        int    `ini:"socket_timeout"`
 	HumanReadableSizes   bool   `ini:"human_readable_sizes"`
 	PublicKey            string `ini:"public_key"`
+	RefreshToken         string `ini:"refresh_token"`
 }
 
 type OIDCWellKnown struct {
@@ -65,12 +94,16 @@ type OIDCWellKnown struct {
 
 type DeviceLoginResponse struct {
 	VerificationURL string `json:"verification_uri_complete"`
+	VerificationURI string `json:"verification_uri"`
+	UserCode        string `json:"user_code"`
 	DeviceCode      string `json:"device_code"`
 	ExpiresIn       int    `json:"expires_in"`
+	Interval        int    `json:"interval"`
 }
 
 type Result struct {
 	AccessToken      string `json:"access_token"`
+	RefreshToken     string `json:"refresh_token"`
 	IDToken          string `json:"id_token"`
 	Scope            string `json:"scope"`
 	TokenType        string `json:"token_type"`
@@ -96,6 +129,8 @@ type DeviceLogin struct {
 	S3Target        string
 	PublicKey       string
 	PollingInterval int
+	DeviceFlow      bool
+	Profile         string
 	LoginResult     *Result
 	UserInfo        *UserInfo
 	wellKnown       *OIDCWellKnown
@@ -130,15 +165,28 @@ func GetAuthInfo(baseURL string) (*AuthInfo, error) {
 	return &result, nil
 }
 
-// creates a .sda-cli-session file and updates its values
+// creates the session file in the config directory and updates its values, or
+// the section of the profile in ~/.sda-cli/config if a profile is set
 func (login *DeviceLogin) UpdateConfigFile() error {
+	if login.Profile != "" {
+		return login.updateProfile()
+	}
 
-	out, err := os.Create(".sda-cli-session")
+	sessionPath, err := helpers.SessionPath()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(sessionPath), 0700)
 	if err != nil {
 		return err
 	}
 
-	cfg, err := ini.Load(".sda-cli-session")
+	out, err := os.OpenFile(sessionPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := ini.Load(sessionPath)
 	if err != nil {
 		return err
 	}
@@ -152,7 +200,7 @@ func (login *DeviceLogin) UpdateConfigFile() error {
 	if err != nil {
 		return err
 	}
-	err = cfg.SaveTo(".sda-cli-session")
+	err = cfg.SaveTo(sessionPath)
 	if err != nil {
 		return err
 	}
@@ -161,20 +209,90 @@ func (login *DeviceLogin) UpdateConfigFile() error {
 	return nil
 }
 
+// updateProfile() writes the login to the section of the profile in
+// ~/.sda-cli/config, keeping the other profiles in the file.
+func (login *DeviceLogin) updateProfile() error {
+	profilesPath, err := helpers.ProfilesPath()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(profilesPath), 0700)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := ini.LooseLoad(profilesPath)
+	if err != nil {
+		return err
+	}
+
+	s3Config, err := login.GetS3Config()
+	if err != nil {
+		return err
+	}
+
+	cfg.DeleteSection(login.Profile)
+	err = cfg.Section(login.Profile).ReflectFrom(s3Config)
+	if err != nil {
+		return err
+	}
+	err = cfg.SaveTo(profilesPath)
+	if err != nil {
+		return err
+	}
+
+	return os.Chmod(profilesPath, 0600)
+}
+
 func NewLogin(args []string) error {
 	deviceLogin, err := NewDeviceLogin(args)
 	if err != nil {
-		return fmt.Errorf("failed to contact authentication service")
+		return fmt.Errorf("failed to start the login: %w", err)
+	}
+	if *refresh {
+		err = deviceLogin.Refresh()
+		if err != nil {
+			return fmt.Errorf("token refresh failed: %w", err)
+		}
+		fmt.Printf("Refreshed the token of %v\n", deviceLogin.UserInfo.Name)
+		printTokenExpiration(os.Stdout, deviceLogin.LoginResult.AccessToken, helpers.IsTerminal(os.Stdout))
+
+		return nil
 	}
 	err = deviceLogin.Login()
 	if err != nil {
 		return fmt.Errorf("Login failed")
 	}
 	fmt.Printf("Logged in as %v\n", deviceLogin.UserInfo.Name)
+	printTokenExpiration(os.Stdout, deviceLogin.LoginResult.AccessToken, helpers.IsTerminal(os.Stdout))
 
 	return err
 }
 
+// printTokenExpiration writes the time when the access token expires to w,
+// with a warning of the time remaining if it expires in less than 24 hours.
+// The warning is shown in yellow if colored is set.
+func printTokenExpiration(w io.Writer, accessToken string, colored bool) {
+	expiration, err := helpers.TokenExpiration(accessToken)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not read the token expiration: %v\n", err)
+
+		return
+	}
+	fmt.Fprintf(w, "Token valid until: %v\n", expiration.Local().Format(time.RFC1123))
+
+	if remaining := time.Until(expiration); remaining < 24*time.Hour {
+		warning := "Warning: the token expires in " + helpers.FormatTimeRemaining(remaining)
+		if remaining <= 0 {
+			warning = "Warning: the token has expired"
+		}
+		if colored {
+			warning = "\033[33m" + warning + "\033[0m"
+		}
+		fmt.Fprintln(w, warning)
+	}
+}
+
 // NewDeviceLogin() returns a new `DeviceLogin` with the given `url` and
 // `clientID` set.
 func NewDeviceLogin(args []string) (DeviceLogin, error) {
@@ -184,15 +302,31 @@ func NewDeviceLogin(args []string) (DeviceLogin, error) {
 	if err != nil {
 		return DeviceLogin{}, errors.New("failed parsing arguments")
 	}
-	if len(Args.Args()) == 1 {
+	switch len(Args.Args()) {
+	case 0:
+		url, err = helpers.PromptSelect("Choose a login target", loginTargets)
+		if err != nil {
+			return DeviceLogin{}, fmt.Errorf("a login target is required, reason: %w", err)
+		}
+		url = strings.TrimSuffix(url, "/")
+	case 1:
 		url = Args.Args()[0]
+	default:
+		return DeviceLogin{}, fmt.Errorf("only one login target can be given, got %d", len(Args.Args()))
 	}
 	info, err := GetAuthInfo(url)
 	if err != nil {
 		return DeviceLogin{}, errors.New("failed to get auth Info")
 	}
 
-	return DeviceLogin{BaseURL: info.OidcURI, ClientID: info.ClientID, PollingInterval: 2, S3Target: info.InboxURI, PublicKey: info.PublicKey}, nil
+	// The login is saved to the remote given with the global -remote flag
+	// unless a profile is given
+	loginProfile := *profile
+	if loginProfile == "" {
+		loginProfile = helpers.Remote
+	}
+
+	return DeviceLogin{BaseURL: info.OidcURI, ClientID: info.ClientID, PollingInterval: 2, DeviceFlow: *deviceFlow, Profile: loginProfile, S3Target: info.InboxURI, PublicKey: info.PublicKey}, nil
 }
 
 // open opens the specified URL in the default browser of the user.
@@ -221,19 +355,23 @@ func (login *DeviceLogin) Login() error {
 	var err error
 	login.wellKnown, err = login.getWellKnown()
 	if err != nil {
-		return fmt.Errorf("failed to fetch .well-known configuration: %v", err)
+		return fmt.Errorf("failed to fetch .well-known configuration: %w", err)
 	}
 
 	login.deviceLogin, err = login.startDeviceLogin()
 	if err != nil {
-		return fmt.Errorf("failed to start device login: %v", err)
+		return fmt.Errorf("failed to start device login: %w", err)
 	}
 	expires := time.Duration(login.deviceLogin.ExpiresIn * int(time.Second))
 	fmt.Printf("Login started (expires in %v minutes)\n", expires.Minutes())
 
-	err = open(login.deviceLogin.VerificationURL)
-	if err != nil {
-		return fmt.Errorf("failed to open login URL: %v", err)
+	if login.DeviceFlow {
+		login.printDeviceCode(os.Stdout)
+	} else {
+		err = open(login.deviceLogin.VerificationURL)
+		if err != nil {
+			return fmt.Errorf("failed to open login URL: %w", err)
+		}
 	}
 
 	loginResult, err := login.waitForLogin()
@@ -255,6 +393,94 @@ func (login *DeviceLogin) Login() error {
 	return err
 }
 
+// Refresh() exchanges the refresh token in the session file, or in the
+// profile, for a new access token, and writes the new tokens back.
+func (login *DeviceLogin) Refresh() error {
+	var configPath string
+	var err error
+	if login.Profile != "" {
+		configPath, err = helpers.ProfilesPath()
+	} else {
+		configPath, err = helpers.FindSessionFile()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read previous login: %w", err)
+	}
+	config, err := helpers.LoadConfigFile(configPath, login.Profile)
+	if err != nil {
+		return fmt.Errorf("failed to read previous login: %w", err)
+	}
+	if config.RefreshToken == "" {
+		return fmt.Errorf("no refresh token found in %s, log in again", configPath)
+	}
+
+	login.wellKnown, err = login.getWellKnown()
+	if err != nil {
+		return fmt.Errorf("failed to fetch .well-known configuration: %w", err)
+	}
+
+	login.LoginResult, err = login.refreshToken(config.RefreshToken)
+	if err != nil {
+		return err
+	}
+	// The server may keep the refresh token unchanged
+	if login.LoginResult.RefreshToken == "" {
+		login.LoginResult.RefreshToken = config.RefreshToken
+	}
+
+	login.UserInfo, err = login.getUserInfo()
+	if err != nil {
+		return err
+	}
+
+	return login.UpdateConfigFile()
+}
+
+// refreshToken() requests a new access token from the token endpoint in
+// login.wellKnown using the refresh token.
+func (login *DeviceLogin) refreshToken(refreshToken string) (*Result, error) {
+	body := url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {login.ClientID},
+		"refresh_token": {refreshToken},
+	}
+
+	resp, err := http.PostForm(login.wellKnown.TokenEndpoint, body)
+	if err != nil {
+		return nil, fmt.Errorf("failure to refresh login token: %w", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var result *Result
+	err = json.Unmarshal(respBody, &result)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("failure to refresh login token: %v %v", result.Error, result.ErrorDescription)
+	}
+	if result.AccessToken == "" {
+		return nil, errors.New("no access token in refresh response")
+	}
+
+	return result, nil
+}
+
+// printDeviceCode() writes the URL where the user logs in, and the code that
+// the user enters there, to w.
+func (login *DeviceLogin) printDeviceCode(w io.Writer) {
+	verificationURI := login.deviceLogin.VerificationURI
+	if verificationURI == "" {
+		verificationURI = login.deviceLogin.VerificationURL
+	}
+	fmt.Fprintf(w, "To log in, open the following URL in a browser on any device:\n\n"+
+		"    %v\n\nand enter the code: %v\n", verificationURI, login.deviceLogin.UserCode)
+}
+
 // S3Config() returns a new `S3Config` with the values from the `DeviceLogin`
 func (login *DeviceLogin) GetS3Config() (*S3Config, error) {
 	if login.LoginResult.AccessToken == "" {
@@ -266,14 +492,15 @@ func (login *DeviceLogin) GetS3Config() (*S3Config, error) {
 		AccessKey:            login.UserInfo.Sub,
 		SecretKey:            login.UserInfo.Sub,
 		AccessToken:          login.LoginResult.AccessToken,
+		RefreshToken:         login.LoginResult.RefreshToken,
 		HostBucket:           login.S3Target,
 		HostBase:             login.S3Target,
 		PublicKey:            login.PublicKey,
 		MultipartChunkSizeMb: 512,
 		GuessMimeType:        false,
 		Encoding:             "UTF-8",
-		CheckSslCertificate:  false,
-		CheckSslHostname:     false,
+		CheckSslCertificate:  true,
+		CheckSslHostname:     true,
 		UseHTTPS:             true,
 		SocketTimeout:        30,
 		HumanReadableSizes:   true,
@@ -306,7 +533,7 @@ func (login *DeviceLogin) getUserInfo() (*UserInfo, error) {
 	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
 		err = fmt.Errorf("status code: %v", resp.StatusCode)
 
-		return nil, fmt.Errorf("request failed: %v", err)
+		return nil, fmt.Errorf("request failed: %w", err)
 	}
 
 	var userinfo *UserInfo
@@ -359,7 +586,7 @@ func (login *DeviceLogin) startDeviceLogin() (*DeviceLoginResponse, error) {
 	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
 		err = fmt.Errorf("status code: %v", resp.StatusCode)
 
-		return nil, fmt.Errorf("request failed: %v", err)
+		return nil, fmt.Errorf("request failed: %w", err)
 	}
 
 	defer resp.Body.Close()
@@ -383,8 +610,14 @@ func (login *DeviceLogin) waitForLogin() (*Result, error) {
 
 	expirationTime := time.Now().Unix() + int64(login.deviceLogin.ExpiresIn)
 
+	// The server may ask for a longer interval than the default
+	interval := login.PollingInterval
+	if login.deviceLogin.Interval > interval {
+		interval = login.deviceLogin.Interval
+	}
+
 	for {
-		time.Sleep(time.Duration(login.PollingInterval) * time.Second)
+		time.Sleep(time.Duration(interval) * time.Second)
 
 		req, err := http.NewRequest("POST", login.wellKnown.TokenEndpoint,
 			strings.NewReader(body))
@@ -395,16 +628,15 @@ func (login *DeviceLogin) waitForLogin() (*Result, error) {
 
 		resp, err := http.DefaultClient.Do(req)
 		if err != nil {
-			return nil, fmt.Errorf("failure to fetch login token: %v", err)
+			return nil, fmt.Errorf("failure to fetch login token: %w", err)
+		}
+		respBody, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
 		}
 
 		if resp.StatusCode == 200 {
-			defer resp.Body.Close()
-			respBody, err := io.ReadAll(resp.Body)
-			if err != nil {
-				return nil, err
-			}
-
 			var loginResult *Result
 			err = json.Unmarshal(respBody, &loginResult)
 			if err != nil {
@@ -414,6 +646,23 @@ func (login *DeviceLogin) waitForLogin() (*Result, error) {
 			return loginResult, nil
 		}
 
+		// Errors defined for the device authorization grant, RFC 8628
+		// section 3.5. Responses that can not be parsed are retried.
+		var result Result
+		if json.Unmarshal(respBody, &result) == nil {
+			switch result.Error {
+			case "", "authorization_pending":
+			case "slow_down":
+				interval += 5
+			case "access_denied":
+				return nil, errors.New("login was denied")
+			case "expired_token":
+				return nil, errors.New("login timed out")
+			default:
+				return nil, fmt.Errorf("failure to fetch login token: %v %v", result.Error, result.ErrorDescription)
+			}
+		}
+
 		if expirationTime <= time.Now().Unix() {
 
 			break
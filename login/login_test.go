@@ -0,0 +1,200 @@
+package login
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NBISweden/sda-cli/helpers"
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type LoginTestSuite struct {
+	suite.Suite
+}
+
+func TestLoginTestSuite(t *testing.T) {
+	suite.Run(t, new(LoginTestSuite))
+}
+
+func (suite *LoginTestSuite) TestPrintDeviceCode() {
+	login := DeviceLogin{deviceLogin: &DeviceLoginResponse{
+		VerificationURL: "https://login.example.org/device?user_code=ABCD-EFGH",
+		VerificationURI: "https://login.example.org/device",
+		UserCode:        "ABCD-EFGH",
+	}}
+
+	var out bytes.Buffer
+	login.printDeviceCode(&out)
+	assert.Equal(suite.T(), "To log in, open the following URL in a browser on any device:\n\n"+
+		"    https://login.example.org/device\n\nand enter the code: ABCD-EFGH\n", out.String())
+}
+
+func (suite *LoginTestSuite) TestWaitForLogin() {
+	polls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(suite.T(), r.ParseForm())
+		assert.Equal(suite.T(), "device-code", r.PostForm.Get("device_code"))
+
+		polls++
+		if polls < 3 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error": "authorization_pending"}`)
+
+			return
+		}
+		fmt.Fprint(w, `{"access_token": "token", "token_type": "Bearer"}`)
+	}))
+	defer ts.Close()
+
+	login := DeviceLogin{
+		ClientID:    "client",
+		wellKnown:   &OIDCWellKnown{TokenEndpoint: ts.URL},
+		deviceLogin: &DeviceLoginResponse{DeviceCode: "device-code", ExpiresIn: 60},
+	}
+	result, err := login.waitForLogin()
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "token", result.AccessToken)
+	assert.Equal(suite.T(), 3, polls)
+}
+
+func (suite *LoginTestSuite) TestWaitForLoginDenied() {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error": "access_denied"}`)
+	}))
+	defer ts.Close()
+
+	login := DeviceLogin{
+		wellKnown:   &OIDCWellKnown{TokenEndpoint: ts.URL},
+		deviceLogin: &DeviceLoginResponse{DeviceCode: "device-code", ExpiresIn: 60},
+	}
+	_, err := login.waitForLogin()
+	assert.EqualError(suite.T(), err, "login was denied")
+}
+
+func (suite *LoginTestSuite) TestRefresh() {
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			fmt.Fprintf(w, `{"token_endpoint": "%s/token"}`, ts.URL)
+		case "/token":
+			assert.NoError(suite.T(), r.ParseForm())
+			assert.Equal(suite.T(), "refresh_token", r.PostForm.Get("grant_type"))
+			assert.Equal(suite.T(), "old-refresh", r.PostForm.Get("refresh_token"))
+			fmt.Fprint(w, `{"access_token": "new-access", "token_type": "Bearer"}`)
+		case "/userinfo":
+			assert.Equal(suite.T(), "Bearer new-access", r.Header.Get("Authorization"))
+			fmt.Fprint(w, `{"sub": "user@example.org", "name": "Test User"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	cwd, err := os.Getwd()
+	assert.NoError(suite.T(), err)
+	assert.NoError(suite.T(), os.Chdir(suite.T().TempDir()))
+	defer func() { assert.NoError(suite.T(), os.Chdir(cwd)) }()
+
+	suite.T().Setenv("XDG_CONFIG_HOME", suite.T().TempDir())
+	login := DeviceLogin{BaseURL: ts.URL, ClientID: "client", S3Target: "inbox.example.org"}
+
+	// Without a previous login there is nothing to refresh
+	assert.ErrorContains(suite.T(), login.Refresh(), "failed to read previous login")
+
+	// The session is read from the deprecated location in the current directory
+	err = os.WriteFile(".sda-cli-session", []byte("[default]\naccess_key = user@example.org\n"+
+		"access_token = old-access\nhost_base = inbox.example.org\nrefresh_token = old-refresh\n"), 0600)
+	assert.NoError(suite.T(), err)
+
+	assert.NoError(suite.T(), login.Refresh())
+	assert.Equal(suite.T(), "Test User", login.UserInfo.Name)
+
+	sessionPath, err := helpers.SessionPath()
+	assert.NoError(suite.T(), err)
+	config, err := helpers.LoadConfigFile(sessionPath, "")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "new-access", config.AccessToken)
+	// The refresh token is kept when the server does not return a new one
+	assert.Equal(suite.T(), "old-refresh", config.RefreshToken)
+}
+
+func (suite *LoginTestSuite) TestUpdateProfile() {
+	home := suite.T().TempDir()
+	suite.T().Setenv("HOME", home)
+
+	for _, name := range []string{"bp", "fega"} {
+		login := DeviceLogin{
+			Profile:     name,
+			S3Target:    name + ".example.org",
+			LoginResult: &Result{AccessToken: name + "-token"},
+			UserInfo:    &UserInfo{Sub: name + "-user"},
+		}
+		assert.NoError(suite.T(), login.UpdateConfigFile())
+	}
+
+	// Both profiles are kept in the file
+	for _, name := range []string{"bp", "fega"} {
+		config, err := helpers.GetAuth("", name)
+		assert.NoError(suite.T(), err)
+		assert.Equal(suite.T(), name+"-token", config.AccessToken)
+		assert.Equal(suite.T(), name+"-user", config.AccessKey)
+	}
+	assert.NoFileExists(suite.T(), ".sda-cli-session")
+}
+
+func (suite *LoginTestSuite) TestPrintTokenExpiration() {
+	expiration := time.Now().Add(72 * time.Hour).Truncate(time.Second)
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"exp": expiration.Unix()}).SignedString([]byte("secret"))
+	assert.NoError(suite.T(), err)
+
+	var out bytes.Buffer
+	printTokenExpiration(&out, token, true)
+	assert.Equal(suite.T(), "Token valid until: "+expiration.Local().Format(time.RFC1123)+"\n", out.String())
+
+	// A token that expires soon gets a warning, in yellow on a terminal
+	expiration = time.Now().Add(time.Hour)
+	token, err = jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"exp": expiration.Unix()}).SignedString([]byte("secret"))
+	assert.NoError(suite.T(), err)
+
+	out.Reset()
+	printTokenExpiration(&out, token, false)
+	assert.True(suite.T(), strings.HasSuffix(out.String(), "\nWarning: the token expires in 59m\n"))
+
+	out.Reset()
+	printTokenExpiration(&out, token, true)
+	assert.True(suite.T(), strings.HasSuffix(out.String(), "\n\033[33mWarning: the token expires in 59m\033[0m\n"))
+
+	// An expired token is not said to expire in some time
+	expiration = time.Now().Add(-time.Hour)
+	token, err = jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"exp": expiration.Unix()}).SignedString([]byte("secret"))
+	assert.NoError(suite.T(), err)
+
+	out.Reset()
+	printTokenExpiration(&out, token, false)
+	assert.True(suite.T(), strings.HasSuffix(out.String(), "\nWarning: the token has expired\n"))
+}
+
+func (suite *LoginTestSuite) TestNewDeviceLoginWithoutTarget() {
+	// The login target cannot be chosen when stdin is not a terminal
+	_, err := NewDeviceLogin([]string{"login"})
+	assert.EqualError(suite.T(), err, "a login target is required, reason: cannot ask to choose, stdin is not a terminal")
+}
+
+func (suite *LoginTestSuite) TestNewDeviceLoginTooManyTargets() {
+	_, err := NewDeviceLogin([]string{"login", "https://login.example.org", "https://other.example.org"})
+	assert.EqualError(suite.T(), err, "only one login target can be given, got 2")
+
+	// The reason of the failure is kept by NewLogin
+	err = NewLogin([]string{"login"})
+	assert.EqualError(suite.T(), err, "failed to start the login: a login target is required, reason: cannot ask to choose, stdin is not a terminal")
+}
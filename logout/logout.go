@@ -0,0 +1,129 @@
+package logout
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/NBISweden/sda-cli/helpers"
+	"gopkg.in/ini.v1"
+)
+
+// Help text and command line flags.
+
+// Usage text that will be displayed as command line help text when using the
+// `help logout` command
+var Usage = `
+USAGE: %s logout (-profile <name>) (-y)
+
+logout:
+    Removes the session file of a previous login, so that the
+    credentials are not left on disk when they are no longer needed.
+    With '-profile', only the named profile is removed from
+    ~/.sda-cli/config.  The removal has to be confirmed, unless '-y'
+    is given.
+`
+
+// ArgHelp is the suffix text that will be displayed after the argument list in
+// the module help
+var ArgHelp = `
+    logout does not take any arguments`
+
+// Args is a flagset that needs to be exported so that it can be written to the
+// main program help
+var Args = flag.NewFlagSet("logout", flag.ExitOnError)
+
+var profile = Args.String("profile", "",
+	"Remove the named profile from ~/.sda-cli/config.")
+
+var assumeYes = Args.Bool("y", false,
+	"Remove the session without asking for confirmation.")
+
+// Long names of the short flags
+func init() {
+	helpers.AliasFlag(Args, "y", "yes")
+}
+
+// Logout removes the session file of a previous login, or the profile given
+// with `-profile`.
+func Logout(args []string) error {
+	err := Args.Parse(args[1:])
+	if err != nil {
+		return fmt.Errorf("could not parse arguments: %s", err)
+	}
+	if len(Args.Args()) > 0 {
+		return errors.New("logout does not take any arguments")
+	}
+
+	if *profile != "" {
+		return removeProfile(*profile, helpers.PromptConfirm)
+	}
+
+	return removeSession(helpers.PromptConfirm)
+}
+
+// removeSession deletes the session file, after it is confirmed with confirm.
+func removeSession(confirm func(string) (bool, error)) error {
+	sessionPath, err := helpers.FindSessionFile()
+	if err != nil {
+		return fmt.Errorf("no session to log out from, reason: %w", err)
+	}
+
+	if !*assumeYes {
+		confirmed, err := confirm(fmt.Sprintf("Remove the session in %s?", sessionPath))
+		if err != nil {
+			return err
+		}
+		if !confirmed {
+			fmt.Println("Logout cancelled")
+
+			return nil
+		}
+	}
+
+	err = os.Remove(sessionPath)
+	if err != nil {
+		return fmt.Errorf("failed to remove session, reason: %w", err)
+	}
+	fmt.Printf("Logged out, removed %s\n", sessionPath)
+
+	return nil
+}
+
+// removeProfile deletes the section of the profile from ~/.sda-cli/config,
+// keeping the other profiles, after it is confirmed with confirm.
+func removeProfile(name string, confirm func(string) (bool, error)) error {
+	profilesPath, err := helpers.ProfilesPath()
+	if err != nil {
+		return err
+	}
+	cfg, err := ini.Load(profilesPath)
+	if err != nil {
+		return fmt.Errorf("failed to read profiles, reason: %w", err)
+	}
+	if !cfg.HasSection(name) {
+		return fmt.Errorf("profile %s not found in %s", name, profilesPath)
+	}
+
+	if !*assumeYes {
+		confirmed, err := confirm(fmt.Sprintf("Remove the profile %s from %s?", name, profilesPath))
+		if err != nil {
+			return err
+		}
+		if !confirmed {
+			fmt.Println("Logout cancelled")
+
+			return nil
+		}
+	}
+
+	cfg.DeleteSection(name)
+	err = cfg.SaveTo(profilesPath)
+	if err != nil {
+		return fmt.Errorf("failed to remove profile, reason: %w", err)
+	}
+	fmt.Printf("Logged out, removed profile %s\n", name)
+
+	return nil
+}
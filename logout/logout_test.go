@@ -0,0 +1,81 @@
+package logout
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/NBISweden/sda-cli/helpers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type LogoutTests struct {
+	suite.Suite
+}
+
+func TestLogoutTestSuite(t *testing.T) {
+	suite.Run(t, new(LogoutTests))
+}
+
+func (suite *LogoutTests) TestRemoveSession() {
+	suite.T().Setenv("XDG_CONFIG_HOME", suite.T().TempDir())
+	sessionPath, err := helpers.SessionPath()
+	assert.NoError(suite.T(), err)
+
+	err = removeSession(answer(true))
+	assert.ErrorContains(suite.T(), err, "no session to log out from")
+
+	assert.NoError(suite.T(), os.MkdirAll(filepath.Dir(sessionPath), 0700))
+	assert.NoError(suite.T(), os.WriteFile(sessionPath, []byte("access_token = token\n"), 0600))
+
+	// The session is kept if the removal is not confirmed
+	assert.NoError(suite.T(), removeSession(answer(false)))
+	assert.FileExists(suite.T(), sessionPath)
+
+	// Nothing is removed if the confirmation cannot be asked for
+	err = removeSession(func(string) (bool, error) {
+		return false, errors.New("stdin is not a terminal")
+	})
+	assert.EqualError(suite.T(), err, "stdin is not a terminal")
+	assert.FileExists(suite.T(), sessionPath)
+
+	assert.NoError(suite.T(), removeSession(answer(true)))
+	assert.NoFileExists(suite.T(), sessionPath)
+}
+
+// answer returns a confirmation function that gives the answer
+func answer(yes bool) func(string) (bool, error) {
+	return func(string) (bool, error) {
+		return yes, nil
+	}
+}
+
+func (suite *LogoutTests) TestLogoutProfile() {
+	home := suite.T().TempDir()
+	suite.T().Setenv("HOME", home)
+	profilesPath, err := helpers.ProfilesPath()
+	assert.NoError(suite.T(), err)
+	assert.NoError(suite.T(), os.MkdirAll(filepath.Dir(profilesPath), 0700))
+	err = os.WriteFile(profilesPath, []byte("[bp]\naccess_key = bpUser\naccess_token = bpToken\nhost_base = bp.example.org\n\n"+
+		"[fega]\naccess_key = fegaUser\naccess_token = fegaToken\nhost_base = fega.example.org\n"), 0600)
+	assert.NoError(suite.T(), err)
+
+	defer func() {
+		*profile = ""
+		*assumeYes = false
+	}()
+
+	err = Logout([]string{"logout", "-y", "-profile", "gdi"})
+	assert.ErrorContains(suite.T(), err, "profile gdi not found")
+
+	err = Logout([]string{"logout", "-y", "-profile", "bp"})
+	assert.NoError(suite.T(), err)
+
+	_, err = helpers.LoadConfigFile(profilesPath, "bp")
+	assert.ErrorContains(suite.T(), err, "profile bp not found")
+	config, err := helpers.LoadConfigFile(profilesPath, "fega")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "fegaUser", config.AccessKey)
+}
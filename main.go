@@ -3,27 +3,87 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"os"
 
+	"github.com/NBISweden/sda-cli/completion"
+	"github.com/NBISweden/sda-cli/config"
+	"github.com/NBISweden/sda-cli/copyfile"
 	createKey "github.com/NBISweden/sda-cli/create_key"
 	"github.com/NBISweden/sda-cli/datasetsize"
 	"github.com/NBISweden/sda-cli/decrypt"
+	"github.com/NBISweden/sda-cli/deletefile"
+	"github.com/NBISweden/sda-cli/diff"
 	"github.com/NBISweden/sda-cli/download"
 	"github.com/NBISweden/sda-cli/encrypt"
+	"github.com/NBISweden/sda-cli/export"
 	"github.com/NBISweden/sda-cli/helpers"
 	"github.com/NBISweden/sda-cli/list"
 	"github.com/NBISweden/sda-cli/login"
+	"github.com/NBISweden/sda-cli/logout"
+	"github.com/NBISweden/sda-cli/move"
+	"github.com/NBISweden/sda-cli/remote"
+	"github.com/NBISweden/sda-cli/status"
+	"github.com/NBISweden/sda-cli/syncdir"
+	"github.com/NBISweden/sda-cli/token"
 	"github.com/NBISweden/sda-cli/upload"
+	"github.com/NBISweden/sda-cli/verify"
 	"github.com/NBISweden/sda-cli/version"
 	log "github.com/sirupsen/logrus"
 )
 
 var Version = "development"
 
-var Usage = `USAGE: %s <command> [command-args]
+var Usage = `USAGE: %s (-v | -vv) (-y | --assume-yes) (-config <s3config-file>) (-proxy <url>) (-ca-cert <pem-file>) (-timeout <duration>) (-remote <name>) (-log-file <file>) (-log-format text|json) (-insecure) (-no-progress) (-json-errors) <command> [command-args]
 
 This is a helper tool that can help with common tasks when interacting
 with the Sensitive Data Archive (SDA).
+
+Global flags, given before the command:
+    -v, --verbose
+        Print debug logs, e.g. of the HTTP requests that are made and
+        the configuration file that is used.
+    -vv
+        Also print the debug logs of the S3 client.
+    -y, --assume-yes
+        Answer yes to all confirmation prompts, e.g. before files are
+        deleted, for automation.  A warning is logged for each prompt.
+    -config <s3config-file>
+        Configuration file to use for all commands, instead of the
+        session of a previous login.  Takes precedence over the
+        SDA_CLI_CONFIG environment variable.
+    -proxy <url>
+        HTTP proxy to use for the connections to the archive and the
+        login service.  Takes precedence over the SDA_CLI_PROXY,
+        HTTPS_PROXY and HTTP_PROXY environment variables.
+    -ca-cert <pem-file>
+        CA certificates to trust, in addition to the system's, for
+        deployments that use an internal PKI.
+    -timeout <duration>
+        Socket timeout of the connections, e.g. 90s.  Overrides the
+        socket_timeout of the configuration, which is 30 seconds by
+        default.
+    -remote <name>
+        Remote, a named profile in ~/.sda-cli/config, to use for all
+        commands unless they are given a profile of their own.  See
+        the remote command.
+    -log-file <file>
+        Also write the logs to the file, which is appended to.  The file
+        gets all logs, at the debug level, while only the warnings and
+        errors are printed, or the debug logs too with -v.
+    -log-format text|json
+        Format of the logs, text by default, or json with one object
+        per line, e.g. for log aggregation systems.
+    -insecure
+        Do not verify the TLS certificate of the archive.  Only for
+        development, the connection is not secure.
+    -no-progress
+        Do not show progress bars, e.g. when the output is logged.  They
+        are also not shown when stdout is not a terminal, or when the
+        SDA_CLI_NO_PROGRESS environment variable is set to 1.
+    -json-errors
+        Print errors to stdout as JSON, {"error": "...", "code": <int>},
+        with the exit code of the error.
 `
 
 // Map of the sub-commands, and their arguments and usage text strings
@@ -37,21 +97,71 @@ var Commands = map[string]commandInfo{
 	"encrypt":     {encrypt.Args, encrypt.Usage, encrypt.ArgHelp},
 	"createKey":   {createKey.Args, createKey.Usage, createKey.ArgHelp},
 	"decrypt":     {decrypt.Args, decrypt.Usage, decrypt.ArgHelp},
+	"delete":      {deletefile.Args, deletefile.Usage, deletefile.ArgHelp},
+	"diff":        {diff.Args, diff.Usage, diff.ArgHelp},
 	"download":    {download.Args, download.Usage, download.ArgHelp},
+	"export":      {export.Args, export.Usage, export.ArgHelp},
 	"upload":      {upload.Args, upload.Usage, upload.ArgHelp},
 	"datasetsize": {datasetsize.Args, datasetsize.Usage, datasetsize.ArgHelp},
 	"list":        {list.Args, list.Usage, list.ArgHelp},
 	"login":       {login.Args, login.Usage, login.ArgHelp},
+	"logout":      {logout.Args, logout.Usage, logout.ArgHelp},
+	"move":        {move.Args, move.Usage, move.ArgHelp},
+	"remote":      {remote.Args, remote.Usage, remote.ArgHelp},
+	"status":      {status.Args, status.Usage, status.ArgHelp},
+	"sync":        {syncdir.Args, syncdir.Usage, syncdir.ArgHelp},
+	"token":       {token.Args, token.Usage, token.ArgHelp},
+	"completion":  {completion.Args, completion.Usage, completion.ArgHelp},
+	"config":      {config.Args, config.Usage, config.ArgHelp},
+	"copy":        {copyfile.Args, copyfile.Usage, copyfile.ArgHelp},
+	"verify":      {verify.Args, verify.Usage, verify.ArgHelp},
 	"version":     {version.Args, version.Usage, version.ArgHelp},
 }
 
+// jsonErrors is set by the global -json-errors flag
+var jsonErrors bool
+
+// proxy is set by the global -proxy flag
+var proxy string
+
+// caCert is set by the global -ca-cert flag
+var caCert string
+
+// timeout is set by the global -timeout flag
+var timeout string
+
+// logFile is set by the global -log-file flag
+var logFile string
+
+// logFormat is set by the global -log-format flag
+var logFormat string
+
 // Main does argument parsing, then delegates to one of the sub modules
 func main() {
 
 	log.SetLevel(log.WarnLevel)
 	command, args := ParseArgs()
 
-	var err error
+	err := helpers.SetLogFormat(logFormat)
+	if err != nil {
+		exitWithError(err)
+	}
+	err = helpers.SetLogFile(logFile)
+	if err != nil {
+		exitWithError(err)
+	}
+	err = helpers.SetProxy(proxy)
+	if err != nil {
+		exitWithError(err)
+	}
+	err = helpers.SetCACert(caCert)
+	if err != nil {
+		exitWithError(err)
+	}
+	err = helpers.SetTimeout(timeout)
+	if err != nil {
+		exitWithError(err)
+	}
 
 	switch command {
 	case "encrypt":
@@ -60,8 +170,14 @@ func main() {
 		err = createKey.CreateKey(args)
 	case "decrypt":
 		err = decrypt.Decrypt(args)
+	case "delete":
+		err = deletefile.Delete(args)
+	case "diff":
+		err = diff.Diff(args)
 	case "download":
 		err = download.Download(args)
+	case "export":
+		err = export.Export(args)
 	case "upload":
 		err = upload.Upload(args)
 	case "datasetsize":
@@ -70,14 +186,105 @@ func main() {
 		err = list.List(args)
 	case "login":
 		err = login.NewLogin(args)
+	case "logout":
+		err = logout.Logout(args)
+	case "move":
+		err = move.Move(args)
+	case "remote":
+		err = remote.Remote(args)
+	case "status":
+		err = status.Status(args)
+	case "sync":
+		err = syncdir.Sync(args)
+	case "token":
+		err = token.Token(args)
+	case "completion":
+		err = completion.Completion(args, completionCommands())
+	case "config":
+		err = config.Config(args)
+	case "copy":
+		err = copyfile.Copy(args)
+	case "verify":
+		err = verify.Verify(args)
 	case "version":
-		err = version.Version(Version)
+		err = version.Version(args, Version)
 	default:
 		fmt.Fprintf(os.Stderr, "Unknown command: %s", command)
 	}
 	if err != nil {
+		exitWithError(err)
+	}
+}
+
+// exitWithError prints the error, as JSON with the global -json-errors flag,
+// and exits with the exit code of the error
+func exitWithError(err error) {
+	if jsonErrors {
+		helpers.PrintJSONError(os.Stdout, err)
+	} else {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 	}
+	os.Exit(helpers.ExitCode(err))
+}
+
+// completionCommands returns the sub-commands for the shell completions
+func completionCommands() []completion.Command {
+	commands := make([]completion.Command, 0, len(Commands))
+	for name, info := range Commands {
+		commands = append(commands, completion.Command{Name: name, Usage: info.usage, Args: info.args})
+	}
+
+	return commands
+}
+
+// GlobalArgs are the global flags, which are given before the command
+var GlobalArgs = flag.NewFlagSet("global", flag.ContinueOnError)
+
+// debug and debugS3 are set by the global -v and -vv flags
+var debug, debugS3 bool
+
+func init() {
+	GlobalArgs.BoolVar(&debug, "v", false, "Print debug logs.")
+	GlobalArgs.BoolVar(&debugS3, "vv", false, "Also print the debug logs of the S3 client.")
+	GlobalArgs.BoolVar(&helpers.AssumeYes, "y", false, "Answer yes to all confirmation prompts.")
+	GlobalArgs.BoolVar(&jsonErrors, "json-errors", false, "Print errors to stdout as JSON.")
+	GlobalArgs.BoolVar(&helpers.Insecure, "insecure", false, "Do not verify the TLS certificate of the archive.")
+	GlobalArgs.BoolVar(&helpers.NoProgress, "no-progress", false, "Do not show progress bars.")
+	GlobalArgs.StringVar(&helpers.ConfigPath, "config", "", "Configuration file to use for all commands.")
+	GlobalArgs.StringVar(&proxy, "proxy", "", "HTTP proxy to use for the connections.")
+	GlobalArgs.StringVar(&caCert, "ca-cert", "", "CA certificates to trust, in addition to the system's.")
+	GlobalArgs.StringVar(&timeout, "timeout", "", "Socket timeout of the connections.")
+	GlobalArgs.StringVar(&helpers.Remote, "remote", helpers.Remote, "Remote to use for all commands.")
+	GlobalArgs.StringVar(&logFile, "log-file", "", "Also write the logs to the file.")
+	GlobalArgs.StringVar(&logFormat, "log-format", "", "Format of the logs, text or json.")
+	helpers.AliasFlag(GlobalArgs, "v", "verbose")
+	helpers.AliasFlag(GlobalArgs, "y", "assume-yes")
+
+	// The global flags are described in the main usage text
+	GlobalArgs.SetOutput(io.Discard)
+}
+
+// parseGlobalFlags parses the global flags before the command, and removes
+// them from os.Args. The main help is printed if the flags are invalid, or if
+// no command follows them.
+func parseGlobalFlags() {
+	if err := GlobalArgs.Parse(os.Args[1:]); err != nil {
+		if err != flag.ErrHelp {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		}
+		Help("help")
+	}
+	if GlobalArgs.NArg() == 0 {
+		Help("help")
+	}
+	os.Args = append(os.Args[:1], GlobalArgs.Args()...)
+
+	switch {
+	case debugS3:
+		helpers.EnableDebugLogging(true)
+	case debug:
+		helpers.EnableDebugLogging(false)
+	}
 }
 
 // Parses the command line arguments into a command, and keep the rest of the
@@ -89,12 +296,24 @@ func ParseArgs() (string, []string) {
 		Help("help")
 	}
 
+	// Global flags are given before the command. A single -v without
+	// a command is the version flag below, and the help and version flags
+	// are handled as commands.
+	switch os.Args[1] {
+	case "-h", "-help", "--help", "-version", "--version":
+	default:
+		if len(os.Args) > 2 || os.Args[1] != "-v" {
+			parseGlobalFlags()
+		}
+	}
+
 	if os.Args[1] == "version" || os.Args[1] == "-v" || os.Args[1] == "--version" {
-		if len(os.Args) != 2 {
+		// Only the version command takes flags
+		if len(os.Args) != 2 && os.Args[1] != "version" {
 			Help("version")
 		}
 
-		return "version", os.Args
+		return "version", append(os.Args[:1], os.Args[2:]...)
 	}
 
 	// Extract `command` from arg 1, then remove it from the flag list.
@@ -113,9 +332,10 @@ func ParseArgs() (string, []string) {
 		Help(subcommand)
 	}
 
-	// list command can have no arguments since it can use the config from login
-	// so we immediately return in that case
-	if command == "list" {
+	// list, status, token and export commands can have no arguments since
+	// they can use the config from login, logout needs no arguments, and
+	// login asks for the login target, so we immediately return in that case
+	if command == "list" || command == "logout" || command == "status" || command == "token" || command == "export" || command == "login" {
 		return command, os.Args
 	}
 
@@ -0,0 +1,147 @@
+package move
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/NBISweden/sda-cli/copyfile"
+	"github.com/NBISweden/sda-cli/helpers"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Help text and command line flags.
+
+// Usage text that will be displayed as command line help text when using the
+// `help move` command
+var Usage = `
+USAGE: %s move [-config <s3config-file>] [-profile <name>] (-force-overwrite) [src-key] [dst-key]
+
+move:
+    Moves or renames a file in the user's folder in the Sensitive Data
+    Archive (SDA), on the server, without downloading and uploading it
+    again.  The file is copied to the new key, and removed from the old
+    key once the copy has been verified.  If no config is specified, the
+    tool will look for a previous session, or the profile given with
+    '-profile' in ~/.sda-cli/config.
+`
+
+// ArgHelp is the suffix text that will be displayed after the argument list in
+// the module help
+var ArgHelp = `
+    [src-key]
+        The key of the file to move.
+    [dst-key]
+        The key to move the file to.`
+
+// Args is a flagset that needs to be exported so that it can be written to the
+// main program help
+var Args = flag.NewFlagSet("move", flag.ExitOnError)
+
+var configPath = Args.String("config", "",
+	"S3 config file to use for moving.")
+
+var profile = Args.String("profile", "",
+	"Named profile in ~/.sda-cli/config to use instead of the session file.")
+
+var forceOverwrite = Args.Bool("force-overwrite", false,
+	"Overwrite the destination file if it exists.")
+
+// Move moves a file from the source key to the destination key on the server.
+func Move(args []string) error {
+	// Call ParseArgs to take care of all the flag parsing
+	err := helpers.ParseArgs(args, Args)
+	if err != nil {
+		return fmt.Errorf("failed parsing arguments, reason: %w", err)
+	}
+
+	if len(Args.Args()) != 2 {
+		return errors.New("a source and a destination key are required")
+	}
+	srcKey, dstKey := strings.TrimPrefix(Args.Args()[0], "/"), strings.TrimPrefix(Args.Args()[1], "/")
+	if srcKey == "" || dstKey == "" {
+		return errors.New("the source and the destination keys can not be empty")
+	}
+	if srcKey == dstKey {
+		return errors.New("the source and the destination are the same file")
+	}
+
+	// Get the configuration file or the .sda-cli-session
+	config, err := helpers.GetAuth(*configPath, *profile)
+	if err != nil {
+		return fmt.Errorf("failed to load config file, reason: %w", err)
+	}
+
+	err = helpers.WarnTokenExpiration(config)
+	if err != nil {
+		return err
+	}
+
+	sess, err := helpers.NewS3Session(config)
+	if err != nil {
+		return err
+	}
+	svc := s3.New(sess)
+
+	err = moveFile(svc, config.AccessKey, srcKey, dstKey, config.MultipartChunkSizeMb*1024*1024)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("moved %s to %s\n", srcKey, dstKey)
+
+	return nil
+}
+
+// moveFile copies the object at srcKey to dstKey, and deletes the object at
+// srcKey once the copy is verified
+func moveFile(svc *s3.S3, bucket, srcKey, dstKey string, partSize int64) error {
+	copyETag, err := copyfile.CopyFile(svc, bucket, srcKey, bucket, dstKey, partSize, *forceOverwrite)
+	if err != nil {
+		return err
+	}
+
+	src, err := svc.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String(srcKey)})
+	if err != nil {
+		return fmt.Errorf("failed to get information about %s, reason: %w", srcKey, err)
+	}
+	dst, err := svc.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String(dstKey)})
+	if err != nil {
+		return fmt.Errorf("failed to get information about %s, reason: %w", dstKey, err)
+	}
+	if err := verifyCopy(src, dst, copyETag); err != nil {
+		return fmt.Errorf("the copy of %s to %s could not be verified, the file is kept, reason: %w", srcKey, dstKey, err)
+	}
+
+	_, err = svc.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String(bucket), Key: aws.String(srcKey)})
+	if err != nil {
+		return fmt.Errorf("%s was copied to %s, but could not be removed, reason: %w", srcKey, dstKey, err)
+	}
+
+	return nil
+}
+
+// verifyCopy checks that the copy has the same size as the source, and that
+// the object at the destination is the copy that was made, with the ETag
+// returned by the copy. The ETag of objects that were uploaded or copied in
+// several parts depends on the size of the parts, so the ETags of the source
+// and the copy are only compared when neither was made in parts. The ETag of
+// a copy made in parts is instead checked against its parts by the copy.
+func verifyCopy(src, dst *s3.HeadObjectOutput, copyETag string) error {
+	srcSize, dstSize := aws.Int64Value(src.ContentLength), aws.Int64Value(dst.ContentLength)
+	if srcSize != dstSize {
+		return fmt.Errorf("the size of the copy is %d instead of %d", dstSize, srcSize)
+	}
+
+	srcETag, dstETag := strings.Trim(aws.StringValue(src.ETag), `"`), strings.Trim(aws.StringValue(dst.ETag), `"`)
+	copyETag = strings.Trim(copyETag, `"`)
+	if !strings.EqualFold(dstETag, copyETag) {
+		return fmt.Errorf("the checksum of the copy is %s instead of %s", dstETag, copyETag)
+	}
+	if !strings.Contains(srcETag, "-") && !strings.Contains(dstETag, "-") && !strings.EqualFold(srcETag, dstETag) {
+		return fmt.Errorf("the checksum of the copy is %s instead of %s", dstETag, srcETag)
+	}
+
+	return nil
+}
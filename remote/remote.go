@@ -0,0 +1,263 @@
+package remote
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/NBISweden/sda-cli/helpers"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/ini.v1"
+)
+
+// Help text and command line flags.
+
+// Usage text that will be displayed as command line help text when using the
+// `help remote` command
+var Usage = `
+USAGE: %s remote [add|remove|list] (-access-key <key>) (-access-token <token>) (-public-key <key>) (-private-key <key-file>) (-tls-cert <pem-file>) (-tls-key <pem-file>) [name] [url]
+
+remote:
+    Manages the named SDA instances, the remotes, in ~/.sda-cli/config.
+    A remote is a named profile, so it can be used with '-profile' by
+    the other commands, or with the global '-remote <name>' flag, which
+    selects the remote for every command.  With 'add', a remote is
+    added with the URL of its inbox and the given credentials and keys.
+    A login with '-remote <name>' stores its tokens in the remote.
+    With 'remove', the remote is removed, and with 'list', the remotes
+    are listed with their URLs.  The flags are only used by 'add'.
+    Give '-access-token -' to read the access token from stdin, or set
+    it in the SDA_CLI_ACCESS_TOKEN environment variable, since a token
+    given on the command line can be seen by other users of the system.
+`
+
+// ArgHelp is the suffix text that will be displayed after the argument list in
+// the module help
+var ArgHelp = `
+    [add <name> <url>]
+        Add a remote with the URL of its inbox, e.g.
+        https://inbox.sda.example.com.
+    [remove <name>]
+        Remove the remote.
+    [list]
+        List the remotes.`
+
+// Args is a flagset that needs to be exported so that it can be written to the
+// main program help
+var Args = flag.NewFlagSet("remote", flag.ExitOnError)
+
+var accessKey = Args.String("access-key", "",
+	"Access key, the user name, of the remote.")
+
+var accessToken = Args.String("access-token", "",
+	"Access token of the remote, or - to read it from stdin.  It is read\n"+
+		"from SDA_CLI_ACCESS_TOKEN if not given.")
+
+var publicKey = Args.String("public-key", "",
+	"Public key of the remote that files are encrypted with, or a https\n"+
+		"URL to download it from.")
+
+var privateKey = Args.String("private-key", "",
+	"Private key file to decrypt downloaded files with.")
+
+var tlsCert = Args.String("tls-cert", "",
+	"TLS client certificate to authenticate to the remote with.")
+
+var tlsKey = Args.String("tls-key", "",
+	"Private key of the TLS client certificate.")
+
+// Remote runs the mode of the remote command given as argument.
+func Remote(args []string) error {
+	err := helpers.ParseArgs(args, Args)
+	if err != nil {
+		return fmt.Errorf("failed parsing arguments, reason: %w", err)
+	}
+	if len(Args.Args()) == 0 {
+		return errors.New("a mode must be given, add, remove or list")
+	}
+
+	profilesPath, err := helpers.ProfilesPath()
+	if err != nil {
+		return err
+	}
+
+	mode, modeArgs := Args.Args()[0], Args.Args()[1:]
+	switch mode {
+	case "add":
+		if len(modeArgs) != 2 {
+			return errors.New("a name and a URL are required to add a remote")
+		}
+
+		return addRemote(profilesPath, modeArgs[0], modeArgs[1])
+	case "remove", "rm":
+		if len(modeArgs) != 1 {
+			return errors.New("the name of the remote to remove is required")
+		}
+
+		return removeRemote(profilesPath, modeArgs[0])
+	case "list", "ls":
+		if len(modeArgs) != 0 {
+			return errors.New("list takes no arguments")
+		}
+
+		return listRemotes(profilesPath, os.Stdout)
+	default:
+		return fmt.Errorf("unsupported mode: %s", mode)
+	}
+}
+
+// addRemote writes a new section for the remote to the profiles file, with
+// the endpoint of the URL and the credentials and keys from the flags
+func addRemote(profilesPath, name, rawURL string) error {
+	if name == "" || strings.ContainsAny(name, "[]") {
+		return helpers.WithCategory(helpers.ErrConfig, fmt.Errorf("invalid remote name: %q", name))
+	}
+	endpoint, err := url.Parse(rawURL)
+	if err != nil || endpoint.Host == "" || (endpoint.Scheme != "https" && endpoint.Scheme != "http") {
+		return helpers.WithCategory(helpers.ErrConfig, fmt.Errorf("invalid remote URL: %s, a http or https URL is required", rawURL))
+	}
+
+	err = os.MkdirAll(filepath.Dir(profilesPath), 0700)
+	if err != nil {
+		return err
+	}
+	cfg, err := ini.LooseLoad(profilesPath)
+	if err != nil {
+		return fmt.Errorf("failed to read remotes, reason: %w", err)
+	}
+	if cfg.HasSection(name) {
+		return fmt.Errorf("remote %s already exists in %s", name, profilesPath)
+	}
+
+	// The https scheme is added to host_base when the configuration is
+	// loaded, so it is only kept for plain http
+	hostBase := strings.TrimSuffix(endpoint.Host+endpoint.Path, "/")
+	useHTTPS := endpoint.Scheme == "https"
+	if !useHTTPS {
+		hostBase = endpoint.Scheme + "://" + hostBase
+	}
+
+	token, err := readAccessToken(*accessToken, os.Stdin)
+	if err != nil {
+		return err
+	}
+
+	section := cfg.Section(name)
+	values := [][2]string{
+		{"host_base", hostBase},
+		{"host_bucket", hostBase},
+		{"use_https", fmt.Sprint(useHTTPS)},
+		{"check_ssl_certificate", "true"},
+		{"check_ssl_hostname", "true"},
+		{"encoding", "UTF-8"},
+		{"access_key", *accessKey},
+		{"secret_key", *accessKey},
+		{"access_token", token},
+		{"public_key", *publicKey},
+		{"private_key", *privateKey},
+		{"tls_cert", *tlsCert},
+		{"tls_key", *tlsKey},
+	}
+	for _, value := range values {
+		if value[1] != "" {
+			section.Key(value[0]).SetValue(value[1])
+		}
+	}
+
+	err = cfg.SaveTo(profilesPath)
+	if err != nil {
+		return fmt.Errorf("failed to add remote, reason: %w", err)
+	}
+	fmt.Printf("Added remote %s, %s\n", name, remoteURL(hostBase, useHTTPS))
+
+	return os.Chmod(profilesPath, 0600)
+}
+
+// readAccessToken returns the access token given with -access-token. The
+// token is read from the first line of stdin if the flag is "-", and from the
+// SDA_CLI_ACCESS_TOKEN environment variable if it is not given. A token given
+// on the command line is visible to the other users of the system, e.g. in
+// the output of ps, so a warning is logged then.
+func readAccessToken(value string, stdin io.Reader) (string, error) {
+	switch value {
+	case "":
+		return os.Getenv("SDA_CLI_ACCESS_TOKEN"), nil
+	case "-":
+		line, err := bufio.NewReader(stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return "", fmt.Errorf("failed to read the access token from stdin, reason: %w", err)
+		}
+		token := strings.TrimSpace(line)
+		if token == "" {
+			return "", errors.New("no access token given on stdin")
+		}
+
+		return token, nil
+	default:
+		log.Warn("The access token given on the command line can be seen by other users of the system, " +
+			"use '-access-token -' to read it from stdin, or the SDA_CLI_ACCESS_TOKEN environment variable, instead")
+
+		return value, nil
+	}
+}
+
+// removeRemote deletes the section of the remote from the profiles file,
+// keeping the other remotes
+func removeRemote(profilesPath, name string) error {
+	cfg, err := ini.Load(profilesPath)
+	if err != nil {
+		return fmt.Errorf("failed to read remotes, reason: %w", err)
+	}
+	if !cfg.HasSection(name) {
+		return helpers.WithCategory(helpers.ErrConfig, fmt.Errorf("remote %s not found in %s", name, profilesPath))
+	}
+
+	cfg.DeleteSection(name)
+	err = cfg.SaveTo(profilesPath)
+	if err != nil {
+		return fmt.Errorf("failed to remove remote, reason: %w", err)
+	}
+	fmt.Printf("Removed remote %s\n", name)
+
+	return nil
+}
+
+// listRemotes writes the names and URLs of the remotes in the profiles file
+// to w, one per line
+func listRemotes(profilesPath string, w io.Writer) error {
+	if !helpers.FileExists(profilesPath) {
+		return nil
+	}
+	cfg, err := ini.Load(profilesPath)
+	if err != nil {
+		return fmt.Errorf("failed to read remotes, reason: %w", err)
+	}
+
+	for _, name := range cfg.SectionStrings() {
+		if name == ini.DefaultSection {
+			continue
+		}
+		config, err := helpers.ReadConfigFile(profilesPath, name)
+		if err != nil {
+			return fmt.Errorf("failed to read remote %s, reason: %w", name, err)
+		}
+		fmt.Fprintf(w, "%s\t%s\n", name, remoteURL(config.HostBase, config.UseHTTPS))
+	}
+
+	return nil
+}
+
+// remoteURL returns the URL of the remote from its host_base and use_https
+func remoteURL(hostBase string, useHTTPS bool) string {
+	if useHTTPS && !strings.Contains(hostBase, "://") {
+		return "https://" + hostBase
+	}
+
+	return hostBase
+}
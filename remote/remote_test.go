@@ -0,0 +1,110 @@
+package remote
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/NBISweden/sda-cli/helpers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type RemoteTests struct {
+	suite.Suite
+}
+
+func TestRemoteTestSuite(t *testing.T) {
+	suite.Run(t, new(RemoteTests))
+}
+
+func (suite *RemoteTests) TestAddListRemove() {
+	profilesPath := filepath.Join(suite.T().TempDir(), ".sda-cli", "config")
+
+	var out bytes.Buffer
+	assert.NoError(suite.T(), listRemotes(profilesPath, &out))
+	assert.Empty(suite.T(), out.String())
+
+	*accessKey = "user"
+	*accessToken = "token"
+	defer func() {
+		*accessKey = ""
+		*accessToken = ""
+	}()
+	assert.NoError(suite.T(), addRemote(profilesPath, "bp", "https://inbox.bp.example.org/"))
+	*accessKey = ""
+	*accessToken = ""
+	assert.NoError(suite.T(), addRemote(profilesPath, "local", "http://localhost:8000"))
+
+	err := addRemote(profilesPath, "bp", "https://inbox.other.example.org")
+	assert.EqualError(suite.T(), err, fmt.Sprintf("remote bp already exists in %s", profilesPath))
+	err = addRemote(profilesPath, "other", "inbox.other.example.org")
+	assert.ErrorContains(suite.T(), err, "invalid remote URL")
+
+	info, err := os.Stat(profilesPath)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), os.FileMode(0600), info.Mode().Perm())
+
+	// The remote is a profile that the other commands can use
+	config, err := helpers.LoadConfigFile(profilesPath, "bp")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "user", config.AccessKey)
+	assert.Equal(suite.T(), "token", config.AccessToken)
+	assert.Equal(suite.T(), "https://inbox.bp.example.org", config.HostBase)
+	assert.True(suite.T(), config.CheckSslCertificate)
+
+	out.Reset()
+	assert.NoError(suite.T(), listRemotes(profilesPath, &out))
+	assert.Equal(suite.T(), "bp\thttps://inbox.bp.example.org\nlocal\thttp://localhost:8000\n", out.String())
+
+	assert.NoError(suite.T(), removeRemote(profilesPath, "bp"))
+	err = removeRemote(profilesPath, "bp")
+	assert.EqualError(suite.T(), err, fmt.Sprintf("remote bp not found in %s", profilesPath))
+
+	out.Reset()
+	assert.NoError(suite.T(), listRemotes(profilesPath, &out))
+	assert.Equal(suite.T(), "local\thttp://localhost:8000\n", out.String())
+}
+
+func (suite *RemoteTests) TestReadAccessToken() {
+	token, err := readAccessToken("-", strings.NewReader("token from stdin\nmore\n"))
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "token from stdin", token)
+
+	_, err = readAccessToken("-", strings.NewReader("\n"))
+	assert.EqualError(suite.T(), err, "no access token given on stdin")
+
+	suite.T().Setenv("SDA_CLI_ACCESS_TOKEN", "token from env")
+	token, err = readAccessToken("", strings.NewReader(""))
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "token from env", token)
+
+	token, err = readAccessToken("token", strings.NewReader(""))
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "token", token)
+}
+
+func (suite *RemoteTests) TestRemoteArguments() {
+	suite.T().Setenv("HOME", suite.T().TempDir())
+
+	err := Remote([]string{"remote"})
+	assert.EqualError(suite.T(), err, "a mode must be given, add, remove or list")
+
+	err = Remote([]string{"remote", "add", "bp"})
+	assert.EqualError(suite.T(), err, "a name and a URL are required to add a remote")
+
+	err = Remote([]string{"remote", "rename", "bp"})
+	assert.EqualError(suite.T(), err, "unsupported mode: rename")
+
+	err = Remote([]string{"remote", "add", "-access-key", "user", "bp", "https://inbox.bp.example.org"})
+	*accessKey = ""
+	assert.NoError(suite.T(), err)
+	profilesPath, err := helpers.ProfilesPath()
+	assert.NoError(suite.T(), err)
+	config, err := helpers.ReadConfigFile(profilesPath, "bp")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "user", config.AccessKey)
+}
@@ -0,0 +1,133 @@
+package status
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/NBISweden/sda-cli/helpers"
+)
+
+// Help text and command line flags.
+
+// Usage text that will be displayed as command line help text when using the
+// `help status` command
+var Usage = `
+USAGE: %s status (-profile <name>) (-json)
+
+status:
+    Shows the current login state and configuration: the configuration
+    file in use, the host, the masked access key, the time until which
+    the access token is valid, and the public key file or URL.  Run it
+    first to verify the setup.  With '-json', the status is printed as a
+    JSON object.
+`
+
+// ArgHelp is the suffix text that will be displayed after the argument list in
+// the module help
+var ArgHelp = `
+    status does not take any arguments`
+
+// Args is a flagset that needs to be exported so that it can be written to the
+// main program help
+var Args = flag.NewFlagSet("status", flag.ExitOnError)
+
+var profile = Args.String("profile", "",
+	"Named profile in ~/.sda-cli/config to show instead of the session file.")
+
+var jsonOutput = Args.Bool("json", false,
+	"Print the status as a JSON object.")
+
+// loginStatus is the login state and configuration shown by the command
+type loginStatus struct {
+	ConfigFile      string    `json:"config_file"`
+	HostBase        string    `json:"host_base"`
+	AccessKey       string    `json:"access_key"`
+	TokenExpiration time.Time `json:"token_expiration"`
+	TokenExpired    bool      `json:"token_expired"`
+	PublicKey       string    `json:"public_key,omitempty"`
+}
+
+// Status prints the login state and configuration of the session file, or of
+// the profile given with `-profile`.
+func Status(args []string) error {
+	err := Args.Parse(args[1:])
+	if err != nil {
+		return fmt.Errorf("could not parse arguments: %s", err)
+	}
+	if len(Args.Args()) > 0 {
+		return errors.New("status does not take any arguments")
+	}
+
+	configPath, err := helpers.FindConfigFile("", *profile)
+	if err != nil {
+		return helpers.WithCategory(helpers.ErrConfig,
+			errors.New("not logged in, run 'sda-cli login <login_target>' to log in"))
+	}
+	config, err := helpers.LoadConfigFile(configPath, *profile)
+	if err != nil {
+		return helpers.WithCategory(helpers.ErrConfig, fmt.Errorf("failed to load config file, reason: %w", err))
+	}
+
+	status, err := newStatus(configPath, config)
+	if err != nil {
+		return err
+	}
+
+	if *jsonOutput {
+		return json.NewEncoder(os.Stdout).Encode(status)
+	}
+	printStatus(os.Stdout, status)
+
+	return nil
+}
+
+// newStatus returns the status of the configuration read from configPath
+func newStatus(configPath string, config *helpers.Config) (loginStatus, error) {
+	expiration, err := helpers.TokenExpiration(config.AccessToken)
+	if err != nil {
+		return loginStatus{}, err
+	}
+
+	status := loginStatus{
+		ConfigFile:      configPath,
+		HostBase:        config.HostBase,
+		AccessKey:       helpers.TruncateKey(config.AccessKey, 4),
+		TokenExpiration: expiration,
+		TokenExpired:    time.Now().After(expiration),
+	}
+	switch {
+	case strings.HasPrefix(config.PublicKey, "https://"):
+		status.PublicKey = config.PublicKey
+	case config.PublicKey != "":
+		status.PublicKey = helpers.PublicKeyFile
+	}
+
+	return status, nil
+}
+
+// printStatus writes the status to w as a table
+func printStatus(w io.Writer, status loginStatus) {
+	token := "valid until " + status.TokenExpiration.Local().Format(time.RFC1123)
+	if status.TokenExpired {
+		token = "expired at " + status.TokenExpiration.Local().Format(time.RFC1123) + ", log in again"
+	}
+	publicKey := status.PublicKey
+	if publicKey == "" {
+		publicKey = "not in the configuration"
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Configuration file:\t%s\n", status.ConfigFile)
+	fmt.Fprintf(tw, "Host:\t%s\n", status.HostBase)
+	fmt.Fprintf(tw, "Access key:\t%s\n", status.AccessKey)
+	fmt.Fprintf(tw, "Access token:\t%s\n", token)
+	fmt.Fprintf(tw, "Public key:\t%s\n", publicKey)
+	tw.Flush()
+}
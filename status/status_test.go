@@ -0,0 +1,107 @@
+package status
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/NBISweden/sda-cli/helpers"
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type StatusTests struct {
+	suite.Suite
+}
+
+func TestStatusTestSuite(t *testing.T) {
+	suite.Run(t, new(StatusTests))
+}
+
+func newToken(expiration time.Time) (string, error) {
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"exp": expiration.Unix()}).SignedString([]byte("secret"))
+}
+
+func (suite *StatusTests) TestPrintStatus() {
+	expiration := time.Now().Add(72 * time.Hour).Truncate(time.Second)
+	accessToken, err := newToken(expiration)
+	assert.NoError(suite.T(), err)
+	config := &helpers.Config{AccessKey: "someUser", AccessToken: accessToken, HostBase: "inbox.example.org", PublicKey: "key"}
+
+	status, err := newStatus("/tmp/s3cmd.conf", config)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), loginStatus{
+		ConfigFile:      "/tmp/s3cmd.conf",
+		HostBase:        "inbox.example.org",
+		AccessKey:       "some***",
+		TokenExpiration: expiration.Local(),
+		PublicKey:       helpers.PublicKeyFile,
+	}, status)
+
+	var out bytes.Buffer
+	printStatus(&out, status)
+	assert.Equal(suite.T(), "Configuration file:  /tmp/s3cmd.conf\n"+
+		"Host:                inbox.example.org\n"+
+		"Access key:          some***\n"+
+		"Access token:        valid until "+expiration.Local().Format(time.RFC1123)+"\n"+
+		"Public key:          key-from-oidc.pub.pem\n", out.String())
+
+	// Expired tokens are shown as such
+	config.AccessToken, err = newToken(time.Now().Add(-time.Hour))
+	assert.NoError(suite.T(), err)
+	config.PublicKey = ""
+	status, err = newStatus("/tmp/s3cmd.conf", config)
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), status.TokenExpired)
+	out.Reset()
+	printStatus(&out, status)
+	assert.Contains(suite.T(), out.String(), ", log in again\n")
+	assert.Contains(suite.T(), out.String(), "Public key:          not in the configuration\n")
+}
+
+func (suite *StatusTests) TestStatus() {
+	accessToken, err := newToken(time.Now().Add(72 * time.Hour))
+	assert.NoError(suite.T(), err)
+
+	configFile := filepath.Join(suite.T().TempDir(), "s3cmd.conf")
+	err = os.WriteFile(configFile, []byte("access_key = someUser\naccess_token = "+accessToken+"\nhost_base = someHostBase\n"), 0600)
+	assert.NoError(suite.T(), err)
+	suite.T().Setenv("SDA_CLI_CONFIG", configFile)
+
+	rescueStdout := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+
+	err = Status([]string{"status", "-json"})
+	*jsonOutput = false
+
+	w.Close()
+	os.Stdout = rescueStdout
+	assert.NoError(suite.T(), err)
+	var status loginStatus
+	assert.NoError(suite.T(), json.NewDecoder(r).Decode(&status))
+	assert.Equal(suite.T(), configFile, status.ConfigFile)
+	assert.Equal(suite.T(), "some***", status.AccessKey)
+	assert.False(suite.T(), status.TokenExpired)
+
+	err = Status([]string{"status", "extra"})
+	assert.EqualError(suite.T(), err, "status does not take any arguments")
+}
+
+func (suite *StatusTests) TestNotLoggedIn() {
+	dir := suite.T().TempDir()
+	suite.T().Setenv("SDA_CLI_CONFIG", "")
+	suite.T().Setenv("XDG_CONFIG_HOME", dir)
+	wd, err := os.Getwd()
+	assert.NoError(suite.T(), err)
+	assert.NoError(suite.T(), os.Chdir(dir))
+	defer func() { _ = os.Chdir(wd) }()
+
+	err = Status([]string{"status"})
+	assert.EqualError(suite.T(), err, "not logged in, run 'sda-cli login <login_target>' to log in")
+	assert.Equal(suite.T(), helpers.ExitConfigError, helpers.ExitCode(err))
+}
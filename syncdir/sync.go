@@ -0,0 +1,435 @@
+package syncdir
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/NBISweden/sda-cli/helpers"
+	"github.com/NBISweden/sda-cli/upload"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	log "github.com/sirupsen/logrus"
+)
+
+// Help text and command line flags.
+
+// Usage text that will be displayed as command line help text when using the
+// `help sync` command
+var Usage = `
+USAGE: %s sync [-config <s3config-file>] [-profile <name>] (-manifest <file>) (-delete) (-dry-run) (-force-unencrypted) [local-dir] [remote-prefix]
+
+sync:
+    Synchronizes a local directory to a folder in the Sensitive Data
+    Archive (SDA), in one direction.  The files in the directory and
+    its subdirectories that are missing in the archive, or that have
+    been modified, are uploaded.  A file is modified if its size differs
+    from the file in the archive, or if its checksum differs from the
+    one recorded in the sync manifest.  With '-delete', the files in the
+    archive that no longer exist in the directory are deleted.  If no
+    config is specified, the tool will look for a previous session, or
+    the profile given with '-profile' in ~/.sda-cli/config.
+`
+
+// ArgHelp is the suffix text that will be displayed after the argument list in
+// the module help
+var ArgHelp = `
+    [local-dir]
+        The directory to synchronize.
+    [remote-prefix]
+        The folder in the archive to synchronize the directory to.  The
+        directory is synchronized to the user's base folder if omitted.`
+
+// Args is a flagset that needs to be exported so that it can be written to the
+// main program help
+var Args = flag.NewFlagSet("sync", flag.ExitOnError)
+
+var configPath = Args.String("config", "",
+	"S3 config file to use for synchronizing.")
+
+var profile = Args.String("profile", "",
+	"Named profile in ~/.sda-cli/config to use instead of the session file.")
+
+var manifestPath = Args.String("manifest", "sda-sync-manifest.json",
+	"File with the checksums of the synchronized files, which is used to\n"+
+		"find modified files and is updated after each sync.")
+
+var deleteRemoved = Args.Bool("delete", false,
+	"Delete the files in the archive that no longer exist locally.")
+
+var dryRun = Args.Bool("dry-run", false,
+	"Print the files that would be uploaded and deleted, without changing\n"+
+		"anything.")
+
+var forceUnencrypted = Args.Bool("force-unencrypted", false, "Force uploading unencrypted files.")
+
+// LocalFile is a file in the local directory, with the key in the archive
+// that it is synchronized to
+type LocalFile struct {
+	Path string
+	Key  string
+	Size int64
+}
+
+// syncPlan lists the files to upload and the keys to delete. The unchanged
+// files are kept with their manifest entries.
+type syncPlan struct {
+	upload    []LocalFile
+	remove    []string
+	unchanged []helpers.ManifestEntry
+}
+
+// Sync uploads the new and modified files in a local directory to a folder in
+// the archive, and deletes the files that were removed locally with -delete.
+func Sync(args []string) error {
+	// Call ParseArgs to take care of all the flag parsing
+	err := helpers.ParseArgs(args, Args)
+	if err != nil {
+		return fmt.Errorf("failed parsing arguments, reason: %w", err)
+	}
+
+	if len(Args.Args()) < 1 || len(Args.Args()) > 2 {
+		return errors.New("a local directory and optionally a remote prefix are required")
+	}
+	localDir := Args.Args()[0]
+	prefix := ""
+	if len(Args.Args()) == 2 {
+		prefix = strings.Trim(Args.Args()[1], "/")
+	}
+
+	local, err := LocalFiles(localDir, prefix)
+	if err != nil {
+		return err
+	}
+
+	// Get the configuration file or the .sda-cli-session
+	config, err := helpers.GetAuth(*configPath, *profile)
+	if err != nil {
+		return fmt.Errorf("failed to load config file, reason: %w", err)
+	}
+
+	err = helpers.WarnTokenExpiration(config)
+	if err != nil {
+		return err
+	}
+
+	remote, err := RemoteFiles(config, prefix)
+	if err != nil {
+		return err
+	}
+
+	manifest := &helpers.Manifest{}
+	if _, err := os.Stat(*manifestPath); err == nil {
+		manifest, err = helpers.ReadManifest(*manifestPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	plan, err := planSync(local, remote, manifestEntries(manifest), config.MultipartChunkSizeMb*1024*1024)
+	if err != nil {
+		return err
+	}
+
+	if *dryRun {
+		for _, file := range plan.upload {
+			fmt.Printf("upload: %s -> %s\n", file.Path, file.Key)
+		}
+		for _, key := range plan.remove {
+			fmt.Printf("delete: %s\n", key)
+		}
+		fmt.Printf("Dry run: %d file(s) would be uploaded, %d deleted and %d are unchanged\n", len(plan.upload), len(plan.remove), len(plan.unchanged))
+
+		return nil
+	}
+
+	uploaded, uploadErr := uploadFiles(plan.upload)
+
+	var removed []string
+	failed := 0
+	if len(plan.remove) > 0 {
+		sess, err := helpers.NewS3Session(config)
+		if err != nil {
+			return err
+		}
+		svc := s3.New(sess)
+		for _, key := range plan.remove {
+			_, err := svc.DeleteObject(&s3.DeleteObjectInput{
+				Bucket: aws.String(config.AccessKey),
+				Key:    aws.String(key),
+			})
+			if err != nil {
+				log.Errorf("failed to delete %s, reason: %v", key, err)
+				failed++
+
+				continue
+			}
+			fmt.Printf("deleted %s\n", key)
+			removed = append(removed, key)
+		}
+	}
+
+	updateManifest(manifest, prefix, plan.unchanged, uploaded)
+	if err := manifest.Write(*manifestPath); err != nil {
+		return fmt.Errorf("failed to write manifest file, reason: %w", err)
+	}
+	fmt.Printf("Synchronized %s: %d file(s) uploaded, %d deleted and %d unchanged\n", localDir, len(uploaded), len(removed), len(plan.unchanged))
+
+	switch {
+	case uploadErr != nil:
+		return uploadErr
+	case failed > 0:
+		return fmt.Errorf("%d of %d files could not be deleted", failed, len(plan.remove))
+	}
+
+	return nil
+}
+
+// LocalFiles returns the regular files in dir and its subdirectories, with
+// the keys they are uploaded to under prefix
+func LocalFiles(dir, prefix string) ([]LocalFile, error) {
+	fileInfo, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !fileInfo.IsDir() {
+		return nil, errors.New(dir + " is not a directory")
+	}
+
+	// The sync manifest is not synchronized if it is kept in the directory
+	manifestFile, err := filepath.Abs(*manifestPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []LocalFile
+	err = filepath.WalkDir(dir, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			if !entry.IsDir() {
+				log.Infof("Skipping %s since it is not a regular file", filePath)
+			}
+
+			return nil
+		}
+		if absPath, err := filepath.Abs(filePath); err == nil && absPath == manifestFile {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(dir, filePath)
+		if err != nil {
+			return err
+		}
+		files = append(files, LocalFile{
+			Path: filePath,
+			Key:  path.Join(prefix, upload.FormatUploadFilePath(relPath)),
+			Size: info.Size(),
+		})
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// RemoteFiles returns the files under prefix in the user's folder, by their
+// keys
+func RemoteFiles(config *helpers.Config, prefix string) (map[string]*s3.Object, error) {
+	listPrefix := prefix
+	if listPrefix != "" {
+		listPrefix += "/"
+	}
+	result, err := helpers.ListFiles(*config, config.AccessKey, listPrefix, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// The keys are listed with the user's folder in front
+	files := map[string]*s3.Object{}
+	for _, object := range result.Contents {
+		files[strings.TrimPrefix(aws.StringValue(object.Key), config.AccessKey+"/")] = object
+	}
+
+	return files, nil
+}
+
+// manifestEntries returns the entries of the manifest by their keys
+func manifestEntries(manifest *helpers.Manifest) map[string]helpers.ManifestEntry {
+	entries := map[string]helpers.ManifestEntry{}
+	for _, entry := range manifest.Files {
+		entries[entry.Key] = entry
+	}
+
+	return entries
+}
+
+// planSync compares the local files with the files in the archive. A file is
+// uploaded if it is missing in the archive, if the sizes differ, or if its
+// sha256 checksum differs from the one in the manifest. Files that are not in
+// the manifest are compared with the ETag in the archive instead, which for
+// files uploaded in parts depends on partSize. The remote files that do not
+// exist locally are deleted with -delete.
+func planSync(local []LocalFile, remote map[string]*s3.Object, manifest map[string]helpers.ManifestEntry, partSize int64) (syncPlan, error) {
+	var plan syncPlan
+	localKeys := map[string]bool{}
+	for _, file := range local {
+		localKeys[file.Key] = true
+
+		object, found := remote[file.Key]
+		if !found || aws.Int64Value(object.Size) != file.Size {
+			plan.upload = append(plan.upload, file)
+
+			continue
+		}
+
+		remoteETag := strings.Trim(aws.StringValue(object.ETag), `"`)
+		filePartSize := int64(0)
+		if strings.Contains(remoteETag, "-") {
+			filePartSize = partSize
+		}
+		etag, sha256sum, err := fileChecksums(file.Path, filePartSize)
+		if err != nil {
+			return syncPlan{}, err
+		}
+
+		entry, found := manifest[file.Key]
+		switch {
+		case found && !strings.EqualFold(entry.SHA256, sha256sum):
+			plan.upload = append(plan.upload, file)
+		case !found && !strings.EqualFold(etag, remoteETag):
+			plan.upload = append(plan.upload, file)
+		default:
+			plan.unchanged = append(plan.unchanged, helpers.ManifestEntry{
+				LocalPath:  file.Path,
+				Key:        file.Key,
+				Location:   entry.Location,
+				Size:       file.Size,
+				SHA256:     sha256sum,
+				UploadedAt: aws.TimeValue(object.LastModified),
+			})
+		}
+	}
+
+	if *deleteRemoved {
+		for key := range remote {
+			if !localKeys[key] {
+				plan.remove = append(plan.remove, key)
+			}
+		}
+		sort.Strings(plan.remove)
+	}
+
+	return plan, nil
+}
+
+// fileChecksums returns the ETag and the sha256 checksum of the file at path
+func fileChecksums(filePath string, partSize int64) (string, string, error) {
+	f, err := os.Open(filepath.Clean(filePath))
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	return helpers.FileChecksums(f, partSize)
+}
+
+// uploadFiles uploads the files with the upload command, one call for each
+// folder in the archive, and returns the manifest entries of the uploaded
+// files
+func uploadFiles(files []LocalFile) ([]helpers.ManifestEntry, error) {
+	folders := map[string][]string{}
+	var order []string
+	for _, file := range files {
+		folder := path.Dir(file.Key)
+		if _, found := folders[folder]; !found {
+			order = append(order, folder)
+		}
+		folders[folder] = append(folders[folder], file.Path)
+	}
+
+	tmpDir, err := os.MkdirTemp("", "sda-cli-sync-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var uploaded []helpers.ManifestEntry
+	failed := 0
+	for k, folder := range order {
+		uploadManifest := filepath.Join(tmpDir, fmt.Sprintf("manifest-%d.json", k))
+		uploadArgs := []string{"upload", "-force-overwrite", "-manifest", uploadManifest}
+		if folder != "." {
+			uploadArgs = append(uploadArgs, "-targetDir", folder)
+		}
+		if *configPath != "" {
+			uploadArgs = append(uploadArgs, "-config", *configPath)
+		}
+		if *profile != "" {
+			uploadArgs = append(uploadArgs, "-profile", *profile)
+		}
+		if *forceUnencrypted {
+			uploadArgs = append(uploadArgs, "-force-unencrypted")
+		}
+		uploadArgs = append(uploadArgs, folders[folder]...)
+
+		if err := upload.Upload(uploadArgs); err != nil {
+			log.Errorf("failed to upload files to %s, reason: %v", folder, err)
+			failed++
+		}
+
+		// The manifest lists the files that were uploaded, also if others
+		// failed
+		if _, err := os.Stat(uploadManifest); err == nil {
+			manifest, err := helpers.ReadManifest(uploadManifest)
+			if err != nil {
+				return uploaded, err
+			}
+			uploaded = append(uploaded, manifest.Files...)
+		}
+	}
+
+	if failed > 0 {
+		return uploaded, fmt.Errorf("%d of %d files failed to upload", len(files)-len(uploaded), len(files))
+	}
+
+	return uploaded, nil
+}
+
+// updateManifest replaces the entries of the files under prefix with the
+// entries of the unchanged and uploaded files, which drops the entries of the
+// deleted files and of the files that failed to upload. The entries of other
+// prefixes are kept.
+func updateManifest(manifest *helpers.Manifest, prefix string, unchanged, uploaded []helpers.ManifestEntry) {
+	entries := manifestEntries(manifest)
+	for key := range entries {
+		if prefix == "" || strings.HasPrefix(key, prefix+"/") {
+			delete(entries, key)
+		}
+	}
+	for _, entry := range append(unchanged, uploaded...) {
+		entries[entry.Key] = entry
+	}
+
+	manifest.Files = manifest.Files[:0]
+	for _, entry := range entries {
+		manifest.Files = append(manifest.Files, entry)
+	}
+	sort.Slice(manifest.Files, func(i, j int) bool {
+		return manifest.Files[i].Key < manifest.Files[j].Key
+	})
+}
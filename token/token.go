@@ -0,0 +1,85 @@
+package token
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/NBISweden/sda-cli/helpers"
+)
+
+// Help text and command line flags.
+
+// Usage text that will be displayed as command line help text when using the
+// `help token` command
+var Usage = `
+USAGE: %s token (-profile <name>) (-raw)
+
+token:
+    Prints the access token of the previous login, and the time until
+    which it is valid.  With '-raw', only the token is printed, for use
+    in scripts, e.g. "Authorization: Bearer $(sda-cli token -raw)".
+    An expired token is an error.
+`
+
+// ArgHelp is the suffix text that will be displayed after the argument list in
+// the module help
+var ArgHelp = `
+    token does not take any arguments`
+
+// Args is a flagset that needs to be exported so that it can be written to the
+// main program help
+var Args = flag.NewFlagSet("token", flag.ExitOnError)
+
+var profile = Args.String("profile", "",
+	"Named profile in ~/.sda-cli/config to use instead of the session file.")
+
+var raw = Args.Bool("raw", false,
+	"Print only the token.")
+
+// Token prints the access token of the previous login, if it has not expired.
+func Token(args []string) error {
+	err := Args.Parse(args[1:])
+	if err != nil {
+		return fmt.Errorf("could not parse arguments: %s", err)
+	}
+	if len(Args.Args()) > 0 {
+		return errors.New("token does not take any arguments")
+	}
+
+	config, err := helpers.GetAuth("", *profile)
+	if err != nil {
+		return fmt.Errorf("failed to load config file, reason: %w", err)
+	}
+
+	return printToken(os.Stdout, config, *raw)
+}
+
+// printToken writes the access token in config to w, or returns an error if
+// the token has expired.
+func printToken(w io.Writer, config *helpers.Config, raw bool) error {
+	expiration, err := helpers.TokenExpiration(config.AccessToken)
+	if err != nil {
+		return err
+	}
+	if time.Now().After(expiration) {
+		return fmt.Errorf("the access token expired at %v, log in again", expiration.Local().Format(time.RFC1123))
+	}
+	err = helpers.WarnTokenExpiration(config)
+	if err != nil {
+		return err
+	}
+
+	if raw {
+		fmt.Fprintln(w, config.AccessToken)
+
+		return nil
+	}
+	fmt.Fprintf(w, "Token: %s\n", config.AccessToken)
+	fmt.Fprintf(w, "Valid until: %v (expires in %s)\n", expiration.Local().Format(time.RFC1123), helpers.FormatTimeRemaining(time.Until(expiration)))
+
+	return nil
+}
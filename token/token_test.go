@@ -0,0 +1,77 @@
+package token
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NBISweden/sda-cli/helpers"
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type TokenTests struct {
+	suite.Suite
+}
+
+func TestTokenTestSuite(t *testing.T) {
+	suite.Run(t, new(TokenTests))
+}
+
+func newToken(expiration time.Time) (string, error) {
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"exp": expiration.Unix()}).SignedString([]byte("secret"))
+}
+
+func (suite *TokenTests) TestPrintToken() {
+	expiration := time.Now().Add(72 * time.Hour)
+	accessToken, err := newToken(expiration)
+	assert.NoError(suite.T(), err)
+	config := &helpers.Config{AccessToken: accessToken}
+
+	var out bytes.Buffer
+	assert.NoError(suite.T(), printToken(&out, config, true))
+	assert.Equal(suite.T(), accessToken+"\n", out.String())
+
+	out.Reset()
+	assert.NoError(suite.T(), printToken(&out, config, false))
+	assert.Equal(suite.T(), "Token: "+accessToken+"\nValid until: "+expiration.Local().Format(time.RFC1123)+" (expires in 2d 23h)\n", out.String())
+
+	// Expired tokens are not printed
+	config.AccessToken, err = newToken(time.Now().Add(-time.Hour))
+	assert.NoError(suite.T(), err)
+	out.Reset()
+	err = printToken(&out, config, true)
+	assert.ErrorContains(suite.T(), err, "the access token expired at")
+	assert.Empty(suite.T(), out.String())
+}
+
+func (suite *TokenTests) TestToken() {
+	accessToken, err := newToken(time.Now().Add(72 * time.Hour))
+	assert.NoError(suite.T(), err)
+
+	configFile := filepath.Join(suite.T().TempDir(), "s3cmd.conf")
+	err = os.WriteFile(configFile, []byte("access_key = someUser\naccess_token = "+accessToken+"\nhost_base = someHostBase\n"), 0600)
+	assert.NoError(suite.T(), err)
+	suite.T().Setenv("SDA_CLI_CONFIG", configFile)
+
+	rescueStdout := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+
+	err = Token([]string{"token", "-raw"})
+	*raw = false
+
+	w.Close()
+	os.Stdout = rescueStdout
+	assert.NoError(suite.T(), err)
+	var out bytes.Buffer
+	_, _ = out.ReadFrom(r)
+	assert.Equal(suite.T(), accessToken, strings.TrimSpace(out.String()))
+
+	err = Token([]string{"token", "extra"})
+	assert.EqualError(suite.T(), err, "token does not take any arguments")
+}
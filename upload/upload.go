@@ -1,23 +1,38 @@
 package upload
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/NBISweden/sda-cli/encrypt"
 	"github.com/NBISweden/sda-cli/helpers"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	log "github.com/sirupsen/logrus"
 	"github.com/vbauerster/mpb/v8"
 	"github.com/vbauerster/mpb/v8/decor"
+	"golang.org/x/time/rate"
 )
 
 // Help text and command line flags.
@@ -25,12 +40,16 @@ import (
 // Usage text that will be displayed as command line help text when using the
 // `help upload` command
 var Usage = `
-USAGE: %s upload -config <s3config-file> (--encrypt-with-key <public-key-file>) (--force-overwrite) (--force-unencrypted) (-r) [file(s) | folder(s)] (-targetDir <upload-directory>)
+USAGE: %s upload -config <s3config-file> (-profile <name>) (-encrypt) (--encrypt-with-key <public-key-file>) (-keep-encrypted) (--force-overwrite) (--force-unencrypted) (-r) (-resume) (-dry-run) (-concurrency <n>) (-max-rate <rate>) (-max-retries <n>) (-verify) (-manifest <file>) (-overwrite-manifest) (-with-index) [file(s) | folder(s) | - -outname <name>] (-targetDir <upload-directory>) (-prefix <key-prefix>)
 
 upload:
     Uploads files to the Sensitive Data Archive (SDA).  All files
     to upload are required to be encrypted and have the .c4gh file
-    extension.
+    extension, unless they are encrypted before upload with '-encrypt'.
+    Interrupted uploads can be continued with '-resume'.  With
+    '-with-index', the index files next to BAM, VCF and FASTA files
+    are uploaded as well.
+    A named profile in ~/.sda-cli/config can be used with '-profile'.
 `
 
 // ArgHelp is the suffix text that will be displayed after the argument list in
@@ -38,7 +57,8 @@ upload:
 var ArgHelp = `
     [file(s)|folder(s)]
         All flagless arguments will be used as file or directory names
-        to upload.  Directories will be skipped if '-r' is not provided.`
+        to upload.  Directories will be skipped if '-r' is not provided.
+        Use '-' together with '-outname' to upload data read from stdin.`
 
 // Args is a flagset that needs to be exported so that it can be written to the
 // main program help
@@ -47,6 +67,9 @@ var Args = flag.NewFlagSet("upload", flag.ExitOnError)
 var configPath = Args.String("config", "",
 	"S3 config file to use for uploading.")
 
+var profile = Args.String("profile", "",
+	"Named profile in ~/.sda-cli/config to use instead of the session file.")
+
 var forceUnencrypted = Args.Bool("force-unencrypted", false, "Force uploading unencrypted files.")
 
 var dirUpload = Args.Bool("r", false, "Upload directories recursively.")
@@ -57,11 +80,90 @@ var targetDir = Args.String("targetDir", "",
 
 var forceOverwrite = Args.Bool("force-overwrite", false, "Force overwrite existing files.")
 
+var noDedup = Args.Bool("no-dedup", false,
+	"Upload files even if the same file is already uploaded, see\n"+
+		"-force-overwrite.")
+
 var pubKeyPath = Args.String("encrypt-with-key", "",
 	"Public key file to use for encryption of files before upload.\n"+
 		"The key file may optionally contain several concatenated\n"+
-		"public keys.  The argument list may include only unencrypted\n"+
-		"data if this flag is set.")
+		"public keys.  Files in the argument list that are already\n"+
+		"encrypted are uploaded without being encrypted again.")
+
+var encryptFiles = Args.Bool("encrypt", false,
+	"Encrypt the files before upload, with the public key in the\n"+
+		"configuration, or the key given with --encrypt-with-key.  The\n"+
+		"encrypted files are removed after the upload.")
+
+var keepEncrypted = Args.Bool("keep-encrypted", false,
+	"Keep the .c4gh files encrypted with -encrypt after the upload.")
+
+var resumeUpload = Args.Bool("resume", false,
+	"Resume interrupted uploads.  The progress of each upload is kept in\n"+
+		"a local .sda-upload-<sha256>.state file, which is removed once\n"+
+		"the upload has completed.  Files that are encrypted during the\n"+
+		"upload cannot be resumed.")
+
+var outName = Args.String("outname", "",
+	"Name of the uploaded file when reading data from stdin ('-').")
+
+var dryRun = Args.Bool("dry-run", false,
+	"Check the files and print where they would be uploaded, without\n"+
+		"uploading anything.")
+
+var maxRate = Args.String("max-rate", "",
+	"Maximum upload rate, e.g. 10MB/s or 500KB/s.  The limit applies to all\n"+
+		"uploads combined, unless -max-rate-per-file is given.")
+
+var maxRatePerFile = Args.Bool("max-rate-per-file", false,
+	"Apply the -max-rate limit to each file separately.")
+
+var forceReencrypt = Args.Bool("force-reencrypt", false,
+	"Encrypt files with --encrypt-with-key even if they are already\n"+
+		"encrypted.  By default, encrypted files are uploaded as they are.")
+
+var keyPrefix = Args.String("prefix", "",
+	"Prefix, e.g. project-x/batch-2/, to prepend to the keys of all\n"+
+		"uploaded files.  The prefix is placed before -targetDir.")
+
+var verify = Args.Bool("verify", false,
+	"Verify each file after upload by comparing the size and checksum of\n"+
+		"the local file with the uploaded object.")
+
+var deleteOnMismatch = Args.Bool("delete-on-mismatch", false,
+	"Delete uploaded objects that fail the -verify check.")
+
+var concurrency = Args.Int("concurrency", 1, "Number of files to upload in parallel.")
+
+// defaultManifest is the manifest file written when -manifest is not given.
+// It is replaced by every upload, while an existing file given with -manifest
+// is only overwritten with -overwrite-manifest.
+const defaultManifest = "sda-upload-manifest.json"
+
+var manifestPath = Args.String("manifest", defaultManifest,
+	"File to write the list of uploaded files, with their keys, sizes\n"+
+		"and checksums, to.  An existing file is only overwritten with\n"+
+		"-overwrite-manifest.")
+
+var overwriteManifest = Args.Bool("overwrite-manifest", false,
+	"Overwrite an existing file given with -manifest.")
+
+var maxRetries = Args.Int("max-retries", 3,
+	"Number of times to retry failed requests to the S3 backend.")
+
+var withIndex = Args.Bool("with-index", false,
+	"Upload the index files of BAM (.bai), VCF (.tbi) and FASTA (.fai)\n"+
+		"files together with the files.")
+
+// Long names of the short flags
+func init() {
+	helpers.AliasFlag(Args, "r", "recursive")
+	helpers.AliasFlag(Args, "targetDir", "target-dir")
+	helpers.AliasFlag(Args, "outname", "output-name")
+}
+
+// retryDelay is the delay before the first retry of a failed request
+var retryDelay = time.Second
 
 // Function uploadFiles uploads the files in the input list to the s3 bucket
 func uploadFiles(files, outFiles []string, targetDir string, config *helpers.Config) error {
@@ -74,18 +176,12 @@ func uploadFiles(files, outFiles []string, targetDir string, config *helpers.Con
 	// Loop through the list of files and check if they are encrypted
 	// If we run into an unencrypted file and the flag force-unencrypted is not set, we stop the upload
 	for _, filename := range files {
-		f, err := os.Open(path.Clean(filename))
-		if err != nil {
-			return err
-		}
 		// Check if the file is encrypted and warn if not
-		// Extracting the first 8 bytes of the header - crypt4gh
-		magicWord := make([]byte, 8)
-		_, err = f.Read(magicWord)
+		encrypted, err := helpers.IsCrypt4GHFile(filename)
 		if err != nil {
-			fmt.Printf("error reading input file %s, reason: %v", filename, err)
+			return err
 		}
-		if string(magicWord) != "crypt4gh" {
+		if !encrypted {
 			fmt.Printf("Input file %s is not encrypted\n", filename)
 			log.Infof("input file %s is not encrypted", filepath.Clean(filename))
 			if !*forceUnencrypted {
@@ -98,102 +194,633 @@ func uploadFiles(files, outFiles []string, targetDir string, config *helpers.Con
 	}
 
 	// The session the S3 Uploader will use
-	sess := session.Must(session.NewSession(&aws.Config{
-		// The region for the backend is always the specified one
-		// and not present in the configuration from auth - hardcoded
-		Region:           aws.String("us-west-2"),
-		Credentials:      credentials.NewStaticCredentials(config.AccessKey, config.AccessKey, config.AccessToken),
-		Endpoint:         aws.String(config.HostBase),
-		DisableSSL:       aws.Bool(!config.UseHTTPS),
-		S3ForcePathStyle: aws.Bool(true),
-	}))
+	sess, err := helpers.NewS3Session(config)
+	if err != nil {
+		return err
+	}
 	// Create an uploader with the session and default options
 	uploader := s3manager.NewUploader(sess)
-	for k, filename := range files {
 
-		// create progress bar instance
-		p := mpb.New()
-		log.Infof("Uploading %s with config %s\n", filename, *configPath)
-		fmt.Printf("Uploading %s with config %s\n", filename, *configPath)
+	// create progress bar instance, shared by all uploads
+	p := helpers.NewProgress()
+	defer p.Shutdown()
 
-		f, err := os.Open(path.Clean(filename))
+	// Limit the upload rate, either for all uploads together, or for each
+	// file separately
+	var limiter *rate.Limiter
+	var bytesPerSecond int64
+	if *maxRate != "" {
+		var err error
+		bytesPerSecond, err = helpers.ParseRate(*maxRate)
 		if err != nil {
 			return err
 		}
+		limiter = rate.NewLimiter(rate.Limit(bytesPerSecond), int(bytesPerSecond))
+	}
 
-		// Check if files exists in S3
-		var listPrefix string
-		if targetDir != "" {
-			listPrefix = targetDir + "/" + outFiles[k]
-		} else {
-			listPrefix = outFiles[k]
+	// Upload the files using a pool of at most `concurrency` workers. A
+	// failed upload is reported, but does not stop the remaining uploads.
+	var g helpers.ErrGroup
+	g.SetLimit(*concurrency)
+	var manifestMux sync.Mutex
+	manifest := &helpers.Manifest{}
+	for k, filename := range files {
+		fileLimiter := limiter
+		if limiter != nil && *maxRatePerFile {
+			fileLimiter = rate.NewLimiter(rate.Limit(bytesPerSecond), int(bytesPerSecond))
 		}
-		fileExists, err := helpers.ListFiles(*config, listPrefix)
+
+		filename, outFile := filename, outFiles[k]
+		g.Go(func() error {
+			entry, err := uploadFile(filename, outFile, targetDir, config, sess, uploader, p, fileLimiter)
+			if err != nil {
+				log.Errorf("Failed to upload %s, reason: %v", filename, err)
+
+				return err
+			}
+
+			manifestMux.Lock()
+			manifest.Files = append(manifest.Files, entry)
+			manifestMux.Unlock()
+
+			return nil
+		})
+	}
+	errs := g.Wait()
+
+	// The manifest lists the files that were uploaded successfully, in the
+	// order they were given
+	if len(manifest.Files) > 0 && *manifestPath != "" {
+		order := map[string]int{}
+		for k, filename := range files {
+			order[filename] = k
+		}
+		sort.Slice(manifest.Files, func(i, j int) bool {
+			return order[manifest.Files[i].LocalPath] < order[manifest.Files[j].LocalPath]
+		})
+		if err := manifest.Write(*manifestPath); err != nil {
+			return fmt.Errorf("failed to write manifest file, reason: %w", err)
+		}
+		fmt.Printf("Wrote list of uploaded files to %s\n", *manifestPath)
+	}
+
+	switch failed := len(errs); {
+	case failed == 0:
+		return nil
+	case len(files) == 1:
+		return errs[0]
+	default:
+		return fmt.Errorf("%d of %d files failed to upload", failed, len(files))
+	}
+}
+
+// uploadFile uploads a single file to the s3 bucket, adding a progress bar for
+// the upload to `p`. The upload rate is limited by `limiter`, unless it is nil.
+// The returned entry describes the uploaded file for the manifest.
+func uploadFile(filename, outFile, targetDir string, config *helpers.Config, sess *session.Session, uploader *s3manager.Uploader, p *mpb.Progress, limiter *rate.Limiter) (helpers.ManifestEntry, error) {
+	log.Infof("Uploading %s with config %s\n", filename, *configPath)
+	fmt.Printf("Uploading %s with config %s\n", filename, *configPath)
+
+	f, err := os.Open(path.Clean(filename))
+	if err != nil {
+		return helpers.ManifestEntry{}, err
+	}
+	defer f.Close()
+
+	// Check if files exists in S3
+	var listPrefix string
+	if targetDir != "" {
+		listPrefix = targetDir + "/" + outFile
+	} else {
+		listPrefix = outFile
+	}
+	var fileExists []*s3.Object
+	err = retry(func() error {
+		result, err := helpers.ListFiles(*config, config.AccessKey, listPrefix, true)
 		if err != nil {
-			log.Error("Couldn't get the file list ", err)
+			return err
 		}
-		if len(fileExists.Contents) > 0 {
-			if aws.StringValue(fileExists.Contents[0].Key) == filepath.Clean(config.AccessKey+"/"+targetDir+"/"+outFiles[k]) {
-				fmt.Printf("File %s is already uploaded!\n", filepath.Base(filename))
-				if !*forceOverwrite {
-					fmt.Println("Quitting...")
+		fileExists = result.Contents
 
-					return errors.New("file already uploaded")
-				}
-				fmt.Println("force-overwrite flag provided, continuing...")
+		return nil
+	})
+	if err != nil {
+		log.Error("Couldn't get the file list ", err)
+	}
+	key := targetDir + "/" + outFile
+	for _, object := range fileExists {
+		if aws.StringValue(object.Key) != filepath.Clean(config.AccessKey+"/"+targetDir+"/"+outFile) {
+			continue
+		}
+
+		// The same file does not need to be uploaded again
+		if !*noDedup && aws.Int64Value(object.Size) == fileSize(f) {
+			same, sha256sum, err := matchesUploadedFile(s3.New(sess), f, key, config)
+			if err != nil {
+				log.Warnf("failed to compare %s with the uploaded file, reason: %v", filename, err)
+			}
+			if same {
+				fmt.Printf("Skipping %s (already uploaded)\n", filename)
+
+				return helpers.ManifestEntry{
+					LocalPath:  filename,
+					Key:        strings.TrimPrefix(key, "/"),
+					Size:       aws.Int64Value(object.Size),
+					SHA256:     sha256sum,
+					UploadedAt: aws.TimeValue(object.LastModified).UTC(),
+				}, nil
 			}
 		}
 
-		fileInfo, err := f.Stat()
+		fmt.Printf("File %s is already uploaded!\n", filepath.Base(filename))
+		if !*forceOverwrite {
+			return helpers.ManifestEntry{}, errors.New("file already uploaded")
+		}
+		fmt.Println("force-overwrite flag provided, continuing...")
+
+		break
+	}
+
+	fileInfo, err := f.Stat()
+	if err != nil {
+		return helpers.ManifestEntry{}, err
+	}
+	file := fmt.Sprintf("File %s:", filepath.Base(filename))
+	// The progress bar starts with the file name, followed by the
+	// uploading status and the progress bar itself.
+	// It is marked as done when the upload is complete
+	bar := p.AddBar(fileInfo.Size(),
+		mpb.PrependDecorators(
+			decor.Name(file, decor.WC{W: len(file) + 1, C: decor.DidentRight}),
+			decor.Name("uploading", decor.WCSyncSpaceR),
+			decor.Counters(decor.SizeB1024(0), "% .1f / % .1f"),
+		),
+		mpb.AppendDecorators(
+			decor.OnComplete(decor.Percentage(decor.WC{W: 5}), "done"),
+		),
+	)
+
+	// Creates a custom reader that updates the progress bar
+	reader := helpers.CustomReader{
+		Fp:      f,
+		Size:    fileInfo.Size(),
+		SignMap: map[int64]struct{}{},
+		Bar:     bar,
+		Limiter: limiter,
+	}
+
+	var location string
+	if *resumeUpload {
+		location, err = resumableUpload(s3.New(sess), &reader, key, config)
 		if err != nil {
-			return err
+			bar.Abort(false)
+
+			return helpers.ManifestEntry{}, err
 		}
-		file := fmt.Sprintf("File %s:", filepath.Base(filename))
-		// Creates a custom reader. The progress bar starts with the file name,
-		// followed by the uploading status and the progress bar itself.
-		// It is marked as done when the upload is complete
-		reader := helpers.CustomReader{
-			Fp:      f,
-			Size:    fileInfo.Size(),
-			SignMap: map[int64]struct{}{},
-			Bar: p.AddBar(fileInfo.Size(),
-				mpb.PrependDecorators(
-					decor.Name(file, decor.WC{W: len(file) + 1, C: decor.DidentRight}),
-					decor.Name("uploading", decor.WCSyncSpaceR),
-					decor.Counters(decor.SizeB1024(0), "% .1f / % .1f"),
-				),
-				mpb.AppendDecorators(
-					decor.OnComplete(decor.Percentage(decor.WC{W: 5}), "done"),
-				),
-			),
-		}
-
-		// Upload the file to S3.
-		result, err := uploader.Upload(&s3manager.UploadInput{
-			Body:            &reader,
-			Bucket:          aws.String(config.AccessKey),
-			Key:             aws.String(targetDir + "/" + outFiles[k]),
-			ContentEncoding: aws.String(config.Encoding),
-		}, func(u *s3manager.Uploader) {
-			u.PartSize = config.MultipartChunkSizeMb * 1024 * 1024
-			// Delete parts of failed multipart, since we cannot currently continue them
-			u.LeavePartsOnError = false
+	} else {
+		// Upload the file to S3. A failed upload is started over from
+		// the beginning of the file.
+		var result *s3manager.UploadOutput
+		err = retry(func() error {
+			if _, err := reader.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			reader.Mux.Lock()
+			reader.Reads = 0
+			reader.SignMap = map[int64]struct{}{}
+			bar.SetCurrent(0)
+			reader.Mux.Unlock()
+
+			result, err = uploader.Upload(&s3manager.UploadInput{
+				Body:            &reader,
+				Bucket:          aws.String(config.AccessKey),
+				Key:             aws.String(key),
+				ContentEncoding: aws.String(config.Encoding),
+			}, func(u *s3manager.Uploader) {
+				u.PartSize = config.MultipartChunkSizeMb * 1024 * 1024
+				// Delete parts of failed multipart, since this uploader
+				// cannot continue them. Use -resume for that.
+				u.LeavePartsOnError = false
+			})
+
+			return err
 		})
 		// Print the progress bar. Second check is to filter out some junk from the output
 		if result != nil && result.VersionID != nil {
 			fmt.Println(result)
 		}
 		if err != nil {
-			return err
+			bar.Abort(false)
+
+			return helpers.ManifestEntry{}, err
 		}
-		log.Infof("file uploaded to %s\n", string(aws.StringValue(&result.Location)))
-		fmt.Printf("file uploaded to %s\n", string(aws.StringValue(&result.Location)))
-		p.Shutdown()
+		location = result.Location
+	}
+	log.Infof("file uploaded to %s\n", location)
+	fmt.Printf("file uploaded to %s\n", location)
+
+	if *verify {
+		if err := checkUploadedFile(s3.New(sess), f, key, config); err != nil {
+			if *deleteOnMismatch {
+				delErr := retry(func() error {
+					_, err := s3.New(sess).DeleteObject(&s3.DeleteObjectInput{
+						Bucket: aws.String(config.AccessKey),
+						Key:    aws.String(key),
+					})
+
+					return err
+				})
+				if delErr != nil {
+					log.Errorf("failed to delete %s, reason: %v", key, delErr)
+				} else {
+					fmt.Printf("Deleted %s from the archive\n", strings.TrimPrefix(key, "/"))
+				}
+			}
+
+			return helpers.ManifestEntry{}, err
+		}
+	}
+
+	_, sha256sum, err := helpers.FileChecksums(f, 0)
+	if err != nil {
+		return helpers.ManifestEntry{}, err
+	}
+
+	return helpers.ManifestEntry{
+		LocalPath:  filename,
+		Key:        strings.TrimPrefix(key, "/"),
+		Location:   location,
+		Size:       fileInfo.Size(),
+		SHA256:     sha256sum,
+		UploadedAt: time.Now().UTC(),
+	}, nil
+}
+
+// checkUploadedFile compares the size and ETag of an uploaded object with the
+// local file, see uploadedETagMatches, after the upload.
+func checkUploadedFile(svc *s3.S3, f *os.File, key string, config *helpers.Config) error {
+	head, err := headObject(svc, key, config)
+	if err != nil {
+		return fmt.Errorf("failed to get information about uploaded file, reason: %w", err)
 	}
 
+	if aws.Int64Value(head.ContentLength) != fileSize(f) {
+		return fmt.Errorf("verification of %s failed, uploaded size %d does not match local size %d", f.Name(), aws.Int64Value(head.ContentLength), fileSize(f))
+	}
+
+	same, sha256sum, err := uploadedETagMatches(head, f, config)
+	if err != nil {
+		return err
+	}
+	if !same {
+		return fmt.Errorf("verification of %s failed, checksum of uploaded file does not match local file", f.Name())
+	}
+
+	log.Infof("verified upload of %s, sha256: %s", f.Name(), sha256sum)
+	fmt.Printf("Verified upload of %s (sha256: %s)\n", filepath.Base(f.Name()), sha256sum)
+
 	return nil
 }
 
+// matchesUploadedFile returns true if the object at key has the size and the
+// ETag of the local file, together with the sha256 checksum of the file
+func matchesUploadedFile(svc *s3.S3, f *os.File, key string, config *helpers.Config) (bool, string, error) {
+	head, err := headObject(svc, key, config)
+	if err != nil {
+		return false, "", err
+	}
+	if aws.Int64Value(head.ContentLength) != fileSize(f) {
+		return false, "", nil
+	}
+
+	same, sha256sum, err := uploadedETagMatches(head, f, config)
+	// The file is read from the start if it is uploaded after all
+	if _, seekErr := f.Seek(0, io.SeekStart); err == nil && seekErr != nil {
+		err = seekErr
+	}
+
+	return same, sha256sum, err
+}
+
+// uploadedETagMatches returns true if the ETag of an uploaded object is the
+// one of the local file, together with the sha256 checksum of the file. The
+// ETag of an object is the md5 checksum of the data for regular uploads, and
+// the md5 of the checksums of all parts followed by the number of parts for
+// multipart uploads.
+func uploadedETagMatches(head *s3.HeadObjectOutput, f *os.File, config *helpers.Config) (bool, string, error) {
+	remoteETag := strings.Trim(aws.StringValue(head.ETag), `"`)
+	partSize := int64(0)
+	if strings.Contains(remoteETag, "-") {
+		partSize = config.MultipartChunkSizeMb * 1024 * 1024
+	}
+	localETag, sha256sum, err := helpers.FileChecksums(f, partSize)
+	if err != nil {
+		return false, "", err
+	}
+
+	return localETag == remoteETag, sha256sum, nil
+}
+
+// headObject returns the metadata of the object at key in the user's bucket
+func headObject(svc *s3.S3, key string, config *helpers.Config) (*s3.HeadObjectOutput, error) {
+	var head *s3.HeadObjectOutput
+	err := retry(func() error {
+		var err error
+		head, err = svc.HeadObject(&s3.HeadObjectInput{
+			Bucket: aws.String(config.AccessKey),
+			Key:    aws.String(key),
+		})
+
+		return err
+	})
+
+	return head, err
+}
+
+// fileSize returns the size of the open file, or -1 if it cannot be read
+func fileSize(f *os.File) int64 {
+	fileInfo, err := f.Stat()
+	if err != nil {
+		return -1
+	}
+
+	return fileInfo.Size()
+}
+
+// uploadState keeps track of the parts of a multipart upload that have
+// already been sent, so that an interrupted upload can be resumed.
+type uploadState struct {
+	UploadID string          `json:"upload_id"`
+	Key      string          `json:"key"`
+	PartSize int64           `json:"part_size"`
+	Parts    []completedPart `json:"parts"`
+}
+
+// completedPart is a part of a multipart upload that has been successfully
+// sent to the S3 backend
+type completedPart struct {
+	PartNumber int64  `json:"part_number"`
+	ETag       string `json:"etag"`
+}
+
+// uploadStateFile returns the name of the state file used when resuming the
+// upload of a file. The name is derived from the sha256 of the absolute path,
+// size and modification time of the file together with the target key, so
+// that a modified file is never resumed from an old state.
+func uploadStateFile(filename string, fileInfo os.FileInfo, key string) (string, error) {
+	absPath, err := filepath.Abs(filename)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\n%s\n%d\n%d", absPath, key, fileInfo.Size(), fileInfo.ModTime().UnixNano())
+
+	return fmt.Sprintf(".sda-upload-%s.state", hex.EncodeToString(hash.Sum(nil))), nil
+}
+
+// loadUploadState reads a previously saved upload state from stateFile
+func loadUploadState(stateFile string) (*uploadState, error) {
+	data, err := os.ReadFile(filepath.Clean(stateFile))
+	if err != nil {
+		return nil, err
+	}
+
+	state := &uploadState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed to parse upload state file %s, reason: %v", stateFile, err)
+	}
+
+	return state, nil
+}
+
+// save writes the upload state to stateFile
+func (state *uploadState) save(stateFile string) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(stateFile, data, 0600)
+}
+
+// resumableUpload uploads a file part by part, recording every completed part
+// in a local state file. If a state file from an earlier, interrupted, upload
+// of the same file exists, the parts listed there are not sent again. The
+// state file is removed once the upload has completed.
+func resumableUpload(svc *s3.S3, reader *helpers.CustomReader, key string, config *helpers.Config) (string, error) {
+	f := reader.Fp
+	fileInfo, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	stateFile, err := uploadStateFile(f.Name(), fileInfo, key)
+	if err != nil {
+		return "", err
+	}
+
+	partSize := config.MultipartChunkSizeMb * 1024 * 1024
+
+	state, err := loadUploadState(stateFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	if state != nil && (state.Key != key || state.PartSize != partSize) {
+		state = nil
+	}
+
+	// The upload in the state file may have been aborted or expired in the
+	// archive, it is then started over
+	if state != nil {
+		found, err := uploadExists(svc, key, state.UploadID, config)
+		if err != nil {
+			return "", err
+		}
+		if !found {
+			log.Warnf("The upload of %s in %s no longer exists in the archive, starting over", f.Name(), stateFile)
+			if err := os.Remove(stateFile); err != nil {
+				return "", err
+			}
+			state = nil
+		}
+	}
+
+	if state != nil {
+		log.Infof("Resuming upload of %s from %s", f.Name(), stateFile)
+		fmt.Printf("Resuming upload of %s, %d part(s) already uploaded\n", filepath.Base(f.Name()), len(state.Parts))
+	} else {
+		var upload *s3.CreateMultipartUploadOutput
+		err := retry(func() error {
+			var err error
+			upload, err = svc.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+				Bucket:          aws.String(config.AccessKey),
+				Key:             aws.String(key),
+				ContentEncoding: aws.String(config.Encoding),
+			})
+
+			return err
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to start multipart upload, reason: %w", err)
+		}
+		state = &uploadState{UploadID: aws.StringValue(upload.UploadId), Key: key, PartSize: partSize}
+		if err := state.save(stateFile); err != nil {
+			return "", err
+		}
+	}
+
+	done := map[int64]bool{}
+	for _, part := range state.Parts {
+		done[part.PartNumber] = true
+	}
+
+	// A multipart upload needs at least one part, even for empty files
+	numParts := (fileInfo.Size() + partSize - 1) / partSize
+	if numParts == 0 {
+		numParts = 1
+	}
+
+	for partNumber := int64(1); partNumber <= numParts; partNumber++ {
+		offset := (partNumber - 1) * partSize
+		length := partSize
+		if offset+length > fileInfo.Size() {
+			length = fileInfo.Size() - offset
+		}
+
+		if done[partNumber] {
+			reader.Mux.Lock()
+			reader.Reads += length
+			reader.Bar.SetCurrent(reader.Reads)
+			reader.Mux.Unlock()
+
+			continue
+		}
+
+		reader.Mux.Lock()
+		reads := reader.Reads
+		reader.Mux.Unlock()
+
+		var part *s3.UploadPartOutput
+		err := retry(func() error {
+			// A retried part is read and signed again, so the progress of
+			// the failed attempt is removed before the part is sent. The
+			// part is only retried here, and not by the S3 client, which
+			// would read it again without resetting the progress.
+			reader.Mux.Lock()
+			reader.Reads = reads
+			for off := range reader.SignMap {
+				if off >= offset && off < offset+length {
+					delete(reader.SignMap, off)
+				}
+			}
+			reader.Bar.SetCurrent(reads)
+			reader.Mux.Unlock()
+
+			var err error
+			part, err = svc.UploadPartWithContext(aws.BackgroundContext(), &s3.UploadPartInput{
+				Body:       io.NewSectionReader(reader, offset, length),
+				Bucket:     aws.String(config.AccessKey),
+				Key:        aws.String(key),
+				PartNumber: aws.Int64(partNumber),
+				UploadId:   aws.String(state.UploadID),
+			}, func(r *request.Request) {
+				r.Retryer = client.NoOpRetryer{}
+			})
+
+			return err
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to upload part %d of %s, reason: %v", partNumber, f.Name(), err)
+		}
+
+		state.Parts = append(state.Parts, completedPart{PartNumber: partNumber, ETag: aws.StringValue(part.ETag)})
+		if err := state.save(stateFile); err != nil {
+			return "", err
+		}
+	}
+
+	// Parts must be listed in ascending order when completing the upload
+	sort.Slice(state.Parts, func(i, j int) bool {
+		return state.Parts[i].PartNumber < state.Parts[j].PartNumber
+	})
+	parts := make([]*s3.CompletedPart, 0, len(state.Parts))
+	for _, part := range state.Parts {
+		parts = append(parts, &s3.CompletedPart{PartNumber: aws.Int64(part.PartNumber), ETag: aws.String(part.ETag)})
+	}
+
+	err = retry(func() error {
+		_, err := svc.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(config.AccessKey),
+			Key:             aws.String(key),
+			UploadId:        aws.String(state.UploadID),
+			MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+		})
+
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to complete multipart upload, reason: %w", err)
+	}
+
+	if err := os.Remove(stateFile); err != nil {
+		log.Errorf("failed to remove upload state file %s, reason: %v", stateFile, err)
+	}
+
+	// Create a presigned URL of the object to report the same location as
+	// the regular uploader does
+	getReq, _ := svc.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(config.AccessKey),
+		Key:    aws.String(key),
+	})
+	getReq.Config.Credentials = credentials.AnonymousCredentials
+	location, _, _ := getReq.PresignRequest(1)
+
+	return location, nil
+}
+
+// uploadExists checks that the multipart upload with uploadID of key has not
+// been completed or aborted, so that more parts can be added to it
+func uploadExists(svc *s3.S3, key, uploadID string, config *helpers.Config) (bool, error) {
+	err := retry(func() error {
+		_, err := svc.ListParts(&s3.ListPartsInput{
+			Bucket:   aws.String(config.AccessKey),
+			Key:      aws.String(key),
+			UploadId: aws.String(uploadID),
+			MaxParts: aws.Int64(1),
+		})
+
+		return err
+	})
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && awsErr.Code() == s3.ErrCodeNoSuchUpload {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to check the multipart upload, reason: %w", err)
+	}
+
+	return true, nil
+}
+
+// retry calls fn until it succeeds or -max-retries retries have failed.
+// Requests that are rejected by the backend with a client error, other than
+// timeouts and throttling, are not retried.
+func retry(fn func() error) error {
+	return helpers.RetryWithBackoff(*maxRetries+1, retryDelay, func() error {
+		err := fn()
+		var reqErr awserr.RequestFailure
+		if errors.As(err, &reqErr) {
+			code := reqErr.StatusCode()
+			if code >= 400 && code < 500 && code != http.StatusRequestTimeout && code != http.StatusTooManyRequests {
+				return &helpers.PermanentError{Err: err}
+			}
+		}
+
+		return err
+	})
+}
+
 // Function createFilePaths returns a slice with all absolute paths to files within a directory recursively
 // and a slice with the corresponding relative paths to the given directory
 func createFilePaths(dirPath string) ([]string, []string, error) {
@@ -210,14 +837,20 @@ func createFilePaths(dirPath string) ([]string, []string, error) {
 	}
 
 	// List all directory contents recursively including relative paths
-	err = filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
+	err = filepath.WalkDir(dirPath, func(path string, entry fs.DirEntry, err error) error {
+		// Files and folders that cannot be read are skipped, so that they
+		// do not stop the upload of the rest of the folder
 		if err != nil {
-			fmt.Println(err)
+			log.Warnf("Skipping %s, reason: %v", path, err)
 
-			return err
+			return nil
 		}
-		// Exclude folders
-		if !info.IsDir() {
+		// Only regular files are uploaded, folders, symlinks and other
+		// special files are skipped
+		if !entry.IsDir() && !entry.Type().IsRegular() {
+			log.Infof("Skipping %s since it is not a regular file", path)
+		}
+		if entry.Type().IsRegular() {
 			// Write relative file paths in a list
 			files = append(files, path)
 
@@ -225,7 +858,7 @@ func createFilePaths(dirPath string) ([]string, []string, error) {
 			// Remove possible trailing "/" so that "path" and "path/" behave the same
 			dirPath = strings.TrimSuffix(dirPath, string(os.PathSeparator))
 			pathToTrim := strings.TrimSuffix(dirPath, filepath.Base(dirPath))
-			outPath := formatUploadFilePath(strings.TrimPrefix(path, pathToTrim))
+			outPath := FormatUploadFilePath(strings.TrimPrefix(path, pathToTrim))
 			outFiles = append(outFiles, outPath)
 		}
 
@@ -239,9 +872,34 @@ func createFilePaths(dirPath string) ([]string, []string, error) {
 	return files, outFiles, nil
 }
 
-// formatUploadFilePath ensures that path separators are "/", and that special
+// normalizePrefix checks that a key prefix only contains characters that are
+// safe to use in URL paths, and removes leading, trailing and repeated
+// slashes from it.
+func normalizePrefix(prefix string) (string, error) {
+	if prefix == "" {
+		return "", nil
+	}
+
+	var parts []string
+	for _, part := range strings.Split(prefix, "/") {
+		switch {
+		case part == "":
+			continue
+		case part == "." || part == ".." || !prefixPattern.MatchString(part):
+			return "", fmt.Errorf("invalid prefix: %s", prefix)
+		}
+		parts = append(parts, part)
+	}
+
+	return strings.Join(parts, "/"), nil
+}
+
+// prefixPattern matches the path segments that are allowed in key prefixes
+var prefixPattern = regexp.MustCompile(`^[A-Za-z0-9._~-]+$`)
+
+// FormatUploadFilePath ensures that path separators are "/", and that special
 // characters are replaced with safe characters.
-func formatUploadFilePath(filePath string) string {
+func FormatUploadFilePath(filePath string) string {
 
 	outPath := filepath.ToSlash(filePath)
 
@@ -253,18 +911,129 @@ func formatUploadFilePath(filePath string) string {
 	return outPath
 }
 
+// withIndexFiles returns the files and their upload paths with the index file
+// of each file, see helpers.IndexFile, added after it, unless the index file
+// is already in the list
+func withIndexFiles(files, outFiles []string) ([]string, []string, error) {
+	included := map[string]bool{}
+	for _, file := range files {
+		included[filepath.Clean(file)] = true
+	}
+
+	var allFiles, allOutFiles []string
+	for k, file := range files {
+		allFiles = append(allFiles, file)
+		allOutFiles = append(allOutFiles, outFiles[k])
+
+		index, found := helpers.IndexFile(file)
+		if !found || included[filepath.Clean(index)] {
+			continue
+		}
+		if !helpers.FileExists(index) {
+			return nil, nil, fmt.Errorf("index file %s of %s not found", index, file)
+		}
+		included[filepath.Clean(index)] = true
+		allFiles = append(allFiles, index)
+		allOutFiles = append(allOutFiles, path.Join(path.Dir(outFiles[k]), FormatUploadFilePath(filepath.Base(index))))
+	}
+
+	return allFiles, allOutFiles, nil
+}
+
+// printUploadPlan checks that the files can be uploaded, and prints the keys
+// that the files would be uploaded to, without uploading anything.
+func printUploadPlan(files, outFiles []string, targetDir string) error {
+	if *pubKeyPath != "" && !helpers.FileIsReadable(*pubKeyPath) {
+		return fmt.Errorf("cannot read public key file %s", *pubKeyPath)
+	}
+
+	var totalBytes int64
+	for k, filename := range files {
+		if !helpers.FileIsReadable(filename) {
+			return fmt.Errorf("cannot read input file %s", filename)
+		}
+		if fileInfo, err := os.Stat(filename); err == nil {
+			totalBytes += fileInfo.Size()
+		}
+
+		encrypted, err := helpers.IsCrypt4GHFile(filename)
+		if err != nil {
+			return err
+		}
+
+		outFile := outFiles[k]
+		switch {
+		case *pubKeyPath != "" && (!encrypted || *forceReencrypt):
+			outFile += ".c4gh"
+		case !encrypted && !*forceUnencrypted:
+			return fmt.Errorf("input file %s is not encrypted", filename)
+		}
+
+		fmt.Printf("%s -> %s\n", filename, strings.TrimPrefix(path.Join(targetDir, outFile), "/"))
+	}
+	fmt.Printf("Dry run: %d file(s), %s, would be uploaded\n", len(files), helpers.FormatBytes(totalBytes))
+
+	return nil
+}
+
+// readStdin writes all data piped to the program to a temporary file, and
+// returns the name of the file
+func readStdin() (string, error) {
+	tmpFile, err := os.CreateTemp("", "sda-cli-stdin-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary file, reason: %w", err)
+	}
+	defer func() {
+		if err := tmpFile.Close(); err != nil {
+			log.Errorf("Error closing file: %s\n", err)
+		}
+	}()
+
+	if _, err = io.Copy(tmpFile, os.Stdin); err != nil {
+		if err := os.Remove(tmpFile.Name()); err != nil {
+			log.Errorf("Error removing temporary file: %s\n", err)
+		}
+
+		return "", fmt.Errorf("failed to read from stdin, reason: %w", err)
+	}
+
+	return tmpFile.Name(), nil
+}
+
 // Upload function uploads files to the s3 bucket. Input can be files or
 // directories to be uploaded recursively
 func Upload(args []string) error {
 	var files []string
 	var outFiles []string
+	var stdinFile string
 	*pubKeyPath = ""
 	*targetDir = ""
+	*concurrency = 1
+	*outName = ""
+	*maxRate = ""
+	*keyPrefix = ""
+	*manifestPath = defaultManifest
 
 	// Call ParseArgs to take care of all the flag parsing
 	err := helpers.ParseArgs(args, Args)
 	if err != nil {
-		return fmt.Errorf("failed parsing arguments, reason: %v", err)
+		return fmt.Errorf("failed parsing arguments, reason: %w", err)
+	}
+
+	if *concurrency < 1 {
+		return errors.New("concurrency must be at least 1")
+	}
+
+	// Files are encrypted anew on every run, which gives a different file
+	// each time, so the parts of an earlier upload can never be reused
+	if *resumeUpload && (*encryptFiles || *pubKeyPath != "") {
+		return errors.New("-resume cannot be combined with -encrypt or --encrypt-with-key, encrypt the files with the encrypt command first and upload the .c4gh files with -resume")
+	}
+
+	if *maxRate != "" {
+		if _, err := helpers.ParseRate(*maxRate); err != nil {
+			return err
+		}
 	}
 
 	// Check that specified target directory is valid, i.e. not a filepath or a flag
@@ -280,19 +1049,22 @@ func Upload(args []string) error {
 		return errors.New(*targetDir + " is not a valid target directory")
 	}
 
-	// Get the configuration file or the .sda-cli-session
-	config, err := helpers.GetAuth(*configPath)
+	// The prefix is prepended to the target directory of all files
+	prefix, err := normalizePrefix(*keyPrefix)
 	if err != nil {
 		return err
 	}
+	uploadDir := path.Join(prefix, filepath.ToSlash(*targetDir))
 
-	expiring, err := helpers.CheckTokenExpiration(config.AccessToken)
+	// Get the configuration file or the .sda-cli-session
+	config, err := helpers.GetAuth(*configPath, *profile)
 	if err != nil {
 		return err
 	}
-	if expiring {
-		fmt.Fprintln(os.Stderr, "The provided token expires in less than 24 hours")
-		fmt.Fprintln(os.Stderr, "Consider renewing the token.")
+
+	err = helpers.WarnTokenExpiration(config)
+	if err != nil {
+		return err
 	}
 
 	// Check that input file/folder list is not empty
@@ -300,9 +1072,51 @@ func Upload(args []string) error {
 		return errors.New("no files to upload")
 	}
 
+	// With -encrypt, the public key of the configuration is used, unless a
+	// key file is given
+	if *encryptFiles && *pubKeyPath == "" {
+		if config.PublicKey == "" {
+			return helpers.WithCategory(helpers.ErrConfig,
+				errors.New("no public key in the configuration, give one with --encrypt-with-key"))
+		}
+		*pubKeyPath, err = helpers.ConfigPublicKey(config)
+		if err != nil {
+			return err
+		}
+	}
+
 	// Check if input argument is a file or directory and
 	// populate file list for upload
 	for _, filePath := range Args.Args() {
+		// Data piped to the program is first written to a temporary file
+		if filePath == "-" {
+			if *outName == "" {
+				return errors.New("-outname is required when uploading from stdin")
+			}
+			if stdinFile != "" {
+				return errors.New("stdin can only be uploaded once")
+			}
+
+			stdinFile, err = readStdin()
+			if err != nil {
+				return err
+			}
+			// The encrypted copy of the data is removed as well, in case the
+			// data is encrypted before upload
+			defer func(name string) {
+				for _, file := range []string{name, name + ".c4gh"} {
+					if err := os.Remove(file); err != nil && !errors.Is(err, os.ErrNotExist) {
+						log.Errorf("Error removing temporary file: %s\n", err)
+					}
+				}
+			}(stdinFile)
+
+			files = append(files, stdinFile)
+			outFiles = append(outFiles, FormatUploadFilePath(*outName))
+
+			continue
+		}
+
 		fileInfo, err := os.Stat(filePath)
 		if err != nil {
 			return err
@@ -328,7 +1142,7 @@ func Upload(args []string) error {
 			outFiles = append(outFiles, upFilePaths...)
 		} else {
 			files = append(files, filePath)
-			outFiles = append(outFiles, formatUploadFilePath(filepath.Base(filePath)))
+			outFiles = append(outFiles, FormatUploadFilePath(filepath.Base(filePath)))
 		}
 	}
 
@@ -337,21 +1151,74 @@ func Upload(args []string) error {
 		return errors.New("no files to upload")
 	}
 
+	// The index files are added before the files are encrypted, so that
+	// they are encrypted as well
+	if *withIndex {
+		files, outFiles, err = withIndexFiles(files, outFiles)
+		if err != nil {
+			return err
+		}
+	}
+
+	if *dryRun {
+		return printUploadPlan(files, outFiles, uploadDir)
+	}
+
+	// The default manifest is replaced by every upload, but a manifest given
+	// with -manifest is kept unless overwriting it is asked for
+	if *manifestPath != defaultManifest && helpers.FileExists(*manifestPath) && !*overwriteManifest {
+		return fmt.Errorf("manifest file %s already exists, use -overwrite-manifest to overwrite it", *manifestPath)
+	}
+
 	if *pubKeyPath != "" {
-		// Prepare input arg list for Encrypt function
-		encryptArgs := []string{args[0], "-key", *pubKeyPath}
-		encryptArgs = append(encryptArgs, files...)
+		// Files that are already encrypted are uploaded as they are, unless
+		// re-encryption is forced
+		var toEncrypt []int
+		for k, filename := range files {
+			encrypted, err := helpers.IsCrypt4GHFile(filename)
+			if err != nil {
+				return err
+			}
+			if encrypted && !*forceReencrypt {
+				fmt.Printf("File %s is already encrypted, skipping encryption\n", filename)
 
-		if err = encrypt.Encrypt(encryptArgs); err != nil {
-			return err
+				continue
+			}
+			toEncrypt = append(toEncrypt, k)
+		}
+
+		if len(toEncrypt) > 0 {
+			// Prepare input arg list for Encrypt function
+			encryptArgs := []string{args[0], "-key", *pubKeyPath}
+			if *forceReencrypt {
+				encryptArgs = append(encryptArgs, "-force-reencrypt")
+			}
+			for _, k := range toEncrypt {
+				encryptArgs = append(encryptArgs, files[k])
+			}
+
+			if err = encrypt.Encrypt(encryptArgs); err != nil {
+				return err
+			}
 		}
 
 		// Modify slices so that we upload only the encrypted files
-		for k := 0; k < len(files); k++ {
+		for _, k := range toEncrypt {
 			files[k] += ".c4gh"
 			outFiles[k] += ".c4gh"
 		}
+
+		// The files encrypted with -encrypt are only kept on request
+		if *encryptFiles && !*keepEncrypted {
+			defer func() {
+				for _, k := range toEncrypt {
+					if err := os.Remove(files[k]); err != nil && !errors.Is(err, os.ErrNotExist) {
+						log.Errorf("Error removing encrypted file: %s\n", err)
+					}
+				}
+			}()
+		}
 	}
 
-	return uploadFiles(files, outFiles, filepath.ToSlash(*targetDir), config)
+	return uploadFiles(files, outFiles, uploadDir, config)
 }
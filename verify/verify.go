@@ -0,0 +1,148 @@
+package verify
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/NBISweden/sda-cli/helpers"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	log "github.com/sirupsen/logrus"
+)
+
+// Help text and command line flags.
+
+// Usage text that will be displayed as command line help text when using the
+// `help verify` command
+var Usage = `
+USAGE: %s verify [-config <s3config-file>] [-profile <name>] [manifest-file]
+
+verify:
+    Verifies that the files listed in a manifest written by the upload
+    command are present in the Sensitive Data Archive (SDA), and that
+    their sizes and checksums match the local files.  A named profile
+    in ~/.sda-cli/config can be used with '-profile'.
+`
+
+// ArgHelp is the suffix text that will be displayed after the argument list in
+// the module help
+var ArgHelp = `
+    [manifest-file]
+        The manifest file written by the upload command.`
+
+// Args is a flagset that needs to be exported so that it can be written to the
+// main program help
+var Args = flag.NewFlagSet("verify", flag.ExitOnError)
+
+var configPath = Args.String("config", "",
+	"S3 config file to use for verifying.")
+
+var profile = Args.String("profile", "",
+	"Named profile in ~/.sda-cli/config to use instead of the session file.")
+
+// Verify checks the files in a manifest against the objects in the archive
+func Verify(args []string) error {
+	// Call ParseArgs to take care of all the flag parsing
+	err := helpers.ParseArgs(args, Args)
+	if err != nil {
+		return fmt.Errorf("failed parsing arguments, reason: %w", err)
+	}
+
+	if len(Args.Args()) != 1 {
+		return errors.New("a single manifest file is required")
+	}
+
+	manifest, err := helpers.ReadManifest(Args.Args()[0])
+	if err != nil {
+		return err
+	}
+
+	// Get the configuration file or the .sda-cli-session
+	config, err := helpers.GetAuth(*configPath, *profile)
+	if err != nil {
+		return fmt.Errorf("failed to load config file, reason: %w", err)
+	}
+
+	err = helpers.WarnTokenExpiration(config)
+	if err != nil {
+		return err
+	}
+
+	sess, err := helpers.NewS3Session(config)
+	if err != nil {
+		return err
+	}
+	svc := s3.New(sess)
+
+	failed := 0
+	for _, entry := range manifest.Files {
+		if err := verifyEntry(svc, entry, config); err != nil {
+			log.Errorf("verification of %s failed, reason: %v", entry.Key, err)
+			fmt.Printf("FAILED %s: %v\n", entry.Key, err)
+			failed++
+
+			continue
+		}
+		fmt.Printf("OK     %s\n", entry.Key)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed verification", failed, len(manifest.Files))
+	}
+
+	return nil
+}
+
+// verifyEntry compares the object for a manifest entry with the size in the
+// manifest. If the local file is still available, its checksums are compared
+// both with the sha256 in the manifest and the ETag of the object.
+func verifyEntry(svc *s3.S3, entry helpers.ManifestEntry, config *helpers.Config) error {
+	head, err := svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(config.AccessKey),
+		Key:    aws.String(entry.Key),
+	})
+	if err != nil {
+		var reqErr awserr.RequestFailure
+		if errors.As(err, &reqErr) && reqErr.StatusCode() == 404 {
+			return errors.New("file is missing in the archive")
+		}
+
+		return fmt.Errorf("failed to get information about file, reason: %w", err)
+	}
+
+	if size := aws.Int64Value(head.ContentLength); size != entry.Size {
+		return fmt.Errorf("size %d in the archive does not match size %d in the manifest", size, entry.Size)
+	}
+
+	f, err := os.Open(filepath.Clean(entry.LocalPath))
+	if err != nil {
+		log.Warningf("local file %s is not available, only the size of %s is verified", entry.LocalPath, entry.Key)
+
+		return nil
+	}
+	defer f.Close()
+
+	remoteETag := strings.Trim(aws.StringValue(head.ETag), `"`)
+	partSize := int64(0)
+	if strings.Contains(remoteETag, "-") {
+		partSize = config.MultipartChunkSizeMb * 1024 * 1024
+	}
+	localETag, sha256sum, err := helpers.FileChecksums(f, partSize)
+	if err != nil {
+		return err
+	}
+
+	if !strings.EqualFold(sha256sum, entry.SHA256) {
+		return fmt.Errorf("local file %s has changed since it was uploaded", entry.LocalPath)
+	}
+	if localETag != remoteETag {
+		return errors.New("checksum in the archive does not match the local file")
+	}
+
+	return nil
+}
@@ -1,9 +1,19 @@
 package version
 
 import (
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/NBISweden/sda-cli/helpers"
+	log "github.com/sirupsen/logrus"
 )
 
 // Help text and command line flags.
@@ -11,10 +21,14 @@ import (
 // Usage text that will be displayed as command line help text when using the
 // `help version` command
 var Usage = `
-USAGE: %s version
+USAGE: %s version (-short) (-check-update)
 
 version:
-    Returns the version of the sda-cli tool.
+    Returns the version of the sda-cli tool, with the commit and the
+    date of the build if they are known.  With '-short', only the
+    version is printed, e.g. for scripts.  With '-check-update', the
+    latest release on GitHub is looked up as well, and a message is
+    printed if it is newer.
 `
 
 // ArgHelp is the suffix text that will be displayed after the argument list in
@@ -26,12 +40,144 @@ var ArgHelp = `
 // main program help
 var Args = flag.NewFlagSet("version", flag.ExitOnError)
 
+var checkUpdate = Args.Bool("check-update", false,
+	"Check if a newer release is available on GitHub.")
+
+var short = Args.Bool("short", false,
+	"Print only the version.")
+
+// Commit and BuildDate describe the build, and are set with
+// -ldflags "-X github.com/NBISweden/sda-cli/version.Commit=<sha>"
+var (
+	Commit    = "unknown"
+	BuildDate = "unknown"
+)
+
+// releasesURL is the GitHub API endpoint of the latest release
+var releasesURL = "https://api.github.com/repos/NBISweden/sda-cli/releases/latest"
+
+// checkTimeout is how long the update check may take, so that it does not
+// hold up users on slow networks
+var checkTimeout = 3 * time.Second
+
 // Returns the version of the sda-cli tool.
-func Version(ver string) error {
+func Version(args []string, ver string) error {
+	err := helpers.ParseArgs(args, Args)
+	if err != nil {
+		return fmt.Errorf("failed parsing arguments, reason: %w", err)
+	}
 	if len(Args.Args()) > 0 {
 		return errors.New("version does not take any arguments")
 	}
-	fmt.Println("sda-cli version: ", ver)
+	printVersion(os.Stdout, ver, *short)
+
+	if *checkUpdate {
+		printUpdate(os.Stdout, ver)
+	}
 
 	return nil
 }
+
+// printVersion writes the version to w, followed by the commit and the build
+// date if they were set when building, unless only the short version is
+// asked for
+func printVersion(w io.Writer, ver string, short bool) {
+	if short {
+		fmt.Fprintln(w, ver)
+
+		return
+	}
+
+	fmt.Fprintln(w, "sda-cli version: ", ver)
+	if Commit != "unknown" {
+		fmt.Fprintf(w, "Commit: %s\n", Commit)
+	}
+	if BuildDate != "unknown" {
+		fmt.Fprintf(w, "Built: %s\n", BuildDate)
+	}
+}
+
+// printUpdate writes a message to w if the latest release is newer than ver.
+// Nothing is written if the release cannot be looked up, since the check is
+// only a convenience.
+func printUpdate(w io.Writer, ver string) {
+	latest, err := latestRelease()
+	if err != nil {
+		log.Debugf("failed to check for updates, reason: %v", err)
+
+		return
+	}
+	if newerVersion(latest, ver) {
+		fmt.Fprintf(w, "A newer version is available: %s, see https://github.com/NBISweden/sda-cli/releases\n", latest)
+	}
+}
+
+// latestRelease returns the tag of the latest release on GitHub
+func latestRelease() (string, error) {
+	client := &http.Client{Timeout: checkTimeout}
+	resp, err := client.Get(releasesURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+
+	var release struct {
+		TagName string `json:"tag_name"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&release)
+	if err != nil {
+		return "", err
+	}
+
+	return release.TagName, nil
+}
+
+// newerVersion returns true if the version latest is newer than current. The
+// versions are compared as major.minor.patch, with or without a leading v,
+// and a current version that is not a release, like development, is never
+// older.
+func newerVersion(latest, current string) bool {
+	latestParts, ok := versionParts(latest)
+	if !ok {
+		return false
+	}
+	currentParts, ok := versionParts(current)
+	if !ok {
+		return false
+	}
+
+	for i := range latestParts {
+		if latestParts[i] != currentParts[i] {
+			return latestParts[i] > currentParts[i]
+		}
+	}
+
+	return false
+}
+
+// versionParts returns the major, minor and patch numbers of the version,
+// ignoring any pre-release or build suffix
+func versionParts(ver string) ([3]int, bool) {
+	var parts [3]int
+	ver = strings.TrimPrefix(strings.TrimSpace(ver), "v")
+	if i := strings.IndexAny(ver, "-+"); i >= 0 {
+		ver = ver[:i]
+	}
+
+	fields := strings.Split(ver, ".")
+	if len(fields) > 3 {
+		return parts, false
+	}
+	for i, field := range fields {
+		n, err := strconv.Atoi(field)
+		if err != nil {
+			return parts, false
+		}
+		parts[i] = n
+	}
+
+	return parts, true
+}
@@ -1,7 +1,12 @@
 package version
 
 import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
@@ -18,7 +23,81 @@ func TestVersionTestSuite(t *testing.T) {
 func (suite *VersionTests) TestGetVersion() {
 
 	// get version
-	err := Version("development")
+	err := Version([]string{"version"}, "development")
 	assert.NoError(suite.T(), err)
 
+	err = Version([]string{"version", "extra"}, "development")
+	assert.EqualError(suite.T(), err, "version does not take any arguments")
+}
+
+func (suite *VersionTests) TestPrintVersion() {
+	var out bytes.Buffer
+	printVersion(&out, "v0.1.5", false)
+	assert.Equal(suite.T(), "sda-cli version:  v0.1.5\n", out.String())
+
+	defer func() {
+		Commit = "unknown"
+		BuildDate = "unknown"
+	}()
+	Commit = "4f82124"
+	BuildDate = "2026-10-17T12:00:00Z"
+	out.Reset()
+	printVersion(&out, "v0.1.5", false)
+	assert.Equal(suite.T(), "sda-cli version:  v0.1.5\nCommit: 4f82124\nBuilt: 2026-10-17T12:00:00Z\n", out.String())
+
+	out.Reset()
+	printVersion(&out, "v0.1.5", true)
+	assert.Equal(suite.T(), "v0.1.5\n", out.String())
+}
+
+func (suite *VersionTests) TestPrintUpdate() {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"tag_name": "v0.2.0", "name": "sda-cli v0.2.0"}`)
+	}))
+	defer ts.Close()
+	defer func(url string) { releasesURL = url }(releasesURL)
+	releasesURL = ts.URL
+
+	var out bytes.Buffer
+	printUpdate(&out, "v0.1.5")
+	assert.Equal(suite.T(), "A newer version is available: v0.2.0, see https://github.com/NBISweden/sda-cli/releases\n", out.String())
+
+	out.Reset()
+	printUpdate(&out, "0.2.0")
+	assert.Empty(suite.T(), out.String())
+
+	// The check is skipped silently if the release cannot be looked up
+	releasesURL = ts.URL + "/missing\x00"
+	out.Reset()
+	printUpdate(&out, "v0.1.5")
+	assert.Empty(suite.T(), out.String())
+}
+
+func (suite *VersionTests) TestPrintUpdateTimeout() {
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer ts.Close()
+	defer close(done)
+	defer func(url string) { releasesURL = url }(releasesURL)
+	releasesURL = ts.URL
+	defer func(timeout time.Duration) { checkTimeout = timeout }(checkTimeout)
+	checkTimeout = 100 * time.Millisecond
+
+	start := time.Now()
+	var out bytes.Buffer
+	printUpdate(&out, "v0.1.5")
+	assert.Empty(suite.T(), out.String())
+	assert.Less(suite.T(), time.Since(start), checkTimeout+time.Second)
+}
+
+func (suite *VersionTests) TestNewerVersion() {
+	assert.True(suite.T(), newerVersion("v0.2.0", "v0.1.9"))
+	assert.True(suite.T(), newerVersion("v1.0.0", "0.10.3"))
+	assert.True(suite.T(), newerVersion("v0.1.10", "v0.1.9"))
+	assert.False(suite.T(), newerVersion("v0.1.9", "v0.1.9"))
+	assert.False(suite.T(), newerVersion("v0.1.9", "v0.2.0-rc1"))
+	assert.False(suite.T(), newerVersion("v0.2.0", "development"))
+	assert.False(suite.T(), newerVersion("latest", "v0.1.0"))
 }